@@ -0,0 +1,79 @@
+// Package main implements a tool for managing the OAuth authorization used by
+// the other commands. Run "auth login" to authorize the application
+// interactively, for example after a non-interactive capture reports that
+// re-authorization is required.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+
+	"github.com/sigh/nest-timelapse/internal/auth"
+)
+
+// Auth files and settings
+const (
+	credentialsFile = "credentials.json"
+	// passphraseEnv is the environment variable holding the passphrase used to
+	// encrypt the token
+	passphraseEnv = "NEST_TIMELAPSE_TOKEN_PASSPHRASE"
+)
+
+var (
+	credsDir     string
+	tokenKeyFile string
+	redirectPort int
+)
+
+// login authorizes the application and saves the token, replacing any
+// existing token
+func login(ctx context.Context) error {
+	tokenStore, err := auth.OpenTokenStore(credsDir, tokenKeyFile, os.Getenv(passphraseEnv))
+	if err != nil {
+		return err
+	}
+	credsPath := filepath.Join(credsDir, credentialsFile)
+
+	if err := auth.Login(ctx, tokenStore, credsPath, auth.Options{RedirectPort: redirectPort}); err != nil {
+		return err
+	}
+
+	fmt.Println("Authorization complete, token saved")
+	return nil
+}
+
+func main() {
+	flag.StringVar(&credsDir, "creds-dir", ".", "Directory containing credentials.json and the saved token")
+	flag.StringVar(&tokenKeyFile, "token-key-file", "", "Key file used to encrypt the saved token (or set "+passphraseEnv+")")
+	flag.IntVar(&redirectPort, "redirect-port", 0, "Local port that receives the OAuth redirect when authorizing (default 8080, or a random port if unavailable)")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [options] login\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  login: authorize the application and save the token\n\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() != 1 || flag.Arg(0) != "login" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	absCredsPath, err := filepath.Abs(credsDir)
+	if err != nil {
+		log.Fatalf("Failed to get absolute path for credentials directory: %v", err)
+	}
+	credsDir = absCredsPath
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if err := login(ctx); err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	"image/jpeg"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sigh/nest-timelapse/internal/auth"
+	"github.com/sigh/nest-timelapse/internal/frames"
+	"github.com/sigh/nest-timelapse/internal/sdm"
+	"github.com/sigh/nest-timelapse/internal/source"
+	"google.golang.org/api/smartdevicemanagement/v1"
+)
+
+// fakeJPEG is served by the test snapshot camera
+var fakeJPEG = []byte{0xFF, 0xD8, 0xFF, 0xD9}
+
+// newTestCapturer returns a capturer for a camera serving snapshots over HTTP
+func newTestCapturer(t *testing.T) (*capturer, *camera) {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(fakeJPEG)
+	}))
+	t.Cleanup(server.Close)
+
+	cam := &camera{
+		source:    source.NewSnapshot("Gate", server.URL, nil),
+		name:      "Gate",
+		id:        "http",
+		outputDir: t.TempDir(),
+	}
+	c := &capturer{cameras: []*camera{cam}, captureTimeout: 30 * time.Second}
+	return c, cam
+}
+
+func TestCaptureImage(t *testing.T) {
+	c, cam := newTestCapturer(t)
+
+	if err := c.captureImage(context.Background(), cam); err != nil {
+		t.Fatalf("captureImage() error = %v", err)
+	}
+
+	frames, _ := filepath.Glob(filepath.Join(cam.outputDir, "*", "*", "*", "nest_camera_frame_*.jpg"))
+	if len(frames) != 1 {
+		t.Fatalf("found %d frames, want 1", len(frames))
+	}
+	if data, err := os.ReadFile(frames[0]); err != nil || !bytes.Equal(data, fakeJPEG) {
+		t.Errorf("frame %s = %x, %v, want the snapshot", frames[0], data, err)
+	}
+}
+
+func TestSaveFrameWithRecordings(t *testing.T) {
+	_, cam := newTestCapturer(t)
+	tempDir := t.TempDir()
+	clip := filepath.Join(tempDir, "clip.mp4")
+	audio := filepath.Join(tempDir, "audio.ogg")
+	for _, recording := range []string{clip, audio} {
+		if err := os.WriteFile(recording, []byte(filepath.Base(recording)), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	frameTime := time.Date(2025, 5, 1, 12, 30, 0, 0, time.Local)
+	frame := &source.Frame{Image: fakeJPEG, Time: frameTime, Clip: clip, Audio: audio}
+	if err := saveFrame(cam, frame, frameTime); err != nil {
+		t.Fatalf("saveFrame() error = %v", err)
+	}
+
+	dateDir := filepath.Join(cam.outputDir, "2025", "05", "01")
+	for recording, saved := range map[string]string{
+		clip:  filepath.Join(dateDir, "nest_camera_frame_20250501_123000.mp4"),
+		audio: filepath.Join(dateDir, "nest_camera_frame_20250501_123000.ogg"),
+	} {
+		if data, err := os.ReadFile(saved); err != nil || string(data) != filepath.Base(recording) {
+			t.Errorf("recording %s = %q, %v, want %s", saved, data, err, filepath.Base(recording))
+		}
+		if _, err := os.Stat(recording); !os.IsNotExist(err) {
+			t.Errorf("temporary recording %s wasn't moved", recording)
+		}
+	}
+}
+
+func TestSaveFrameWritesSidecar(t *testing.T) {
+	_, cam := newTestCapturer(t)
+	var img bytes.Buffer
+	if err := jpeg.Encode(&img, image.NewGray(image.Rect(0, 0, 64, 48)), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	captureStart := time.Date(2025, 5, 1, 12, 29, 58, 0, time.UTC)
+	frameTime := time.Date(2025, 5, 1, 12, 30, 0, 0, time.Local)
+	frame := &source.Frame{Image: img.Bytes(), Time: frameTime, Metadata: map[string]string{
+		source.MetadataSource:          source.KindNestWebRTC,
+		source.MetadataCamera:          "Gate",
+		source.MetadataDeviceID:        "cam-1",
+		source.MetadataCodec:           "H264",
+		source.MetadataRoundTripTime:   "12.5",
+		source.MetadataPacketsReceived: "990",
+		source.MetadataPacketsLost:     "10",
+		source.MetadataJitter:          "1.5",
+		source.MetadataSharpness:       "120.50",
+		source.MetadataFrameIndex:      "2",
+	}}
+	if err := saveFrame(cam, frame, captureStart); err != nil {
+		t.Fatalf("saveFrame() error = %v", err)
+	}
+
+	framePath := filepath.Join(cam.outputDir, "2025", "05", "01", "nest_camera_frame_20250501_123000.jpg")
+	sidecar, err := frames.ReadSidecar(framePath)
+	if err != nil {
+		t.Fatalf("ReadSidecar() error = %v", err)
+	}
+	if sidecar.Camera != "Gate" || sidecar.DeviceID != "cam-1" || sidecar.Source != source.KindNestWebRTC || sidecar.Codec != "H264" {
+		t.Errorf("sidecar = %+v, want the camera, source and codec", sidecar)
+	}
+	if !sidecar.CaptureStart.Equal(captureStart) || sidecar.CaptureEnd.Before(captureStart) {
+		t.Errorf("capture = %v to %v, want from %v", sidecar.CaptureStart, sidecar.CaptureEnd, captureStart)
+	}
+	if sidecar.Width != 64 || sidecar.Height != 48 {
+		t.Errorf("size = %dx%d, want 64x48", sidecar.Width, sidecar.Height)
+	}
+	wantConnection := frames.ConnectionStats{RoundTripTimeMs: 12.5, PacketsReceived: 990, PacketsLost: 10, JitterMs: 1.5}
+	if sidecar.Connection == nil || *sidecar.Connection != wantConnection {
+		t.Errorf("Connection = %+v, want %+v", sidecar.Connection, wantConnection)
+	}
+	if sidecar.Scores[source.MetadataSharpness] != 120.5 || len(sidecar.Scores) != 1 {
+		t.Errorf("Scores = %v, want the sharpness", sidecar.Scores)
+	}
+	if sidecar.Metadata[source.MetadataFrameIndex] != "2" || len(sidecar.Metadata) != 1 {
+		t.Errorf("Metadata = %v, want only the frame index", sidecar.Metadata)
+	}
+}
+
+func TestSaveWebPFrameWritesSidecar(t *testing.T) {
+	_, cam := newTestCapturer(t)
+	// The header of a lossless 640x480 WebP image
+	webp := []byte("RIFF\x00\x00\x00\x00WEBPVP8L\x00\x00\x00\x00\x2f\x7f\xc2\x77\x00\x00\x00\x00\x00\x00")
+	frameTime := time.Date(2025, 5, 1, 12, 30, 0, 0, time.Local)
+	frame := &source.Frame{Image: webp, Time: frameTime, Metadata: map[string]string{
+		source.MetadataSource: source.KindNestWebRTC,
+	}}
+	if err := saveFrame(cam, frame, frameTime); err != nil {
+		t.Fatalf("saveFrame() error = %v", err)
+	}
+
+	framePath := filepath.Join(cam.outputDir, "2025", "05", "01", "nest_camera_frame_20250501_123000.webp")
+	sidecar, err := frames.ReadSidecar(framePath)
+	if err != nil {
+		t.Fatalf("ReadSidecar() error = %v", err)
+	}
+	if sidecar.Width != 640 || sidecar.Height != 480 {
+		t.Errorf("size = %dx%d, want 640x480", sidecar.Width, sidecar.Height)
+	}
+}
+
+func TestNewCapturerReauthRequired(t *testing.T) {
+	t.Setenv(passphraseEnv, "")
+	credsDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(credsDir, credentialsFile), []byte(`{"installed":{"client_id":"id","client_secret":"secret"}}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	hookOutput := filepath.Join(t.TempDir(), "hook")
+	config := &Config{
+		EnterpriseID:   "enterprise",
+		OutputDir:      t.TempDir(),
+		CredsDir:       credsDir,
+		CaptureTimeout: Duration(defaultCaptureTimeout),
+		NonInteractive: true,
+		ReauthHook:     `echo "$NEST_TIMELAPSE_ERROR" > ` + hookOutput,
+	}
+
+	_, err := newCapturer(context.Background(), config)
+	if !errors.Is(err, auth.ErrReauthRequired) {
+		t.Fatalf("newCapturer() error = %v, want ErrReauthRequired", err)
+	}
+	if code := exitCode(err); code != exitReauthRequired {
+		t.Errorf("exitCode() = %d, want %d", code, exitReauthRequired)
+	}
+	if output, err := os.ReadFile(hookOutput); err != nil || !bytes.Contains(output, []byte(auth.ErrReauthRequired.Error())) {
+		t.Errorf("reauth hook output = %q, %v, want the error", output, err)
+	}
+
+	if code := exitCode(errors.New("capture failed")); code != 1 {
+		t.Errorf("exitCode() of another error = %d, want 1", code)
+	}
+}
+
+func TestAddCameraSameRoom(t *testing.T) {
+	outputDir := t.TempDir()
+	c := &capturer{}
+	// Unnamed cameras are named after their room
+	for _, id := range []string{"cam-1", "cam-2"} {
+		device := &sdm.Device{
+			Name: "enterprises/enterprise/devices/" + id,
+			ParentRelations: []*smartdevicemanagement.GoogleHomeEnterpriseSdmV1ParentRelation{{
+				Parent:      "enterprises/enterprise/structures/home/rooms/garden",
+				DisplayName: "Garden",
+			}},
+		}
+		src := source.NewSnapshot(sdm.DisplayName(device), "http://camera.invalid/", nil)
+		if err := c.addCamera(src, sdm.DeviceID(device), outputDir); err != nil {
+			t.Fatalf("addCamera(%s) error = %v", id, err)
+		}
+	}
+
+	want := []string{filepath.Join(outputDir, "garden"), filepath.Join(outputDir, "cam_2")}
+	if len(c.cameras) != len(want) {
+		t.Fatalf("added %d cameras, want %d", len(c.cameras), len(want))
+	}
+	for i, cam := range c.cameras {
+		if cam.name != "Garden" || cam.outputDir != want[i] {
+			t.Errorf("camera %d = %q in %s, want %q in %s", i, cam.name, cam.outputDir, "Garden", want[i])
+		}
+	}
+
+	// A third camera can't fall back to a directory that is already used
+	if err := c.addCamera(source.NewSnapshot("Garden", "http://camera.invalid/", nil), "cam-2", outputDir); err == nil {
+		t.Error("addCamera() of a camera sharing a directory succeeded, want error")
+	}
+}
+
+func TestStreamCameraPollsSources(t *testing.T) {
+	c, cam := newTestCapturer(t)
+
+	// Frames are named by the second, so poll for long enough to save two
+	ctx, cancel := context.WithTimeout(context.Background(), 2500*time.Millisecond)
+	defer cancel()
+	if err := c.streamCamera(ctx, cam, time.Second, time.Second); err != nil {
+		t.Fatalf("streamCamera() error = %v", err)
+	}
+
+	frames, _ := filepath.Glob(filepath.Join(cam.outputDir, "*", "*", "*", "nest_camera_frame_*.jpg"))
+	if len(frames) < 2 {
+		t.Errorf("found %d frames, want at least 2", len(frames))
+	}
+}
+
+func TestStreamCameraStopsWhenExhausted(t *testing.T) {
+	c, _ := newTestCapturer(t)
+	replayDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(replayDir, "frame.jpg"), fakeJPEG, 0644); err != nil {
+		t.Fatal(err)
+	}
+	src, err := source.NewDirectory("Replay", replayDir)
+	if err != nil {
+		t.Fatalf("NewDirectory() error = %v", err)
+	}
+	cam := &camera{source: src, name: "Replay", id: "directory", outputDir: t.TempDir()}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := c.streamCamera(ctx, cam, 10*time.Millisecond, time.Second); err != nil {
+		t.Fatalf("streamCamera() error = %v", err)
+	}
+	if ctx.Err() != nil {
+		t.Error("streamCamera() didn't stop once the directory was replayed")
+	}
+}
@@ -0,0 +1,429 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sigh/nest-timelapse/internal/frames"
+	"github.com/sigh/nest-timelapse/internal/source"
+	"github.com/sigh/nest-timelapse/internal/video"
+	"github.com/sigh/nest-timelapse/internal/webrtc"
+)
+
+// Duration is a time.Duration that is written as a string (e.g. "5m") in the
+// config file
+type Duration time.Duration
+
+// UnmarshalJSON parses a duration string such as "30s" or "1h30m"
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration must be a string: %w", err)
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// stringList is a flag.Value holding a comma separated list of strings
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = nil
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*l = append(*l, item)
+		}
+	}
+	return nil
+}
+
+// Config holds the capture settings. Settings can be loaded from a JSON file
+// with -config, and any flags given on the command line override the file.
+type Config struct {
+	OutputDir    string `json:"outputDir"`
+	EnterpriseID string `json:"enterpriseId"`
+	CredsDir     string `json:"credsDir"`
+	TokenKeyFile string `json:"tokenKeyFile"`
+	RedirectPort int    `json:"redirectPort"`
+	// NonInteractive makes the capture fail instead of prompting the user when
+	// re-authorization is needed
+	NonInteractive bool `json:"nonInteractive"`
+	// ReauthHook is a shell command run when re-authorization is needed in
+	// non-interactive mode
+	ReauthHook string   `json:"reauthHook"`
+	Interval   Duration `json:"interval"`
+	MaxBackoff Duration `json:"maxBackoff"`
+	// Continuous keeps one stream open per camera and saves a frame from it
+	// every interval, instead of starting a new stream for each frame
+	Continuous bool `json:"continuous"`
+	// CaptureTimeout is the deadline for each capture from a camera
+	CaptureTimeout Duration `json:"captureTimeout"`
+	// Cameras selects cameras by device ID, display name or room. When empty,
+	// the first camera is captured directly into OutputDir.
+	Cameras []string `json:"cameras"`
+	// ICEServers are the STUN and TURN servers used for WebRTC. When empty,
+	// Google's public STUN server is used.
+	ICEServers []webrtc.ICEServer `json:"iceServers"`
+	// HostOnly disables STUN and TURN, using only local addresses
+	HostOnly bool `json:"hostOnly"`
+	// ICEInterfaces restricts WebRTC to the named network interfaces
+	ICEInterfaces []string `json:"iceInterfaces"`
+	// IPFamily restricts WebRTC to "ipv4" or "ipv6"
+	IPFamily string `json:"ipFamily"`
+	// UDPPorts restricts WebRTC to a range of local UDP ports, e.g. "50000-50100"
+	UDPPorts string `json:"udpPorts"`
+	// Sources are cameras to capture from other than Nest cameras. They can
+	// only be set in the config file.
+	Sources []SourceConfig `json:"sources"`
+	// SelectFrames is how many frames to decode from each WebRTC capture to
+	// choose the best still from, at most maxDecodedFrames. The first frame is
+	// saved when zero.
+	SelectFrames int `json:"selectFrames"`
+	// StackFrames is how many frames to decode from each WebRTC capture and
+	// stack into one still with less noise, at most maxDecodedFrames. Nothing
+	// is stacked when zero.
+	StackFrames int `json:"stackFrames"`
+	// StackMethod is how frames are stacked, "mean" or "median"
+	StackMethod string `json:"stackMethod"`
+	// Format is the format, "jpeg", "png" or "webp", of stills taken from
+	// video. Snapshots and replayed images are saved as they are.
+	Format string `json:"format"`
+	// Quality is the quality of JPEG and WebP stills, from 1 to 100. ffmpeg's
+	// default is used when zero.
+	Quality int `json:"quality"`
+	// Clip is the format, "mp4" or "mkv", of a video clip saved next to each
+	// frame. No clips are saved when empty.
+	Clip string `json:"clip"`
+	// ClipDuration is how long each clip is recorded for after the frame
+	ClipDuration Duration `json:"clipDuration"`
+	// ClipAudio records the camera's audio in clips
+	ClipAudio bool `json:"clipAudio"`
+	// Audio saves the audio from Nest cameras as an Ogg file next to each
+	// frame
+	Audio bool `json:"audio"`
+	// AudioLoudness measures how loud the audio from Nest cameras is around
+	// each frame
+	AudioLoudness bool `json:"audioLoudness"`
+	// AudioDuration is how long audio is recorded for after the frame
+	AudioDuration Duration `json:"audioDuration"`
+}
+
+// Default lengths of clips and audio recordings
+const (
+	defaultClipDuration  = 10 * time.Second
+	defaultAudioDuration = 10 * time.Second
+)
+
+// maxDecodedFrames is the most frames that -select-frames and -stack-frames
+// can decode from each capture, about two seconds of video. Every decoded
+// frame is held in memory until the still is chosen or stacked.
+const maxDecodedFrames = 60
+
+// stillFormat returns the format of stills taken from video
+func (c *Config) stillFormat() video.StillFormat {
+	return video.StillFormat{Format: c.Format, Quality: c.Quality}
+}
+
+// clipOptions returns the options for recording clips
+func (c *Config) clipOptions() source.ClipOptions {
+	return source.ClipOptions{
+		Format:   c.Clip,
+		Duration: time.Duration(c.ClipDuration),
+		Audio:    c.ClipAudio,
+	}
+}
+
+// audioOptions returns the options for recording audio
+func (c *Config) audioOptions() source.AudioOptions {
+	return source.AudioOptions{
+		Record:   c.Audio,
+		Loudness: c.AudioLoudness,
+		Duration: time.Duration(c.AudioDuration),
+	}
+}
+
+// Kinds of source that can be configured
+const (
+	sourceRTSP      = "rtsp"
+	sourceHTTP      = "http"
+	sourceDirectory = "directory"
+)
+
+// SourceConfig configures a camera that isn't a Nest camera
+type SourceConfig struct {
+	// Name names the camera and its subdirectory of OutputDir
+	Name string `json:"name"`
+	// Type is "rtsp" for a stream that ffmpeg can read, "http" for a URL
+	// serving JPEG snapshots, or "directory" to replay existing images
+	Type string `json:"type"`
+	// URL is the stream or snapshot URL
+	URL string `json:"url"`
+	// Dir is the directory of images to replay
+	Dir string `json:"dir"`
+}
+
+// validate checks that the source has the settings its type needs
+func (s *SourceConfig) validate() error {
+	if s.Name == "" {
+		return fmt.Errorf("source has no name")
+	}
+	switch s.Type {
+	case sourceRTSP, sourceHTTP:
+		if s.URL == "" {
+			return fmt.Errorf("%s source %q has no url", s.Type, s.Name)
+		}
+	case sourceDirectory:
+		if s.Dir == "" {
+			return fmt.Errorf("directory source %q has no dir", s.Name)
+		}
+	default:
+		return fmt.Errorf("source %q has unknown type %q (want %q, %q or %q)", s.Name, s.Type, sourceRTSP, sourceHTTP, sourceDirectory)
+	}
+	return nil
+}
+
+// open returns the configured source, taking stills in the format and
+// recording clips with the options if it can
+func (s *SourceConfig) open(still video.StillFormat, clip source.ClipOptions) (source.Source, error) {
+	switch s.Type {
+	case sourceRTSP:
+		return source.NewStream(s.Name, s.URL, still, clip), nil
+	case sourceHTTP:
+		return source.NewSnapshot(s.Name, s.URL, nil), nil
+	case sourceDirectory:
+		return source.NewDirectory(s.Name, s.Dir)
+	default:
+		return nil, fmt.Errorf("source %q has unknown type %q", s.Name, s.Type)
+	}
+}
+
+// iceServerList is a flag.Value setting the ICE servers from a comma separated
+// list of URLs, one server per URL
+type iceServerList []webrtc.ICEServer
+
+func (l *iceServerList) String() string {
+	var urls []string
+	for _, server := range *l {
+		urls = append(urls, server.URLs...)
+	}
+	return strings.Join(urls, ",")
+}
+
+func (l *iceServerList) Set(value string) error {
+	var urls stringList
+	if err := urls.Set(value); err != nil {
+		return err
+	}
+	*l = nil
+	for _, url := range urls {
+		*l = append(*l, webrtc.ICEServer{URLs: []string{url}})
+	}
+	return nil
+}
+
+// parsePortRange parses a port range such as "50000-50100"
+func parsePortRange(ports string) (uint16, uint16, error) {
+	minPort, maxPort, ok := strings.Cut(ports, "-")
+	if !ok {
+		return 0, 0, fmt.Errorf("invalid port range %q (want min-max)", ports)
+	}
+	portMin, err := strconv.ParseUint(strings.TrimSpace(minPort), 10, 16)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid port range %q: %w", ports, err)
+	}
+	portMax, err := strconv.ParseUint(strings.TrimSpace(maxPort), 10, 16)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid port range %q: %w", ports, err)
+	}
+	if portMin == 0 || portMin > portMax {
+		return 0, 0, fmt.Errorf("invalid port range %q", ports)
+	}
+	return uint16(portMin), uint16(portMax), nil
+}
+
+// webrtcOptions returns the WebRTC options for the config
+func (c *Config) webrtcOptions() (webrtc.Options, error) {
+	opts := webrtc.DefaultOptions()
+	if len(c.ICEServers) > 0 {
+		opts.ICEServers = c.ICEServers
+	}
+	opts.HostOnly = c.HostOnly
+	opts.Interfaces = c.ICEInterfaces
+	if c.IPFamily != "" && c.IPFamily != webrtc.IPFamilyIPv4 && c.IPFamily != webrtc.IPFamilyIPv6 {
+		return opts, fmt.Errorf("ip-family must be %q or %q", webrtc.IPFamilyIPv4, webrtc.IPFamilyIPv6)
+	}
+	opts.IPFamily = c.IPFamily
+	if c.UDPPorts != "" {
+		var err error
+		if opts.PortMin, opts.PortMax, err = parsePortRange(c.UDPPorts); err != nil {
+			return opts, err
+		}
+	}
+	return opts, nil
+}
+
+// loadConfig reads a JSON config file into config, leaving any settings not
+// present in the file unchanged
+func loadConfig(filename string, config *Config) error {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return fmt.Errorf("failed to read config file %s: %w", filename, err)
+	}
+	if err := json.Unmarshal(data, config); err != nil {
+		return fmt.Errorf("failed to parse config file %s: %w", filename, err)
+	}
+	return nil
+}
+
+func parseArgs() (*Config, error) {
+	config := &Config{
+		OutputDir:      ".",
+		CredsDir:       ".",
+		MaxBackoff:     Duration(defaultMaxBackoff),
+		CaptureTimeout: Duration(defaultCaptureTimeout),
+		ClipDuration:   Duration(defaultClipDuration),
+		AudioDuration:  Duration(defaultAudioDuration),
+		StackMethod:    video.StackMean,
+		Format:         frames.FormatJPEG,
+	}
+
+	var configFile string
+	flag.StringVar(&configFile, "config", "", "JSON config file. Flags override values from the file")
+	flag.StringVar(&config.OutputDir, "output-dir", config.OutputDir, "Directory to save captured frames")
+	flag.StringVar(&config.EnterpriseID, "enterprise-id", "", "Google Workspace enterprise ID where the Nest cameras are registered. Not needed if only sources from the config file are captured")
+	flag.StringVar(&config.CredsDir, "creds-dir", config.CredsDir, "Directory containing credentials.json and the saved token")
+	flag.StringVar(&config.TokenKeyFile, "token-key-file", "", "Key file used to encrypt the saved token (or set "+passphraseEnv+")")
+	flag.IntVar(&config.RedirectPort, "redirect-port", 0, "Local port that receives the OAuth redirect when authorizing (default 8080, or a random port if unavailable)")
+	flag.BoolVar(&config.NonInteractive, "non-interactive", false, fmt.Sprintf("Never prompt for authorization; exit with code %d if re-authorization is needed", exitReauthRequired))
+	flag.StringVar(&config.ReauthHook, "reauth-hook", "", "Shell command to run when re-authorization is needed in non-interactive mode. The error is passed in $NEST_TIMELAPSE_ERROR")
+	flag.DurationVar((*time.Duration)(&config.Interval), "interval", 0, "Run as a daemon, capturing a frame at this interval (e.g. '5m'). Captures once if zero")
+	flag.BoolVar(&config.Continuous, "continuous", false, "Keep one stream open per camera and save a frame from it every interval, reconnecting if it fails. Requires -interval")
+	flag.DurationVar((*time.Duration)(&config.MaxBackoff), "max-backoff", defaultMaxBackoff, "Maximum delay between retries of failed captures in daemon mode")
+	flag.DurationVar((*time.Duration)(&config.CaptureTimeout), "capture-timeout", defaultCaptureTimeout, "Deadline for each capture from a camera, from negotiating the stream to saving the frame")
+	flag.Var((*stringList)(&config.Cameras), "cameras", "Comma separated cameras to capture, by device ID, display name or room. Each camera is saved to its own subdirectory of output-dir")
+	flag.Var((*iceServerList)(&config.ICEServers), "ice-servers", "Comma separated STUN and TURN server URLs for WebRTC (default "+webrtc.DefaultSTUNServer+")")
+	var iceUsername, iceCredential string
+	flag.StringVar(&iceUsername, "ice-username", "", "Username for TURN servers that don't have one in the config file")
+	flag.StringVar(&iceCredential, "ice-credential", "", "Credential for TURN servers that don't have one in the config file")
+	flag.BoolVar(&config.HostOnly, "host-only", false, "Use only local addresses for WebRTC, without STUN or TURN")
+	flag.Var((*stringList)(&config.ICEInterfaces), "ice-interfaces", "Comma separated network interfaces to use for WebRTC (default all)")
+	flag.StringVar(&config.IPFamily, "ip-family", "", "Restrict WebRTC to \"ipv4\" or \"ipv6\" (default both)")
+	flag.StringVar(&config.UDPPorts, "udp-ports", "", "Range of local UDP ports to use for WebRTC, e.g. \"50000-50100\"")
+	flag.IntVar(&config.SelectFrames, "select-frames", 0, fmt.Sprintf("Decode this many frames, up to %d, from each capture over WebRTC and save the sharpest, most stable one instead of the first", maxDecodedFrames))
+	flag.IntVar(&config.StackFrames, "stack-frames", 0, fmt.Sprintf("Decode this many frames, up to %d, from each capture over WebRTC and stack them into one still, reducing night noise", maxDecodedFrames))
+	flag.StringVar(&config.StackMethod, "stack-method", config.StackMethod, "How stacked frames are combined: \"mean\" or \"median\"")
+	flag.StringVar(&config.Format, "format", config.Format, "Format of stills taken from video: \"jpeg\", \"png\" (lossless) or \"webp\"")
+	flag.IntVar(&config.Quality, "quality", 0, "Quality of JPEG and WebP stills, from 1 to 100 (default ffmpeg's)")
+	flag.StringVar(&config.Clip, "clip", "", "Save a video clip in this format (\"mp4\" or \"mkv\") next to each frame")
+	flag.DurationVar((*time.Duration)(&config.ClipDuration), "clip-duration", defaultClipDuration, "How long to record each clip for after the frame is taken")
+	flag.BoolVar(&config.ClipAudio, "clip-audio", false, "Record the camera's audio in clips")
+	flag.BoolVar(&config.Audio, "audio", false, "Save the audio from Nest cameras as an Ogg file next to each frame")
+	flag.BoolVar(&config.AudioLoudness, "audio-loudness", false, "Measure and log how loud the audio from Nest cameras is around each frame")
+	flag.DurationVar((*time.Duration)(&config.AudioDuration), "audio-duration", defaultAudioDuration, "How long to record audio for after the frame is taken")
+	flag.Parse()
+
+	if configFile != "" {
+		if err := loadConfig(configFile, config); err != nil {
+			return nil, err
+		}
+		// Parse the flags again so that they take precedence over the file
+		flag.Parse()
+	}
+
+	if config.EnterpriseID == "" && len(config.Sources) == 0 {
+		return nil, fmt.Errorf("enterprise-id is required unless sources are configured")
+	}
+	if config.EnterpriseID == "" && len(config.Cameras) > 0 {
+		return nil, fmt.Errorf("cameras selects Nest cameras, which require enterprise-id")
+	}
+	for i := range config.Sources {
+		if err := config.Sources[i].validate(); err != nil {
+			return nil, err
+		}
+	}
+	if config.Interval < 0 {
+		return nil, fmt.Errorf("interval must not be negative")
+	}
+	if config.Continuous && time.Duration(config.Interval) < time.Second {
+		// Frames are named by the second they were taken in
+		return nil, fmt.Errorf("continuous mode requires an interval of at least 1s")
+	}
+	if config.MaxBackoff <= 0 {
+		return nil, fmt.Errorf("max-backoff must be positive")
+	}
+	if config.CaptureTimeout <= 0 {
+		return nil, fmt.Errorf("capture-timeout must be positive")
+	}
+	if config.SelectFrames < 0 || config.StackFrames < 0 {
+		return nil, fmt.Errorf("select-frames and stack-frames must not be negative")
+	}
+	if config.SelectFrames > maxDecodedFrames || config.StackFrames > maxDecodedFrames {
+		return nil, fmt.Errorf("select-frames and stack-frames must be at most %d", maxDecodedFrames)
+	}
+	if config.SelectFrames > 1 && config.StackFrames > 1 {
+		return nil, fmt.Errorf("select-frames and stack-frames can't be used together")
+	}
+	if config.StackMethod != video.StackMean && config.StackMethod != video.StackMedian {
+		return nil, fmt.Errorf("stack-method must be %q or %q", video.StackMean, video.StackMedian)
+	}
+	if err := config.stillFormat().Validate(); err != nil {
+		return nil, err
+	}
+	if config.Clip != "" {
+		if config.Clip != video.ClipFormatMP4 && config.Clip != video.ClipFormatMKV {
+			return nil, fmt.Errorf("clip must be %q or %q", video.ClipFormatMP4, video.ClipFormatMKV)
+		}
+		if config.Continuous {
+			return nil, fmt.Errorf("clips can't be saved in continuous mode")
+		}
+		if config.ClipDuration <= 0 || config.ClipDuration >= config.CaptureTimeout {
+			return nil, fmt.Errorf("clip-duration must be positive and shorter than capture-timeout")
+		}
+	}
+	if config.audioOptions().Enabled() {
+		if config.Continuous {
+			return nil, fmt.Errorf("audio can't be recorded in continuous mode")
+		}
+		if config.AudioDuration <= 0 || config.AudioDuration >= config.CaptureTimeout {
+			return nil, fmt.Errorf("audio-duration must be positive and shorter than capture-timeout")
+		}
+	}
+	for i, server := range config.ICEServers {
+		if server.Username == "" && server.Credential == "" {
+			config.ICEServers[i].Username = iceUsername
+			config.ICEServers[i].Credential = iceCredential
+		}
+	}
+	if _, err := config.webrtcOptions(); err != nil {
+		return nil, err
+	}
+
+	// Convert to absolute paths for consistent handling
+	absOutputPath, err := filepath.Abs(config.OutputDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get absolute path for output directory: %w", err)
+	}
+	config.OutputDir = absOutputPath
+
+	absCredsPath, err := filepath.Abs(config.CredsDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get absolute path for credentials directory: %w", err)
+	}
+	config.CredsDir = absCredsPath
+
+	return config, nil
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"os"
+	"strconv"
+	"testing"
+)
+
+// parseTestArgs runs parseArgs on the command line arguments
+func parseTestArgs(t *testing.T, args ...string) (*Config, error) {
+	t.Helper()
+	oldArgs, oldFlags := os.Args, flag.CommandLine
+	t.Cleanup(func() {
+		os.Args, flag.CommandLine = oldArgs, oldFlags
+	})
+	os.Args = append([]string{"capture"}, args...)
+	flag.CommandLine = flag.NewFlagSet("capture", flag.ContinueOnError)
+	flag.CommandLine.SetOutput(io.Discard)
+	return parseArgs()
+}
+
+func TestParseArgs(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		wantErr bool
+	}{
+		{"defaults", nil, false},
+		{"max backoff", []string{"-max-backoff", "30s"}, false},
+		{"zero max backoff", []string{"-max-backoff", "0"}, true},
+		{"negative max backoff", []string{"-max-backoff", "-1s"}, true},
+		{"zero capture timeout", []string{"-capture-timeout", "0"}, true},
+		{"most select frames", []string{"-select-frames", strconv.Itoa(maxDecodedFrames)}, false},
+		{"too many select frames", []string{"-select-frames", strconv.Itoa(maxDecodedFrames + 1)}, true},
+		{"most stack frames", []string{"-stack-frames", strconv.Itoa(maxDecodedFrames)}, false},
+		{"too many stack frames", []string{"-stack-frames", strconv.Itoa(maxDecodedFrames + 1)}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := append([]string{"-enterprise-id", "enterprise"}, tt.args...)
+			if _, err := parseTestArgs(t, args...); (err != nil) != tt.wantErr {
+				t.Errorf("parseArgs(%q) error = %v, wantErr %v", args, err, tt.wantErr)
+			}
+		})
+	}
+}
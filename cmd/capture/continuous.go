@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/sigh/nest-timelapse/internal/auth"
+	"github.com/sigh/nest-timelapse/internal/source"
+)
+
+// runContinuous keeps a stream open to each camera, saving a frame from it
+// every interval until the context is cancelled. Streams are extended before
+// they expire, and reconnected with exponential backoff, capped at maxBackoff,
+// if they fail. Sources that can't stream are captured from every interval
+// instead. It only returns an error if re-authorization is required.
+func runContinuous(ctx context.Context, c *capturer, interval, maxBackoff time.Duration) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	errs := make(chan error, len(c.cameras))
+	for _, cam := range c.cameras {
+		go func() {
+			errs <- c.streamCamera(ctx, cam, interval, maxBackoff)
+		}()
+	}
+
+	// Re-authorization affects every camera, so stop them all
+	var reauthErr error
+	for range c.cameras {
+		if err := <-errs; err != nil && reauthErr == nil {
+			reauthErr = err
+			cancel()
+		}
+	}
+
+	fmt.Println("Shutting down")
+	return reauthErr
+}
+
+// streamCamera saves frames from the camera every interval, reconnecting the
+// stream whenever it fails
+func (c *capturer) streamCamera(ctx context.Context, cam *camera, interval, maxBackoff time.Duration) error {
+	backoff := initialBackoff
+	for {
+		saved := 0
+		save := func(frame *source.Frame) error {
+			// Streamed frames are captured when they are taken
+			if err := saveFrame(cam, frame, frame.Time); err != nil {
+				return err
+			}
+			saved++
+			return nil
+		}
+
+		var err error
+		if streamer, ok := cam.source.(source.Streamer); ok {
+			err = streamer.Stream(ctx, interval, save)
+		} else {
+			err = source.Poll(ctx, cam.source, interval, c.captureTimeout, save)
+		}
+		if ctx.Err() != nil {
+			return nil
+		}
+		if errors.Is(err, auth.ErrReauthRequired) {
+			return err
+		}
+		if errors.Is(err, source.ErrExhausted) {
+			fmt.Printf("Camera %q has no more frames\n", cam.name)
+			return nil
+		}
+
+		// Only back off further if the stream never got going
+		if saved > 0 {
+			backoff = initialBackoff
+		}
+		delay := min(backoff, maxBackoff)
+		backoff *= 2
+		fmt.Printf("Stream from camera %q ended: %v\nReconnecting in %s\n", cam.name, err, delay)
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(delay):
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Daemon retry behaviour
+const (
+	// initialBackoff is the delay before retrying after the first failed capture
+	initialBackoff = 10 * time.Second
+	// defaultMaxBackoff is the default upper bound on the retry delay
+	defaultMaxBackoff = 5 * time.Minute
+)
+
+// runDaemon captures an image from every camera each interval until the
+// context is cancelled. Cameras whose capture fails are retried with
+// exponential backoff, capped at maxBackoff, until the next scheduled run when
+// all cameras are captured again. Cancelling the context also cancels any
+// in-flight capture. It only returns an error if re-authorization is required,
+// as retrying can't help.
+func runDaemon(ctx context.Context, c *capturer, interval, maxBackoff time.Duration) error {
+	backoff := initialBackoff
+	runStart := time.Now()
+	pending := c.cameras
+
+	for {
+		fmt.Printf("Starting capture at %s\n", time.Now().Format(time.RFC3339))
+		failed, err := c.captureAll(ctx, pending)
+		if err != nil {
+			return err
+		}
+
+		nextRun := runStart.Add(interval)
+		wakeAt := nextRun
+		if len(failed) > 0 {
+			retryAt := time.Now().Add(min(backoff, maxBackoff))
+			backoff *= 2
+			if retryAt.Before(nextRun) {
+				wakeAt = retryAt
+				fmt.Printf("Retrying %d failed camera(s) in %s\n", len(failed), time.Until(retryAt).Round(time.Second))
+			}
+		} else {
+			backoff = initialBackoff
+		}
+
+		select {
+		case <-ctx.Done():
+			fmt.Println("Shutting down")
+			return nil
+		case <-time.After(time.Until(wakeAt)):
+		}
+
+		if wakeAt.Equal(nextRun) {
+			runStart = nextRun
+			// If captures overran a whole interval, start the schedule afresh
+			if now := time.Now(); now.Sub(runStart) >= interval {
+				runStart = now
+			}
+			pending = c.cameras
+		} else {
+			pending = failed
+		}
+	}
+}
@@ -1,166 +1,375 @@
 // Package main implements a Nest camera video recorder that uses WebRTC to stream
 // and record video from a Google Nest camera. It authenticates with the Smart Device
 // Management API and handles the WebRTC connection lifecycle.
+//
+// By default a single frame is captured. With -interval the recorder runs as a
+// daemon, capturing on a schedule until it receives SIGINT or SIGTERM. With
+// -continuous as well, one stream is kept open to each camera and frames are
+// taken from it, instead of starting a new stream for every frame.
+//
+// Other cameras can be captured alongside, or instead of, Nest cameras by
+// listing them as sources in the config file: RTSP streams, HTTP snapshot URLs
+// and directories of images to replay.
 package main
 
 import (
-	"bytes"
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"os"
+	"os/exec"
+	"os/signal"
 	"path/filepath"
+	"syscall"
 	"time"
 
 	"github.com/sigh/nest-timelapse/internal/auth"
+	"github.com/sigh/nest-timelapse/internal/frames"
 	"github.com/sigh/nest-timelapse/internal/sdm"
+	"github.com/sigh/nest-timelapse/internal/source"
 	"github.com/sigh/nest-timelapse/internal/video"
-	"github.com/sigh/nest-timelapse/internal/webrtc"
 )
 
-// Auth files
+// exitReauthRequired is the exit code used when the user needs to authorize
+// the application again with "auth login"
+const exitReauthRequired = 3
+
+// Auth files and settings
 const (
-	tokenFile       = "token.json"
 	credentialsFile = "credentials.json"
+	// passphraseEnv is the environment variable holding the passphrase used to
+	// encrypt the token
+	passphraseEnv = "NEST_TIMELAPSE_TOKEN_PASSPHRASE"
 )
 
-// Timeouts and durations
-const (
-	// recordingDuration is how long to record video from the camera
-	recordingDuration = 5 * time.Second
-	// webRtcTimeout is the maximum time to wait for WebRTC operations
-	webRtcTimeout = 30 * time.Second
-)
+// defaultCaptureTimeout is the default deadline for a whole capture, from
+// negotiating the stream to saving the frame
+const defaultCaptureTimeout = 90 * time.Second
 
-var (
-	outputDir    string
-	enterpriseID string
-	credsDir     string
-)
+// camera is a source to capture from and where to save its frames
+type camera struct {
+	source source.Source
+	name   string
+	// id identifies the camera in messages: its device ID for Nest cameras,
+	// otherwise the kind of source
+	id        string
+	outputDir string
+}
 
-// getCameraImage is the main function that orchestrates the entire process:
-// authentication, camera discovery, WebRTC setup, streaming, and recording
-func getCameraImage() error {
-	tokenPath := filepath.Join(credsDir, tokenFile)
-	credsPath := filepath.Join(credsDir, credentialsFile)
+// capturer holds the long-lived state needed to capture images from cameras.
+// The sources, and the SDM service behind Nest cameras, are reused across
+// captures so that daemon mode doesn't re-authenticate or re-list devices for
+// every frame.
+type capturer struct {
+	cameras        []*camera
+	captureTimeout time.Duration
+	// cameraDirs maps the subdirectories used by cameras to their names
+	cameraDirs map[string]string
+}
 
-	tokenSource, err := auth.GetCredentials(tokenPath, credsPath)
-	if err != nil {
-		return fmt.Errorf("failed to get credentials: %w", err)
+// newCapturer finds the cameras to capture from: the Nest cameras, if an
+// enterprise ID is configured, and any other sources. If only Nest cameras are
+// used and none are selected, the first camera is saved directly into the
+// output directory; otherwise each camera is saved to its own subdirectory.
+func newCapturer(ctx context.Context, config *Config) (*capturer, error) {
+	c := &capturer{captureTimeout: time.Duration(config.CaptureTimeout)}
+	add := func(src source.Source, id string) error {
+		return c.addCamera(src, id, config.OutputDir)
 	}
 
-	sdmService, err := sdm.NewService(tokenSource)
-	if err != nil {
-		return err
+	if config.EnterpriseID != "" {
+		if err := c.addNestCameras(ctx, config, add); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, sourceConfig := range config.Sources {
+		src, err := sourceConfig.open(config.stillFormat(), config.clipOptions())
+		if err != nil {
+			return nil, err
+		}
+		if err := add(src, sourceConfig.Type); err != nil {
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
+
+// addCamera adds a camera that saves to its own subdirectory of the output
+// directory, named after the camera. If another camera already has that
+// subdirectory, e.g. because both are unnamed cameras in the same room and
+// take its name, it is named after the camera's ID instead.
+func (c *capturer) addCamera(src source.Source, id, outputDir string) error {
+	if c.cameraDirs == nil {
+		c.cameraDirs = make(map[string]string)
+	}
+	name := src.Name()
+	dirName := frames.CameraDirName(name)
+	if _, taken := c.cameraDirs[dirName]; dirName == "" || taken {
+		dirName = frames.CameraDirName(id)
+	}
+	if other, ok := c.cameraDirs[dirName]; ok {
+		return fmt.Errorf("cameras %q and %q would share output directory %q", other, name, dirName)
 	}
+	c.cameraDirs[dirName] = name
+	c.cameras = append(c.cameras, &camera{
+		source:    src,
+		name:      name,
+		id:        id,
+		outputDir: filepath.Join(outputDir, dirName),
+	})
+	return nil
+}
 
-	cameraDevice, err := sdmService.FindCamera(enterpriseID)
+// addNestCameras authenticates with the SDM API and adds the selected Nest
+// cameras
+func (c *capturer) addNestCameras(ctx context.Context, config *Config, add func(source.Source, string) error) error {
+	tokenStore, err := auth.OpenTokenStore(config.CredsDir, config.TokenKeyFile, os.Getenv(passphraseEnv))
 	if err != nil {
 		return err
 	}
+	credsPath := filepath.Join(config.CredsDir, credentialsFile)
+
+	authOpts := auth.Options{
+		RedirectPort:   config.RedirectPort,
+		NonInteractive: config.NonInteractive,
+		OnEvent:        func(e auth.Event) { fmt.Printf("Auth: %v\n", e) },
+	}
+	if config.ReauthHook != "" {
+		authOpts.OnReauthRequired = func(err error) { runReauthHook(config.ReauthHook, err) }
+	}
 
-	peerConnection, err := webrtc.SetupWebRTC()
+	tokenSource, err := auth.GetCredentials(ctx, tokenStore, credsPath, authOpts)
 	if err != nil {
-		return err
+		return fmt.Errorf("failed to get credentials: %w", err)
 	}
-	defer peerConnection.Close()
 
-	if err := webrtc.SetupTransceivers(peerConnection); err != nil {
+	sdmService, err := sdm.NewService(ctx, tokenSource, sdm.Options{})
+	if err != nil {
 		return err
 	}
 
-	offer, err := webrtc.CreateOffer(peerConnection)
+	webrtcOptions, err := config.webrtcOptions()
 	if err != nil {
 		return err
 	}
+	nestOptions := source.NestOptions{
+		WebRTC:       webrtcOptions,
+		FrameTimeout: time.Duration(config.CaptureTimeout),
+		SelectFrames: config.SelectFrames,
+		StackFrames:  config.StackFrames,
+		StackMethod:  config.StackMethod,
+		Still:        config.stillFormat(),
+		Clip:         config.clipOptions(),
+		Audio:        config.audioOptions(),
+	}
 
-	// Create a channel to receive the buffered video data
-	videoData := make(chan *bytes.Buffer, 1)
-	peerConnection.OnTrack(func(remoteTrack *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
-		if buffer := webrtc.HandleTrack(remoteTrack, receiver); buffer != nil {
-			videoData <- buffer
+	if len(config.Cameras) == 0 {
+		device, err := sdmService.FindCamera(ctx, config.EnterpriseID)
+		if err != nil {
+			return err
 		}
-	})
+		name := sdm.DisplayName(device)
+		src, err := source.NewNest(sdmService, device, name, nestOptions)
+		if err != nil {
+			return err
+		}
+		if len(config.Sources) > 0 {
+			return add(src, sdm.DeviceID(device))
+		}
+		c.cameras = append(c.cameras, &camera{
+			source:    src,
+			name:      name,
+			id:        sdm.DeviceID(device),
+			outputDir: config.OutputDir,
+		})
+		return nil
+	}
 
-	answerSdp, err := sdmService.GenerateWebRTCStream(cameraDevice, offer.SDP)
+	devices, err := sdmService.SelectCameras(ctx, config.EnterpriseID, config.Cameras)
 	if err != nil {
 		return err
 	}
+	for _, device := range devices {
+		src, err := source.NewNest(sdmService, device, sdm.DisplayName(device), nestOptions)
+		if err != nil {
+			return err
+		}
+		if err := add(src, sdm.DeviceID(device)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	answer := webrtc.SessionDescription{
-		Type: webrtc.SDPTypeAnswer,
-		SDP:  answerSdp,
+// captureAll captures an image from each of the cameras in turn, returning the
+// cameras that failed. If the context is done, the remaining cameras are
+// skipped and counted as failed. If re-authorization is required, no further
+// captures can succeed, so it stops and returns the error.
+func (c *capturer) captureAll(ctx context.Context, cameras []*camera) ([]*camera, error) {
+	var failed []*camera
+	for i, cam := range cameras {
+		if ctx.Err() != nil {
+			return append(failed, cameras[i:]...), nil
+		}
+		fmt.Printf("Capturing from camera %q\n", cam.name)
+		captureCtx, cancel := context.WithTimeout(ctx, c.captureTimeout)
+		err := c.captureImage(captureCtx, cam)
+		cancel()
+		if errors.Is(err, auth.ErrReauthRequired) {
+			return append(failed, cameras[i:]...), err
+		}
+		if err != nil {
+			fmt.Printf("Capture from camera %q failed: %v\n", cam.name, err)
+			failed = append(failed, cam)
+		}
 	}
-	if err := peerConnection.SetRemoteDescription(answer); err != nil {
-		return fmt.Errorf("failed to set remote description: %w", err)
+	return failed, nil
+}
+
+// runReauthHook runs the user's re-authorization hook command with the shell,
+// passing the error in the NEST_TIMELAPSE_ERROR environment variable
+func runReauthHook(command string, reauthErr error) {
+	cmd := exec.Command("sh", "-c", command)
+	cmd.Env = append(os.Environ(), "NEST_TIMELAPSE_ERROR="+reauthErr.Error())
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		fmt.Printf("Warning: re-authorization hook failed: %v\n", err)
 	}
+}
 
-	if err := webrtc.WaitForConnection(peerConnection, webRtcTimeout); err != nil {
-		return err
+// exitCode returns the code to exit with after the error: exitReauthRequired
+// if the user needs to authorize the application again, otherwise 1, or 0 if
+// there is no error
+func exitCode(err error) int {
+	switch {
+	case err == nil:
+		return 0
+	case errors.Is(err, auth.ErrReauthRequired):
+		return exitReauthRequired
+	default:
+		return 1
 	}
+}
 
-	fmt.Printf("Recording for %s...\n", recordingDuration)
-	time.Sleep(recordingDuration)
+// exitOnReauthRequired exits with exitReauthRequired if the error means the
+// user needs to authorize the application again
+func exitOnReauthRequired(err error) {
+	if code := exitCode(err); code == exitReauthRequired {
+		fmt.Fprintf(os.Stderr, "Error: %v\nRun \"auth login\" to authorize the application again\n", err)
+		os.Exit(code)
+	}
+}
 
-	if err := webrtc.WaitForConnectionClose(peerConnection, webRtcTimeout); err != nil {
-		return fmt.Errorf("failed to clean up connection: %w", err)
+// captureImage captures a single image from the camera and saves it. The
+// whole capture is abandoned if the context is done.
+func (c *capturer) captureImage(ctx context.Context, cam *camera) error {
+	captureStart := time.Now()
+	frame, err := cam.source.Capture(ctx)
+	if err != nil {
+		return err
 	}
+	return saveFrame(cam, frame, captureStart)
+}
+
+// saveFrame saves the frame, its sidecar describing how it was captured since
+// captureStart, and its clip and audio if it has them, into the camera's
+// output directory
+func saveFrame(cam *camera, frame *source.Frame, captureStart time.Time) error {
+	captureEnd := time.Now()
 
-	fmt.Println("Recording complete")
+	var recordings []string
+	for _, recording := range []string{frame.Clip, frame.Audio} {
+		if recording != "" {
+			recordings = append(recordings, recording)
+		}
+	}
 
-	// Wait for the video data from the recording
-	select {
-	case buffer := <-videoData:
-		if err := video.ExtractFirstFrame(buffer, outputDir); err != nil {
-			return fmt.Errorf("failed to extract frame: %w", err)
+	imagePath, err := video.SaveFrame(frame.Image, frame.Time, cam.outputDir)
+	if err != nil {
+		for _, recording := range recordings {
+			os.Remove(recording)
 		}
-	case <-time.After(5 * time.Second):
-		return fmt.Errorf("timeout waiting for video data")
+		return err
 	}
+	fmt.Printf("Saved frame to: %s\n", imagePath)
 
+	// The frame has been saved, so don't fail the capture for its sidecar or
+	// recordings
+	if err := frames.WriteSidecar(imagePath, newSidecar(frame, captureStart, captureEnd)); err != nil {
+		fmt.Printf("Warning: %v\n", err)
+	}
+	for _, recording := range recordings {
+		savedPath, err := video.SaveRecording(recording, frame.Time, cam.outputDir)
+		if err != nil {
+			fmt.Printf("Warning: %v\n", err)
+			os.Remove(recording)
+			continue
+		}
+		fmt.Printf("Saved recording to: %s\n", savedPath)
+	}
 	return nil
 }
 
 func main() {
-	// Parse command line flags
-	flag.StringVar(&outputDir, "output-dir", ".", "Directory to save captured frames")
-	flag.StringVar(&enterpriseID, "enterprise-id", "", "Google Workspace enterprise ID where the camera is registered")
-	flag.StringVar(&credsDir, "creds-dir", ".", "Directory containing credentials.json and token.json files")
-	flag.Parse()
-
-	if enterpriseID == "" {
-		log.Fatal("enterprise-id flag is required")
+	config, err := parseArgs()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error parsing arguments: %v\n", err)
+		flag.Usage()
+		os.Exit(1)
 	}
 
 	// Ensure output directory exists
-	if err := os.MkdirAll(outputDir, 0755); err != nil {
+	if err := os.MkdirAll(config.OutputDir, 0755); err != nil {
 		log.Fatalf("Failed to create output directory: %v", err)
 	}
 
-	// Convert to absolute paths for consistent handling
-	absOutputPath, err := filepath.Abs(outputDir)
-	if err != nil {
-		log.Fatalf("Failed to get absolute path for output directory: %v", err)
+	if config.EnterpriseID != "" {
+		// Check if credentials file exists
+		credsPath := filepath.Join(config.CredsDir, credentialsFile)
+		if _, err := os.Stat(credsPath); os.IsNotExist(err) {
+			log.Fatalf("Credentials file not found at %s", credsPath)
+		}
+
+		fmt.Printf("Using enterprise ID: %s\n", config.EnterpriseID)
+		fmt.Printf("Using credentials from: %s\n", config.CredsDir)
 	}
-	outputDir = absOutputPath
+	fmt.Printf("Saving frames to: %s\n", config.OutputDir)
 
-	absCredsPath, err := filepath.Abs(credsDir)
+	// Cancel any in-flight capture on SIGINT or SIGTERM
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	c, err := newCapturer(ctx, config)
 	if err != nil {
-		log.Fatalf("Failed to get absolute path for credentials directory: %v", err)
+		exitOnReauthRequired(err)
+		log.Fatalf("Error: %v", err)
 	}
-	credsDir = absCredsPath
 
-	// Check if credentials file exists
-	credsPath := filepath.Join(credsDir, credentialsFile)
-	if _, err := os.Stat(credsPath); os.IsNotExist(err) {
-		log.Fatalf("Credentials file not found at %s", credsPath)
+	for _, cam := range c.cameras {
+		fmt.Printf("Camera %q (%s) saving to: %s\n", cam.name, cam.id, cam.outputDir)
 	}
 
-	fmt.Printf("Using enterprise ID: %s\n", enterpriseID)
-	fmt.Printf("Saving frames to: %s\n", outputDir)
-	fmt.Printf("Using credentials from: %s\n", credsDir)
+	if config.Interval == 0 {
+		failed, err := c.captureAll(ctx, c.cameras)
+		exitOnReauthRequired(err)
+		if len(failed) > 0 {
+			log.Fatalf("Error: %d of %d captures failed", len(failed), len(c.cameras))
+		}
+		return
+	}
 
-	if err := getCameraImage(); err != nil {
-		log.Fatalf("Error: %v", err)
+	if config.Continuous {
+		err = runContinuous(ctx, c, time.Duration(config.Interval), time.Duration(config.MaxBackoff))
+		exitOnReauthRequired(err)
+		return
 	}
+
+	fmt.Printf("Capturing every %s\n", time.Duration(config.Interval))
+	err = runDaemon(ctx, c, time.Duration(config.Interval), time.Duration(config.MaxBackoff))
+	exitOnReauthRequired(err)
 }
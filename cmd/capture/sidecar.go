@@ -0,0 +1,78 @@
+package main
+
+import (
+	"maps"
+	"strconv"
+	"time"
+
+	"github.com/sigh/nest-timelapse/internal/frames"
+	"github.com/sigh/nest-timelapse/internal/source"
+)
+
+// scoreKeys are the metadata keys holding measurements of the frame, which
+// are saved in the sidecar as numbers
+var scoreKeys = []string{
+	source.MetadataFrameScore,
+	source.MetadataSharpness,
+	source.MetadataBrightnessChange,
+	source.MetadataMeanVolume,
+	source.MetadataMaxVolume,
+}
+
+// newSidecar describes how the frame was captured, between captureStart and
+// captureEnd
+func newSidecar(frame *source.Frame, captureStart, captureEnd time.Time) *frames.Sidecar {
+	metadata := maps.Clone(frame.Metadata)
+	if metadata == nil {
+		metadata = make(map[string]string)
+	}
+	// take removes the key from the metadata that is saved as is
+	take := func(key string) string {
+		value := metadata[key]
+		delete(metadata, key)
+		return value
+	}
+
+	sidecar := &frames.Sidecar{
+		Camera:       take(source.MetadataCamera),
+		DeviceID:     take(source.MetadataDeviceID),
+		Source:       take(source.MetadataSource),
+		CaptureStart: captureStart,
+		CaptureEnd:   captureEnd,
+		Codec:        take(source.MetadataCodec),
+	}
+	if width, height, err := frames.ImageSize(frame.Image); err == nil {
+		sidecar.Width = width
+		sidecar.Height = height
+	}
+
+	if _, ok := metadata[source.MetadataPacketsReceived]; ok {
+		var connection frames.ConnectionStats
+		connection.RoundTripTimeMs, _ = strconv.ParseFloat(take(source.MetadataRoundTripTime), 64)
+		connection.PacketsReceived, _ = strconv.ParseUint(take(source.MetadataPacketsReceived), 10, 64)
+		connection.PacketsLost, _ = strconv.ParseInt(take(source.MetadataPacketsLost), 10, 64)
+		connection.JitterMs, _ = strconv.ParseFloat(take(source.MetadataJitter), 64)
+		sidecar.Connection = &connection
+	}
+
+	for _, key := range scoreKeys {
+		value, ok := metadata[key]
+		if !ok {
+			continue
+		}
+		score, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			continue
+		}
+		if sidecar.Scores == nil {
+			sidecar.Scores = make(map[string]float64)
+		}
+		sidecar.Scores[key] = score
+		delete(metadata, key)
+	}
+
+	if len(metadata) > 0 {
+		sidecar.Metadata = metadata
+	}
+	return sidecar
+}
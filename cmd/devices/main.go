@@ -0,0 +1,211 @@
+// Package main implements a tool that lists the structures and devices visible
+// to the Smart Device Management API, along with their camera streaming
+// capabilities and whether the capture tool can stream from them.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/sigh/nest-timelapse/internal/auth"
+	"github.com/sigh/nest-timelapse/internal/sdm"
+)
+
+// Auth files and settings
+const (
+	credentialsFile = "credentials.json"
+	// passphraseEnv is the environment variable holding the passphrase used to
+	// encrypt the token
+	passphraseEnv = "NEST_TIMELAPSE_TOKEN_PASSPHRASE"
+)
+
+var (
+	enterpriseID string
+	credsDir     string
+	tokenKeyFile string
+	redirectPort int
+	jsonOutput   bool
+)
+
+// structureInfo describes a structure (home) in the enterprise
+type structureInfo struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// deviceInfo describes a device and its streaming capabilities
+type deviceInfo struct {
+	ID          string                `json:"id"`
+	Type        string                `json:"type"`
+	CustomName  string                `json:"customName,omitempty"`
+	Room        string                `json:"room,omitempty"`
+	StructureID string                `json:"structureId,omitempty"`
+	LiveStream  *sdm.CameraLiveStream `json:"liveStream,omitempty"`
+	CanCapture  bool                  `json:"canCapture"`
+	Traits      json.RawMessage       `json:"traits,omitempty"`
+
+	// displayName is used when printing and isn't part of the JSON output
+	displayName string
+	traitNames  []string
+}
+
+// enterpriseInfo is everything the SDM API reports for the enterprise
+type enterpriseInfo struct {
+	Structures []structureInfo `json:"structures"`
+	Devices    []deviceInfo    `json:"devices"`
+}
+
+// listEnterprise fetches the structures and devices in the enterprise
+func listEnterprise(ctx context.Context) (*enterpriseInfo, error) {
+	tokenStore, err := auth.OpenTokenStore(credsDir, tokenKeyFile, os.Getenv(passphraseEnv))
+	if err != nil {
+		return nil, err
+	}
+	credsPath := filepath.Join(credsDir, credentialsFile)
+
+	tokenSource, err := auth.GetCredentials(ctx, tokenStore, credsPath, auth.Options{RedirectPort: redirectPort})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get credentials: %w", err)
+	}
+
+	sdmService, err := sdm.NewService(ctx, tokenSource, sdm.Options{})
+	if err != nil {
+		return nil, err
+	}
+
+	structures, err := sdmService.ListStructures(ctx, enterpriseID)
+	if err != nil {
+		return nil, err
+	}
+
+	devices, err := sdmService.ListDevices(ctx, enterpriseID)
+	if err != nil {
+		return nil, err
+	}
+
+	info := &enterpriseInfo{
+		Structures: []structureInfo{},
+		Devices:    []deviceInfo{},
+	}
+	for _, structure := range structures {
+		info.Structures = append(info.Structures, structureInfo{
+			ID:   structure.Name[strings.LastIndex(structure.Name, "/")+1:],
+			Name: sdm.StructureName(structure),
+		})
+	}
+	for _, device := range devices {
+		info.Devices = append(info.Devices, deviceInfo{
+			ID:          sdm.DeviceID(device),
+			Type:        sdm.DeviceType(device),
+			CustomName:  sdm.CustomName(device),
+			Room:        sdm.RoomName(device),
+			StructureID: sdm.StructureID(device),
+			LiveStream:  sdm.LiveStream(device),
+			CanCapture:  sdm.CanCapture(device),
+			Traits:      json.RawMessage(device.Traits),
+			displayName: sdm.DisplayName(device),
+			traitNames:  sdm.TraitNames(device),
+		})
+	}
+
+	return info, nil
+}
+
+// printDevice prints a human readable description of the device
+func printDevice(device deviceInfo) {
+	fmt.Printf("  %s\n", device.displayName)
+	fmt.Printf("    ID:          %s\n", device.ID)
+	fmt.Printf("    Type:        %s\n", device.Type)
+	if device.Room != "" {
+		fmt.Printf("    Room:        %s\n", device.Room)
+	}
+	if ls := device.LiveStream; ls != nil {
+		fmt.Printf("    Protocols:   %s\n", strings.Join(ls.SupportedProtocols, ", "))
+		fmt.Printf("    Resolution:  %dx%d\n", ls.MaxVideoResolution.Width, ls.MaxVideoResolution.Height)
+		fmt.Printf("    Video:       %s\n", strings.Join(ls.VideoCodecs, ", "))
+		fmt.Printf("    Audio:       %s\n", strings.Join(ls.AudioCodecs, ", "))
+	}
+	if device.CanCapture {
+		fmt.Printf("    Capture:     supported\n")
+	} else {
+		fmt.Printf("    Capture:     not supported\n")
+	}
+	fmt.Printf("    Traits:      %s\n", strings.Join(device.traitNames, ", "))
+}
+
+// printEnterprise prints the devices grouped by the structure they belong to
+func printEnterprise(info *enterpriseInfo) {
+	printed := make(map[string]bool)
+	for _, structure := range info.Structures {
+		fmt.Printf("Structure %s (%s)\n", structure.Name, structure.ID)
+		for _, device := range info.Devices {
+			if device.StructureID == structure.ID {
+				printDevice(device)
+				printed[device.ID] = true
+			}
+		}
+		fmt.Println()
+	}
+
+	var unassigned []deviceInfo
+	for _, device := range info.Devices {
+		if !printed[device.ID] {
+			unassigned = append(unassigned, device)
+		}
+	}
+	if len(unassigned) > 0 {
+		fmt.Println("Devices without a structure")
+		for _, device := range unassigned {
+			printDevice(device)
+		}
+		fmt.Println()
+	}
+
+	fmt.Printf("%d structure(s), %d device(s)\n", len(info.Structures), len(info.Devices))
+}
+
+func main() {
+	flag.StringVar(&enterpriseID, "enterprise-id", "", "Google Workspace enterprise ID to inspect")
+	flag.StringVar(&credsDir, "creds-dir", ".", "Directory containing credentials.json and the saved token")
+	flag.StringVar(&tokenKeyFile, "token-key-file", "", "Key file used to encrypt the saved token (or set "+passphraseEnv+")")
+	flag.IntVar(&redirectPort, "redirect-port", 0, "Local port that receives the OAuth redirect when authorizing (default 8080, or a random port if unavailable)")
+	flag.BoolVar(&jsonOutput, "json", false, "Print JSON instead of a human readable listing")
+	flag.Parse()
+
+	if enterpriseID == "" {
+		log.Fatal("enterprise-id flag is required")
+	}
+
+	absCredsPath, err := filepath.Abs(credsDir)
+	if err != nil {
+		log.Fatalf("Failed to get absolute path for credentials directory: %v", err)
+	}
+	credsDir = absCredsPath
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	info, err := listEnterprise(ctx)
+	if err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+
+	if jsonOutput {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(info); err != nil {
+			log.Fatalf("Failed to write JSON: %v", err)
+		}
+		return
+	}
+
+	printEnterprise(info)
+}
@@ -25,9 +25,11 @@ type Config struct {
 	OutputFile  string
 	Overwrite   bool
 	InputDir    string
+	Camera      string
 	CropX       *CropRange
 	CropY       *CropRange
 	TimeRange   *parsetime.TimeRange
+	Filter      frames.Filter
 }
 
 // FrameInfo represents information about a single frame in the timelapse
@@ -104,6 +106,23 @@ func parseTimeRange(startTimeStr, endTimeStr, durationStr string) (*parsetime.Ti
 	return parsetime.MakeTimeRange(startTime, endTime, duration)
 }
 
+// parseFilter parses comma separated conditions on the frames' sidecars, all
+// of which a frame must meet to be used
+func parseFilter(value string) (frames.Filter, error) {
+	if value == "" {
+		return nil, nil
+	}
+	var filters []frames.Filter
+	for _, condition := range strings.Split(value, ",") {
+		filter, err := frames.ParseCondition(condition)
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, filter)
+	}
+	return frames.AllFilters(filters...), nil
+}
+
 func parseArgs() (*Config, error) {
 	config := &Config{
 		Speedup:    3600, // Default to 3600x speedup (1 hour = 1 second)
@@ -114,6 +133,7 @@ func parseArgs() (*Config, error) {
 	var cropXStr, cropYStr string
 	var startTimeStr, endTimeStr, durationStr string
 	var speedupStr string
+	var whereStr string
 
 	flag.StringVar(&speedupStr, "speedup", "1h/1s", "Speedup ratio (e.g. '1h/1m' for 1 hour = 1 minute, '1d/30s' for 1 day = 30 seconds)")
 	flag.StringVar(&speedupStr, "s", "1h/1s", "Speedup ratio (shorthand)")
@@ -126,6 +146,8 @@ func parseArgs() (*Config, error) {
 	flag.StringVar(&startTimeStr, "start-time", "", "Start time (HH:MM:SS or YYYY-MM-DD HH:MM:SS)")
 	flag.StringVar(&endTimeStr, "end-time", "", "End time (HH:MM:SS or YYYY-MM-DD HH:MM:SS)")
 	flag.StringVar(&durationStr, "duration", "", "Duration (e.g. '1d6h30m', '2d', '6h30m')")
+	flag.StringVar(&config.Camera, "camera", "", "Use frames from this camera's subdirectory of a multi-camera capture")
+	flag.StringVar(&whereStr, "where", "", "Only use frames whose sidecar meets these comma separated conditions (e.g. 'sharpness>=100,packetLoss<0.01')")
 
 	// Add minimal usage message for the positional argument
 	flag.Usage = func() {
@@ -148,6 +170,11 @@ func parseArgs() (*Config, error) {
 	}
 	config.InputDir = absInputDir
 
+	// Select the camera's subtree of a multi-camera capture
+	if config.Camera != "" {
+		config.InputDir = frames.CameraDir(config.InputDir, config.Camera)
+	}
+
 	// Parse speedup ratio
 	speedup, err := parsetime.ParseSpeedup(speedupStr)
 	if err != nil {
@@ -179,6 +206,13 @@ func parseArgs() (*Config, error) {
 	}
 	config.TimeRange = timeRange
 
+	// Parse sidecar conditions
+	filter, err := parseFilter(whereStr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid where conditions: %w", err)
+	}
+	config.Filter = filter
+
 	return config, nil
 }
 
@@ -273,7 +307,7 @@ func generateTimelapse(config *Config) error {
 	}
 
 	// Get frames through the channel
-	frameChan, errChan := frames.GenerateFrames(config.InputDir, config.Speedup, config.TimeRange)
+	frameChan, errChan := frames.GenerateFrames(config.InputDir, config.Speedup, config.TimeRange, config.Filter)
 
 	// Write frames to the pipe in a goroutine
 	go func() {
@@ -2,11 +2,15 @@ package auth
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"net/url"
 	"os"
 	"strings"
+	"sync"
+	"time"
 
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
@@ -16,6 +20,11 @@ const (
 	oauthScope = "https://www.googleapis.com/auth/sdm.service"
 )
 
+// ErrReauthRequired is returned in non-interactive mode when the user needs to
+// authorize the application again, e.g. because the refresh token was revoked
+// or has expired
+var ErrReauthRequired = errors.New("re-authorization required")
+
 type credentials struct {
 	Installed struct {
 		ClientID                string   `json:"client_id"`
@@ -28,46 +37,123 @@ type credentials struct {
 	} `json:"installed"`
 }
 
-// TokenSource wraps an oauth2.TokenSource and handles token persistence
+// TokenSource provides access tokens, refreshing and persisting them as
+// needed. It is safe for concurrent use: when several callers race on an
+// expired token, only one refresh is made and the others wait for its result.
 type TokenSource struct {
-	tokenSource oauth2.TokenSource
-	tokenFile   string
-	config      *oauth2.Config
+	mu     sync.Mutex
+	store  TokenStore
+	config *oauth2.Config
+	opts   Options
+	// ctx is used for token refreshes and re-authorization, which happen
+	// outside of any caller's context
+	ctx context.Context
+	// current is the token handed out to callers until it expires
+	current *oauth2.Token
+	// saved is the token last loaded from or saved to the store
+	saved *oauth2.Token
+	// reauthOnce calls the OnReauthRequired hook the first time
+	// re-authorization is found to be needed
+	reauthOnce sync.Once
+}
+
+// tokenChanged reports whether the token differs from the saved one
+func tokenChanged(saved, token *oauth2.Token) bool {
+	return saved == nil ||
+		saved.AccessToken != token.AccessToken ||
+		saved.RefreshToken != token.RefreshToken ||
+		!saved.Expiry.Equal(token.Expiry)
+}
+
+// save persists the token if it has changed since it was last saved
+func (ts *TokenSource) save(token *oauth2.Token) error {
+	if !tokenChanged(ts.saved, token) {
+		return nil
+	}
+	if err := ts.store.Save(token); err != nil {
+		return err
+	}
+	ts.saved = token
+	return nil
 }
 
 // Token implements oauth2.TokenSource interface
 func (ts *TokenSource) Token() (*oauth2.Token, error) {
-	token, err := ts.tokenSource.Token()
+	token, err := ts.token()
+	if errors.Is(err, ErrReauthRequired) {
+		// The hook may block or request a token, so it is called unlocked.
+		// Every later call fails the same way until the user logs in again,
+		// so it is only called once.
+		ts.reauthOnce.Do(func() { ts.opts.reauthRequired(err) })
+	}
+	return token, err
+}
+
+// token returns a valid token, refreshing it or re-authorizing if needed
+func (ts *TokenSource) token() (*oauth2.Token, error) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	if ts.current.Valid() {
+		return ts.current, nil
+	}
+
+	// Another process sharing the store may have refreshed the token already
+	if stored, err := ts.store.Load(); err == nil && stored.Valid() && tokenChanged(ts.current, stored) {
+		ts.current = stored
+		ts.saved = stored
+		ts.opts.emit(Event{Type: EventLoaded, Expiry: stored.Expiry})
+		return stored, nil
+	}
+
+	start := time.Now()
+	token, err := ts.config.TokenSource(ts.ctx, ts.current).Token()
 	if err != nil {
+		ts.opts.emit(Event{Type: EventRefreshFailed, Duration: time.Since(start), Err: err})
+
 		// Check if the error is due to an expired or invalid token
 		if strings.Contains(err.Error(), "invalid_grant") {
-			// Remove the expired token file
-			if err := os.Remove(ts.tokenFile); err != nil {
-				fmt.Printf("Warning: failed to remove expired token file: %v\n", err)
+			if ts.opts.NonInteractive {
+				// Keep the saved token so that nothing changes until the user
+				// logs in again. The cause isn't wrapped as callers such as the
+				// Google API client convert oauth2 errors into their own types,
+				// which would hide ErrReauthRequired.
+				reauthErr := fmt.Errorf("%w: %v", ErrReauthRequired, err)
+				ts.opts.emit(Event{Type: EventReauthRequired, Err: reauthErr})
+				return nil, reauthErr
 			}
 
+			// Remove the expired token
+			if err := ts.store.Delete(); err != nil {
+				fmt.Fprintf(os.Stderr, "Warning: failed to remove expired token: %v\n", err)
+			}
+			ts.saved = nil
+
 			// Start a new OAuth flow
-			newToken, err := handleOAuthFlow(ts.config)
+			newToken, err := handleOAuthFlow(ts.ctx, ts.config, ts.opts)
 			if err != nil {
 				return nil, fmt.Errorf("failed to refresh token through OAuth flow: %w", err)
 			}
 
 			// Save the new token
-			if err := saveJSON(newToken, ts.tokenFile); err != nil {
-				fmt.Printf("Warning: failed to save new token: %v\n", err)
+			if err := ts.save(newToken); err != nil {
+				fmt.Fprintf(os.Stderr, "Warning: failed to save new token: %v\n", err)
 			}
 
-			// Update the token source with the new token
-			ts.tokenSource = ts.config.TokenSource(context.Background(), newToken)
+			ts.current = newToken
+			ts.opts.emit(Event{Type: EventReauthorized, Expiry: newToken.Expiry})
 			return newToken, nil
 		}
 		return nil, fmt.Errorf("failed to get token: %w", err)
 	}
 
-	// Save the token if it has been refreshed
+	ts.current = token
+	ts.opts.emit(Event{Type: EventRefreshed, Expiry: token.Expiry, Duration: time.Since(start)})
+
+	// Save the token since it has been refreshed
 	if token.AccessToken != "" {
-		if err := saveJSON(token, ts.tokenFile); err != nil {
-			fmt.Printf("Warning: failed to save refreshed token: %v\n", err)
+		if err := ts.save(token); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: failed to save refreshed token: %v\n", err)
 		}
 	}
 
@@ -87,85 +173,175 @@ func loadJSON[T any](filename string) (*T, error) {
 	return &result, nil
 }
 
-// saveJSON is a generic function that saves a value as JSON to the specified file
-func saveJSON[T any](data *T, filename string) error {
-	jsonData, err := json.Marshal(data)
-	if err != nil {
-		return fmt.Errorf("failed to marshal JSON for %s: %w", filename, err)
+// newConfig returns the OAuth config for the client credentials
+func newConfig(creds *credentials) *oauth2.Config {
+	return &oauth2.Config{
+		ClientID:     creds.Installed.ClientID,
+		ClientSecret: creds.Installed.ClientSecret,
+		Scopes:       []string{oauthScope},
+		Endpoint:     google.Endpoint,
 	}
-	return os.WriteFile(filename, jsonData, 0600)
 }
 
-// GetCredentials handles OAuth token management, including loading from cache,
-// token refresh, and initiating the OAuth flow if needed. Returns a TokenSource
-// that will automatically handle token refresh and persistence.
-func GetCredentials(tokenFile, credentialsFile string) (*TokenSource, error) {
+// GetCredentials handles OAuth token management, including loading from the
+// store, token refresh, and initiating the OAuth flow if needed. Returns a
+// TokenSource that will automatically handle token refresh and persistence.
+// The context bounds the initial OAuth flow; the returned TokenSource keeps the
+// context's values but isn't cancelled with it.
+func GetCredentials(ctx context.Context, store TokenStore, credentialsFile string, opts Options) (*TokenSource, error) {
 	creds, err := loadJSON[credentials](credentialsFile)
 	if err != nil {
 		return nil, fmt.Errorf("failed to load credentials: %w", err)
 	}
 
-	config := &oauth2.Config{
-		ClientID:     creds.Installed.ClientID,
-		ClientSecret: creds.Installed.ClientSecret,
-		Scopes:       []string{oauthScope},
-		Endpoint:     google.Endpoint,
-		RedirectURL:  "http://localhost:8080",
-	}
+	config := newConfig(creds)
 
 	// Try to load existing token
-	var token *oauth2.Token
-	if savedToken, err := loadJSON[oauth2.Token](tokenFile); err == nil {
-		token = savedToken
-	} else {
+	token, err := store.Load()
+	if errors.Is(err, ErrNoToken) {
+		if opts.NonInteractive {
+			return nil, opts.reauthRequired(fmt.Errorf("%w: no saved token", ErrReauthRequired))
+		}
+
 		// No saved token, start OAuth flow
-		token, err = handleOAuthFlow(config)
+		token, err = handleOAuthFlow(ctx, config, opts)
 		if err != nil {
 			return nil, fmt.Errorf("failed to complete OAuth flow: %w", err)
 		}
-		if err := saveJSON(token, tokenFile); err != nil {
+		if err := store.Save(token); err != nil {
 			return nil, fmt.Errorf("failed to save token: %w", err)
 		}
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to load token: %w", err)
 	}
 
-	// Create a token source that will handle refresh
-	tokenSource := config.TokenSource(context.Background(), token)
-
+	// The token source outlives this call, so its refreshes mustn't be
+	// cancelled along with it
 	return &TokenSource{
-		tokenSource: tokenSource,
-		tokenFile:   tokenFile,
-		config:      config,
+		store:   store,
+		config:  config,
+		opts:    opts,
+		ctx:     context.WithoutCancel(ctx),
+		current: token,
+		saved:   token,
 	}, nil
 }
 
-// handleOAuthFlow implements the OAuth 2.0 authorization code flow, prompting
-// the user to authorize the application in their browser
-func handleOAuthFlow(config *oauth2.Config) (*oauth2.Token, error) {
-	authURL := config.AuthCodeURL("state-token", oauth2.AccessTypeOffline, oauth2.ApprovalForce)
-	fmt.Printf("Go to the following link in your browser:\n%v\n", authURL)
-	fmt.Print("Enter the authorization code or redirect URL: ")
+// Options configures how the user is asked to authorize the application
+type Options struct {
+	// RedirectPort is the loopback port that receives the OAuth redirect. If
+	// zero, port 8080 is used. A random port is used if it is unavailable.
+	RedirectPort int
+	// NonInteractive disables prompting the user to authorize the application.
+	// When authorization is needed, ErrReauthRequired is returned instead.
+	NonInteractive bool
+	// OnReauthRequired, if set, is called with the error when authorization
+	// is needed in non-interactive mode, e.g. to notify the user. It is called
+	// at most once per TokenSource.
+	OnReauthRequired func(error)
+	// OnEvent, if set, is called when the token is refreshed or fails to
+	// refresh, e.g. for logging or metrics. It is called while the
+	// TokenSource is locked, so it must not block or request a token.
+	OnEvent func(Event)
+}
 
-	var input string
-	if _, err := fmt.Scan(&input); err != nil {
-		return nil, fmt.Errorf("failed to read input: %w", err)
+// emit calls the OnEvent hook
+func (o Options) emit(event Event) {
+	if o.OnEvent != nil {
+		o.OnEvent(event)
 	}
+}
 
-	// Try to extract code from redirect URL if it looks like a URL
-	var authCode string
-	if strings.HasPrefix(input, "http") {
-		redirectURL, err := url.Parse(input)
-		if err != nil {
-			return nil, fmt.Errorf("failed to parse redirect URL: %w", err)
-		}
-		authCode = redirectURL.Query().Get("code")
-		if authCode == "" {
-			return nil, fmt.Errorf("no authorization code found in redirect URL")
-		}
+// reauthRequired calls the OnReauthRequired hook and returns the error
+func (o Options) reauthRequired(err error) error {
+	if o.OnReauthRequired != nil {
+		o.OnReauthRequired(err)
+	}
+	return err
+}
+
+// Login runs the interactive OAuth flow and saves the new token, replacing any
+// saved token. Use it to authorize the application ahead of running
+// non-interactively.
+func Login(ctx context.Context, store TokenStore, credentialsFile string, opts Options) error {
+	creds, err := loadJSON[credentials](credentialsFile)
+	if err != nil {
+		return fmt.Errorf("failed to load credentials: %w", err)
+	}
+
+	token, err := handleOAuthFlow(ctx, newConfig(creds), opts)
+	if err != nil {
+		return fmt.Errorf("failed to complete OAuth flow: %w", err)
+	}
+	if err := store.Save(token); err != nil {
+		return fmt.Errorf("failed to save token: %w", err)
+	}
+	return nil
+}
+
+// randomState returns an unguessable OAuth state parameter
+func randomState() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate state: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// handleOAuthFlow implements the OAuth 2.0 authorization code flow with PKCE,
+// prompting the user to authorize the application in their browser. The
+// authorization code is received by a loopback server, or can be pasted in
+// when the browser runs on a different machine (e.g. over SSH). Prompts are
+// written to stderr so that they don't mix with a command's output.
+func handleOAuthFlow(ctx context.Context, config *oauth2.Config, opts Options) (*oauth2.Token, error) {
+	state, err := randomState()
+	if err != nil {
+		return nil, err
+	}
+	verifier := oauth2.GenerateVerifier()
+
+	// The redirect URL depends on the port we listen on, so use a copy of the
+	// config for this flow
+	flowConfig := *config
+	flowConfig.RedirectURL = "http://" + loopbackHost
+
+	var serverResults <-chan authResult
+	server, err := startLoopbackServer(opts.RedirectPort, state)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+	} else {
+		defer server.Close()
+		flowConfig.RedirectURL = server.redirectURL
+		serverResults = server.results
+	}
+
+	authURL := flowConfig.AuthCodeURL(state,
+		oauth2.AccessTypeOffline, oauth2.ApprovalForce, oauth2.S256ChallengeOption(verifier))
+	fmt.Fprintf(os.Stderr, "Go to the following link in your browser:\n%v\n", authURL)
+	if server != nil {
+		fmt.Fprintln(os.Stderr, "Waiting for the browser to redirect back...")
+		fmt.Fprint(os.Stderr, "If the browser is on another machine, enter the redirect URL from its address bar: ")
 	} else {
-		authCode = input
+		fmt.Fprint(os.Stderr, "Enter the authorization code or redirect URL: ")
+	}
+
+	var result authResult
+	select {
+	case result = <-serverResults:
+		fmt.Fprintln(os.Stderr)
+	case input, ok := <-stdin.Lines():
+		if !ok {
+			return nil, fmt.Errorf("failed to read input: %w", stdin.Err())
+		}
+		result.code, result.err = parseCode(input, state)
+	case <-ctx.Done():
+		return nil, fmt.Errorf("authorization interrupted: %w", ctx.Err())
+	}
+	if result.err != nil {
+		return nil, result.err
 	}
 
-	token, err := config.Exchange(context.Background(), authCode)
+	token, err := flowConfig.Exchange(ctx, result.code, oauth2.VerifierOption(verifier))
 	if err != nil {
 		return nil, fmt.Errorf("failed to exchange code for token: %w", err)
 	}
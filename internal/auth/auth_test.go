@@ -0,0 +1,177 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sigh/nest-timelapse/internal/sdm"
+	"github.com/sigh/nest-timelapse/internal/sdm/sdmtest"
+	"golang.org/x/oauth2"
+)
+
+func TestTokenSourceConcurrentRefresh(t *testing.T) {
+	var refreshes atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := refreshes.Add(1)
+		// Give racing callers time to pile up behind the refresh
+		time.Sleep(50 * time.Millisecond)
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"access_token":"access-%d","token_type":"Bearer","expires_in":3600}`, n)
+	}))
+	defer server.Close()
+
+	expired := &oauth2.Token{
+		AccessToken:  "expired",
+		RefreshToken: "refresh",
+		Expiry:       time.Now().Add(-time.Hour),
+	}
+	store := NewMemoryStore(expired)
+
+	var mu sync.Mutex
+	var events []EventType
+	ts := &TokenSource{
+		store:  store,
+		config: &oauth2.Config{Endpoint: oauth2.Endpoint{TokenURL: server.URL}},
+		opts: Options{OnEvent: func(e Event) {
+			mu.Lock()
+			defer mu.Unlock()
+			events = append(events, e.Type)
+		}},
+		ctx:     context.Background(),
+		current: expired,
+		saved:   expired,
+	}
+
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			token, err := ts.Token()
+			if err != nil {
+				t.Errorf("Token() error = %v", err)
+				return
+			}
+			if token.AccessToken != "access-1" {
+				t.Errorf("Token() = %q, want %q", token.AccessToken, "access-1")
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n := refreshes.Load(); n != 1 {
+		t.Errorf("token endpoint called %d times, want 1", n)
+	}
+	if len(events) != 1 || events[0] != EventRefreshed {
+		t.Errorf("events = %v, want [%v]", events, EventRefreshed)
+	}
+
+	saved, err := store.Load()
+	if err != nil || saved.AccessToken != "access-1" || saved.RefreshToken != "refresh" {
+		t.Errorf("saved token = %+v, %v, want refreshed token keeping the refresh token", saved, err)
+	}
+}
+
+func TestTokenSourceLoadsTokenRefreshedElsewhere(t *testing.T) {
+	expired := &oauth2.Token{AccessToken: "expired", RefreshToken: "refresh", Expiry: time.Now().Add(-time.Hour)}
+	fresh := &oauth2.Token{AccessToken: "fresh", RefreshToken: "refresh", Expiry: time.Now().Add(time.Hour)}
+
+	var got []EventType
+	ts := &TokenSource{
+		store: NewMemoryStore(fresh),
+		// Refreshing would fail, as there is no token endpoint
+		config:  &oauth2.Config{Endpoint: oauth2.Endpoint{TokenURL: "http://127.0.0.1:0"}},
+		opts:    Options{OnEvent: func(e Event) { got = append(got, e.Type) }},
+		ctx:     context.Background(),
+		current: expired,
+		saved:   expired,
+	}
+
+	token, err := ts.Token()
+	if err != nil {
+		t.Fatalf("Token() error = %v", err)
+	}
+	if token.AccessToken != "fresh" {
+		t.Errorf("Token() = %q, want %q", token.AccessToken, "fresh")
+	}
+	if len(got) != 1 || got[0] != EventLoaded {
+		t.Errorf("events = %v, want [%v]", got, EventLoaded)
+	}
+}
+
+func TestTokenSourceReauthRequired(t *testing.T) {
+	tokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, `{"error":"invalid_grant","error_description":"Token has been expired or revoked."}`)
+	}))
+	defer tokenServer.Close()
+	sdmServer := sdmtest.NewServer("enterprise")
+	defer sdmServer.Close()
+
+	expired := &oauth2.Token{AccessToken: "expired", RefreshToken: "revoked", Expiry: time.Now().Add(-time.Hour)}
+	var hookCalls atomic.Int32
+	ts := &TokenSource{
+		store:   NewMemoryStore(expired),
+		config:  &oauth2.Config{Endpoint: oauth2.Endpoint{TokenURL: tokenServer.URL}},
+		ctx:     context.Background(),
+		current: expired,
+		saved:   expired,
+	}
+	ts.opts = Options{
+		NonInteractive: true,
+		OnReauthRequired: func(err error) {
+			hookCalls.Add(1)
+			// The hook may request a token, so it mustn't be called locked
+			if !ts.mu.TryLock() {
+				t.Error("OnReauthRequired called while the token source is locked")
+				return
+			}
+			ts.mu.Unlock()
+		},
+	}
+
+	service, err := sdm.NewService(context.Background(), ts, sdm.Options{Endpoint: sdmServer.Endpoint()})
+	if err != nil {
+		t.Fatalf("NewService() error = %v", err)
+	}
+	for range 2 {
+		if _, err := service.ListDevices(context.Background(), "enterprise"); !errors.Is(err, ErrReauthRequired) {
+			t.Errorf("ListDevices() error = %v, want ErrReauthRequired", err)
+		}
+	}
+	if n := hookCalls.Load(); n != 1 {
+		t.Errorf("OnReauthRequired called %d times, want 1", n)
+	}
+
+	saved, err := ts.store.Load()
+	if err != nil || saved.RefreshToken != "revoked" {
+		t.Errorf("saved token = %+v, %v, want the saved token kept", saved, err)
+	}
+}
+
+func TestGetCredentialsWithoutTokenNonInteractive(t *testing.T) {
+	credentialsFile := filepath.Join(t.TempDir(), "credentials.json")
+	if err := os.WriteFile(credentialsFile, []byte(`{"installed":{"client_id":"id","client_secret":"secret"}}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	var hookErr error
+	opts := Options{NonInteractive: true, OnReauthRequired: func(err error) { hookErr = err }}
+	_, err := GetCredentials(context.Background(), NewMemoryStore(nil), credentialsFile, opts)
+	if !errors.Is(err, ErrReauthRequired) {
+		t.Errorf("GetCredentials() error = %v, want ErrReauthRequired", err)
+	}
+	if !errors.Is(hookErr, ErrReauthRequired) {
+		t.Errorf("OnReauthRequired called with %v, want ErrReauthRequired", hookErr)
+	}
+}
@@ -0,0 +1,63 @@
+package auth
+
+import (
+	"fmt"
+	"time"
+)
+
+// EventType identifies what happened to the token
+type EventType int
+
+const (
+	// EventRefreshed means the access token was refreshed
+	EventRefreshed EventType = iota
+	// EventRefreshFailed means refreshing the access token failed
+	EventRefreshFailed
+	// EventLoaded means a token refreshed by another process was loaded from
+	// the store instead of refreshing
+	EventLoaded
+	// EventReauthorized means the user authorized the application again
+	EventReauthorized
+	// EventReauthRequired means the user needs to authorize the application
+	// again, but can't be prompted in non-interactive mode
+	EventReauthRequired
+)
+
+// String returns the name of the event type
+func (t EventType) String() string {
+	switch t {
+	case EventRefreshed:
+		return "refreshed"
+	case EventRefreshFailed:
+		return "refresh_failed"
+	case EventLoaded:
+		return "loaded"
+	case EventReauthorized:
+		return "reauthorized"
+	case EventReauthRequired:
+		return "reauth_required"
+	}
+	return fmt.Sprintf("EventType(%d)", int(t))
+}
+
+// Event describes a change to the token made by a TokenSource
+type Event struct {
+	Type EventType
+	// Expiry is when the new token expires, if there is one
+	Expiry time.Time
+	// Duration is how long the refresh took, for refresh events
+	Duration time.Duration
+	// Err is the error, for failure events
+	Err error
+}
+
+// String returns a human readable description of the event
+func (e Event) String() string {
+	switch {
+	case e.Err != nil:
+		return fmt.Sprintf("token %s: %v", e.Type, e.Err)
+	case !e.Expiry.IsZero():
+		return fmt.Sprintf("token %s, expires %s", e.Type, e.Expiry.Format(time.RFC3339))
+	}
+	return fmt.Sprintf("token %s", e.Type)
+}
@@ -0,0 +1,74 @@
+package auth
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+)
+
+// inputReader reads lines pasted in by the user. Reads can't be interrupted,
+// so a single goroutine reads for the whole process and hands each line to
+// whichever OAuth flow is waiting for one. A flow that gives up waiting, e.g.
+// because the loopback server received the code, leaves the next line for the
+// next flow.
+type inputReader struct {
+	reader io.Reader
+	once   sync.Once
+	lines  chan string
+	// err is why reading stopped. It is set before lines is closed.
+	err error
+}
+
+// stdin is the input reader shared by all OAuth flows
+var stdin = newInputReader(os.Stdin)
+
+// newInputReader returns an input reader for the reader. Nothing is read
+// until the first call to Lines.
+func newInputReader(reader io.Reader) *inputReader {
+	return &inputReader{reader: reader, lines: make(chan string)}
+}
+
+// Lines returns the channel that receives each non-empty line, which is
+// closed when the input ends
+func (r *inputReader) Lines() <-chan string {
+	r.once.Do(func() { go r.read() })
+	return r.lines
+}
+
+// Err returns why the input ended, once Lines is closed
+func (r *inputReader) Err() error {
+	return r.err
+}
+
+// read sends each line of the input, blocking until a flow receives it
+func (r *inputReader) read() {
+	scanner := bufio.NewScanner(r.reader)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			r.lines <- line
+		}
+	}
+	r.err = scanner.Err()
+	if r.err == nil {
+		r.err = io.EOF
+	}
+	close(r.lines)
+}
+
+// parseCode returns the authorization code from a code or redirect URL pasted
+// in by the user, checking the state if a URL is given
+func parseCode(input, state string) (string, error) {
+	// Try to extract code from redirect URL if it looks like a URL
+	if !strings.HasPrefix(input, "http") {
+		return input, nil
+	}
+	redirectURL, err := url.Parse(input)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse redirect URL: %w", err)
+	}
+	return codeFromQuery(redirectURL.Query(), state)
+}
@@ -0,0 +1,68 @@
+package auth
+
+import (
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+// receive returns the next line from the input reader, failing the test if
+// none arrives
+func receive(t *testing.T, r *inputReader) (string, bool) {
+	t.Helper()
+	select {
+	case line, ok := <-r.Lines():
+		return line, ok
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for input")
+		return "", false
+	}
+}
+
+func TestInputReaderSharedBetweenFlows(t *testing.T) {
+	pr, pw := io.Pipe()
+	r := newInputReader(pr)
+
+	// A flow that stops waiting, e.g. because the loopback server received
+	// the code, mustn't take the line meant for the next flow
+	select {
+	case line := <-r.Lines():
+		t.Fatalf("Lines() = %q before any input", line)
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	go func() {
+		io.WriteString(pw, "first-code\n\n  second-code  \n")
+		pw.Close()
+	}()
+	for _, want := range []string{"first-code", "second-code"} {
+		if line, ok := receive(t, r); !ok || line != want {
+			t.Errorf("Lines() = %q, %v, want %q", line, ok, want)
+		}
+	}
+	if _, ok := receive(t, r); ok {
+		t.Error("Lines() isn't closed at the end of the input")
+	}
+	if err := r.Err(); !errors.Is(err, io.EOF) {
+		t.Errorf("Err() = %v, want EOF", err)
+	}
+}
+
+func TestParseCode(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    string
+		wantErr bool
+	}{
+		{"4/abc", "4/abc", false},
+		{"http://127.0.0.1:8080/?state=s&code=4/abc", "4/abc", false},
+		{"http://127.0.0.1:8080/?state=forged&code=4/abc", "", true},
+	}
+	for _, tt := range tests {
+		got, err := parseCode(tt.input, "s")
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("parseCode(%q) = %q, %v, want %q, wantErr %v", tt.input, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
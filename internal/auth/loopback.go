@@ -0,0 +1,124 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+)
+
+const (
+	// defaultRedirectPort is the loopback port used when none is configured
+	defaultRedirectPort = 8080
+	// loopbackHost is the address the loopback server listens on
+	loopbackHost = "127.0.0.1"
+)
+
+// authResult is the outcome of the user authorizing the application: either
+// an authorization code or an error
+type authResult struct {
+	code string
+	err  error
+}
+
+// loopbackServer receives the OAuth redirect on a local port so that the user
+// doesn't need to copy the authorization code by hand
+type loopbackServer struct {
+	server      *http.Server
+	redirectURL string
+	state       string
+	results     chan authResult
+}
+
+// startLoopbackServer listens on the given loopback port, falling back to a
+// random free port if it is unavailable. Redirects are only accepted if they
+// carry the expected state.
+func startLoopbackServer(port int, state string) (*loopbackServer, error) {
+	if port == 0 {
+		port = defaultRedirectPort
+	}
+
+	listener, err := net.Listen("tcp", net.JoinHostPort(loopbackHost, strconv.Itoa(port)))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Port %d is unavailable (%v), using a random port\n", port, err)
+		listener, err = net.Listen("tcp", net.JoinHostPort(loopbackHost, "0"))
+		if err != nil {
+			return nil, fmt.Errorf("failed to listen for OAuth redirect: %w", err)
+		}
+	}
+
+	s := &loopbackServer{
+		redirectURL: "http://" + listener.Addr().String(),
+		state:       state,
+		results:     make(chan authResult, 1),
+	}
+	s.server = &http.Server{
+		Handler:           http.HandlerFunc(s.handleRedirect),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		if err := s.server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			s.send(authResult{err: fmt.Errorf("OAuth redirect server failed: %w", err)})
+		}
+	}()
+
+	return s, nil
+}
+
+// send delivers the first result and drops any after it
+func (s *loopbackServer) send(result authResult) {
+	select {
+	case s.results <- result:
+	default:
+	}
+}
+
+// handleRedirect handles the browser being redirected back after the user
+// authorizes (or refuses to authorize) the application
+func (s *loopbackServer) handleRedirect(w http.ResponseWriter, r *http.Request) {
+	code, err := codeFromQuery(r.URL.Query(), s.state)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Authorization failed: %v", err), http.StatusBadRequest)
+		// A mismatched state may come from a stale or forged request, so keep
+		// waiting for the real redirect
+		if !errors.Is(err, errStateMismatch) {
+			s.send(authResult{err: err})
+		}
+		return
+	}
+
+	fmt.Fprintln(w, "Authorization complete. You can close this window.")
+	s.send(authResult{code: code})
+}
+
+// Close stops the server
+func (s *loopbackServer) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return s.server.Shutdown(ctx)
+}
+
+// errStateMismatch means a redirect didn't carry the state we sent
+var errStateMismatch = errors.New("state parameter does not match")
+
+// codeFromQuery extracts the authorization code from redirect query
+// parameters, checking that the state matches
+func codeFromQuery(query url.Values, state string) (string, error) {
+	if query.Get("state") != state {
+		return "", errStateMismatch
+	}
+	if errCode := query.Get("error"); errCode != "" {
+		return "", fmt.Errorf("authorization denied: %s", errCode)
+	}
+	code := query.Get("code")
+	if code == "" {
+		return "", fmt.Errorf("no authorization code found in redirect URL")
+	}
+	return code, nil
+}
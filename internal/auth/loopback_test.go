@@ -0,0 +1,71 @@
+package auth
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestLoopbackServer(t *testing.T) {
+	server, err := startLoopbackServer(0, "expected-state")
+	if err != nil {
+		t.Fatalf("startLoopbackServer() error = %v", err)
+	}
+	defer server.Close()
+
+	get := func(query string) int {
+		resp, err := http.Get(server.redirectURL + "/?" + query)
+		if err != nil {
+			t.Fatalf("GET failed: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	// Redirects with the wrong state are rejected without ending the flow
+	if status := get("state=forged&code=bad"); status != http.StatusBadRequest {
+		t.Errorf("forged state: status = %d, want %d", status, http.StatusBadRequest)
+	}
+	if status := get("code=bad"); status != http.StatusBadRequest {
+		t.Errorf("missing state: status = %d, want %d", status, http.StatusBadRequest)
+	}
+
+	if status := get("state=expected-state&code=the-code"); status != http.StatusOK {
+		t.Errorf("valid redirect: status = %d, want %d", status, http.StatusOK)
+	}
+
+	select {
+	case result := <-server.results:
+		if result.err != nil || result.code != "the-code" {
+			t.Errorf("result = %+v, want code %q", result, "the-code")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no result received")
+	}
+}
+
+func TestCodeFromQuery(t *testing.T) {
+	tests := []struct {
+		name    string
+		query   map[string][]string
+		want    string
+		wantErr bool
+	}{
+		{"valid", map[string][]string{"state": {"s"}, "code": {"c"}}, "c", false},
+		{"wrong state", map[string][]string{"state": {"x"}, "code": {"c"}}, "", true},
+		{"denied", map[string][]string{"state": {"s"}, "error": {"access_denied"}}, "", true},
+		{"no code", map[string][]string{"state": {"s"}}, "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := codeFromQuery(tt.query, "s")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("codeFromQuery() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("codeFromQuery() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,291 @@
+package auth
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"golang.org/x/crypto/scrypt"
+	"golang.org/x/oauth2"
+)
+
+// Token files
+const (
+	tokenFile          = "token.json"
+	encryptedTokenFile = "token.enc"
+)
+
+// ErrNoToken is returned by TokenStore.Load when no token has been saved
+var ErrNoToken = errors.New("no saved token")
+
+// TokenStore persists the OAuth token between runs
+type TokenStore interface {
+	// Load returns the saved token, or ErrNoToken if there isn't one
+	Load() (*oauth2.Token, error)
+	// Save replaces the saved token
+	Save(token *oauth2.Token) error
+	// Delete removes the saved token. Deleting a missing token isn't an error.
+	Delete() error
+}
+
+// OpenTokenStore returns a store for the token in dir. If a key file or
+// passphrase is given the token is encrypted with it, otherwise it is saved as
+// plain JSON.
+func OpenTokenStore(dir, keyFile, passphrase string) (TokenStore, error) {
+	if keyFile != "" && passphrase != "" {
+		return nil, fmt.Errorf("only one of a key file or passphrase can be used")
+	}
+	if keyFile != "" {
+		key, err := os.ReadFile(keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read key file: %w", err)
+		}
+		return NewEncryptedFileStore(filepath.Join(dir, encryptedTokenFile), key)
+	}
+	if passphrase != "" {
+		return NewEncryptedFileStore(filepath.Join(dir, encryptedTokenFile), []byte(passphrase))
+	}
+	return NewFileStore(filepath.Join(dir, tokenFile)), nil
+}
+
+// FileStore saves the token as JSON in a file
+type FileStore struct {
+	path string
+}
+
+// NewFileStore returns a store that saves the token in the file
+func NewFileStore(path string) *FileStore {
+	return &FileStore{path: path}
+}
+
+// Load implements TokenStore
+func (s *FileStore) Load() (*oauth2.Token, error) {
+	data, err := readFile(s.path)
+	if err != nil {
+		return nil, err
+	}
+	var token oauth2.Token
+	if err := json.Unmarshal(data, &token); err != nil {
+		return nil, fmt.Errorf("failed to parse JSON from %s: %w", s.path, err)
+	}
+	return &token, nil
+}
+
+// Save implements TokenStore
+func (s *FileStore) Save(token *oauth2.Token) error {
+	data, err := json.Marshal(token)
+	if err != nil {
+		return fmt.Errorf("failed to marshal JSON for %s: %w", s.path, err)
+	}
+	return writeFileAtomic(s.path, data)
+}
+
+// Delete implements TokenStore
+func (s *FileStore) Delete() error {
+	return removeFile(s.path)
+}
+
+// scrypt parameters for deriving the encryption key
+const (
+	scryptN       = 1 << 15
+	scryptR       = 8
+	scryptP       = 1
+	scryptKeySize = 32
+	saltSize      = 16
+)
+
+// encryptedToken is the on-disk format of an EncryptedFileStore
+type encryptedToken struct {
+	Salt       []byte `json:"salt"`
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+// EncryptedFileStore saves the token in a file encrypted with AES-GCM, using a
+// key derived from a secret (a passphrase or the contents of a key file)
+type EncryptedFileStore struct {
+	path   string
+	secret []byte
+}
+
+// NewEncryptedFileStore returns a store that encrypts the token with the secret
+func NewEncryptedFileStore(path string, secret []byte) (*EncryptedFileStore, error) {
+	if len(secret) == 0 {
+		return nil, fmt.Errorf("encryption secret must not be empty")
+	}
+	return &EncryptedFileStore{path: path, secret: secret}, nil
+}
+
+// cipher derives the key for the salt and returns an AEAD using it
+func (s *EncryptedFileStore) cipher(salt []byte) (cipher.AEAD, error) {
+	key, err := scrypt.Key(s.secret, salt, scryptN, scryptR, scryptP, scryptKeySize)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive key: %w", err)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %w", err)
+	}
+	return cipher.NewGCM(block)
+}
+
+// Load implements TokenStore
+func (s *EncryptedFileStore) Load() (*oauth2.Token, error) {
+	data, err := readFile(s.path)
+	if err != nil {
+		return nil, err
+	}
+	var encrypted encryptedToken
+	if err := json.Unmarshal(data, &encrypted); err != nil {
+		return nil, fmt.Errorf("failed to parse JSON from %s: %w", s.path, err)
+	}
+
+	aead, err := s.cipher(encrypted.Salt)
+	if err != nil {
+		return nil, err
+	}
+	if len(encrypted.Nonce) != aead.NonceSize() {
+		return nil, fmt.Errorf("invalid nonce in %s", s.path)
+	}
+	plaintext, err := aead.Open(nil, encrypted.Nonce, encrypted.Ciphertext, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt %s (wrong key or passphrase?): %w", s.path, err)
+	}
+
+	var token oauth2.Token
+	if err := json.Unmarshal(plaintext, &token); err != nil {
+		return nil, fmt.Errorf("failed to parse decrypted token: %w", err)
+	}
+	return &token, nil
+}
+
+// Save implements TokenStore
+func (s *EncryptedFileStore) Save(token *oauth2.Token) error {
+	plaintext, err := json.Marshal(token)
+	if err != nil {
+		return fmt.Errorf("failed to marshal token: %w", err)
+	}
+
+	encrypted := encryptedToken{Salt: make([]byte, saltSize)}
+	if _, err := rand.Read(encrypted.Salt); err != nil {
+		return fmt.Errorf("failed to generate salt: %w", err)
+	}
+	aead, err := s.cipher(encrypted.Salt)
+	if err != nil {
+		return err
+	}
+	encrypted.Nonce = make([]byte, aead.NonceSize())
+	if _, err := rand.Read(encrypted.Nonce); err != nil {
+		return fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	encrypted.Ciphertext = aead.Seal(nil, encrypted.Nonce, plaintext, nil)
+
+	data, err := json.Marshal(encrypted)
+	if err != nil {
+		return fmt.Errorf("failed to marshal JSON for %s: %w", s.path, err)
+	}
+	return writeFileAtomic(s.path, data)
+}
+
+// Delete implements TokenStore
+func (s *EncryptedFileStore) Delete() error {
+	return removeFile(s.path)
+}
+
+// MemoryStore keeps the token in memory. It is safe for concurrent use.
+type MemoryStore struct {
+	mu    sync.Mutex
+	token *oauth2.Token
+}
+
+// NewMemoryStore returns a store holding the token, which may be nil
+func NewMemoryStore(token *oauth2.Token) *MemoryStore {
+	return &MemoryStore{token: token}
+}
+
+// Load implements TokenStore
+func (s *MemoryStore) Load() (*oauth2.Token, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.token == nil {
+		return nil, ErrNoToken
+	}
+	token := *s.token
+	return &token, nil
+}
+
+// Save implements TokenStore
+func (s *MemoryStore) Save(token *oauth2.Token) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	saved := *token
+	s.token = &saved
+	return nil
+}
+
+// Delete implements TokenStore
+func (s *MemoryStore) Delete() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.token = nil
+	return nil
+}
+
+// readFile reads a token file, returning ErrNoToken if it doesn't exist
+func readFile(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNoToken
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file %s: %w", path, err)
+	}
+	return data, nil
+}
+
+// removeFile removes a token file, ignoring it if it doesn't exist
+func removeFile(path string) error {
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to remove %s: %w", path, err)
+	}
+	return nil
+}
+
+// writeFileAtomic writes the file by writing a temporary file in the same
+// directory and renaming it into place, so that concurrent readers never see
+// a partially written file
+func writeFileAtomic(path string, data []byte) error {
+	dir, base := filepath.Split(path)
+	tmp, err := os.CreateTemp(dir, base+".tmp*")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file for %s: %w", path, err)
+	}
+	// Clean up the temporary file unless it is successfully renamed
+	defer os.Remove(tmp.Name())
+
+	if err := tmp.Chmod(0600); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to set permissions on %s: %w", tmp.Name(), err)
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write %s: %w", tmp.Name(), err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to sync %s: %w", tmp.Name(), err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to close %s: %w", tmp.Name(), err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to rename %s to %s: %w", tmp.Name(), path, err)
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package auth
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+func TestTokenStores(t *testing.T) {
+	dir := t.TempDir()
+	encrypted, err := NewEncryptedFileStore(filepath.Join(dir, "token.enc"), []byte("passphrase"))
+	if err != nil {
+		t.Fatalf("NewEncryptedFileStore() error = %v", err)
+	}
+
+	stores := map[string]TokenStore{
+		"file":      NewFileStore(filepath.Join(dir, "token.json")),
+		"encrypted": encrypted,
+		"memory":    NewMemoryStore(nil),
+	}
+
+	token := &oauth2.Token{
+		AccessToken:  "access",
+		RefreshToken: "refresh",
+		Expiry:       time.Date(2024, 3, 20, 14, 30, 0, 0, time.UTC),
+	}
+
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			if _, err := store.Load(); !errors.Is(err, ErrNoToken) {
+				t.Fatalf("Load() before Save() error = %v, want %v", err, ErrNoToken)
+			}
+
+			if err := store.Save(token); err != nil {
+				t.Fatalf("Save() error = %v", err)
+			}
+			got, err := store.Load()
+			if err != nil {
+				t.Fatalf("Load() error = %v", err)
+			}
+			if tokenChanged(got, token) {
+				t.Errorf("Load() = %+v, want %+v", got, token)
+			}
+
+			if err := store.Delete(); err != nil {
+				t.Fatalf("Delete() error = %v", err)
+			}
+			if err := store.Delete(); err != nil {
+				t.Fatalf("Delete() of missing token error = %v", err)
+			}
+			if _, err := store.Load(); !errors.Is(err, ErrNoToken) {
+				t.Errorf("Load() after Delete() error = %v, want %v", err, ErrNoToken)
+			}
+		})
+	}
+}
+
+func TestEncryptedFileStoreWrongSecret(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "token.enc")
+	store, _ := NewEncryptedFileStore(path, []byte("right"))
+	if err := store.Save(&oauth2.Token{AccessToken: "secret-access-token"}); err != nil {
+		t.Fatalf("Save() error = %v", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile() error = %v", err)
+	}
+	if bytes.Contains(data, []byte("secret-access-token")) {
+		t.Errorf("token file contains the plaintext token")
+	}
+
+	wrong, _ := NewEncryptedFileStore(path, []byte("wrong"))
+	if _, err := wrong.Load(); err == nil || errors.Is(err, ErrNoToken) {
+		t.Errorf("Load() with wrong secret error = %v, want decryption error", err)
+	}
+}
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "token.json")
+	if err := writeFileAtomic(path, []byte("first")); err != nil {
+		t.Fatalf("writeFileAtomic() error = %v", err)
+	}
+	if err := writeFileAtomic(path, []byte("second")); err != nil {
+		t.Fatalf("writeFileAtomic() error = %v", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil || string(data) != "second" {
+		t.Errorf("file contents = %q, %v, want %q", data, err, "second")
+	}
+	info, err := os.Stat(path)
+	if err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("file mode = %v, %v, want 0600", info.Mode().Perm(), err)
+	}
+
+	// No temporary files should be left behind
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 {
+		t.Errorf("directory has %d entries, want 1", len(entries))
+	}
+}
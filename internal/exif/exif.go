@@ -0,0 +1,346 @@
+// Package exif writes and reads the few EXIF tags that describe a captured
+// frame: when it was taken, by which camera, and a comment describing the
+// capture.
+package exif
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// ErrNotFound is returned when an image doesn't have the requested EXIF data
+var ErrNotFound = errors.New("no EXIF date found")
+
+// JPEG markers
+const (
+	markerSOI  = 0xD8
+	markerEOI  = 0xD9
+	markerSOS  = 0xDA
+	markerAPP1 = 0xE1
+)
+
+// exifHeader starts the APP1 segment holding EXIF data
+var exifHeader = []byte("Exif\x00\x00")
+
+// maxSegmentSize is the most a JPEG segment can hold after its length
+const maxSegmentSize = 0xFFFF - 2
+
+// EXIF tags
+const (
+	tagMake               = 0x010F
+	tagModel              = 0x0110
+	tagExifIFD            = 0x8769
+	tagDateTimeOriginal   = 0x9003
+	tagOffsetTimeOriginal = 0x9011
+	tagUserComment        = 0x9286
+)
+
+// EXIF value types
+const (
+	typeASCII     = 2
+	typeLong      = 4
+	typeUndefined = 7
+)
+
+// Formats of EXIF dates and timezone offsets
+const (
+	dateTimeFormat = "2006:01:02 15:04:05"
+	offsetFormat   = "-07:00"
+)
+
+// Info is what is recorded about a frame
+type Info struct {
+	// Time is when the frame was taken. It is recorded as DateTimeOriginal,
+	// in its location, with the location's offset as OffsetTimeOriginal.
+	Time time.Time
+	// Make is the camera's manufacturer and Model its model or name. Either
+	// is left out if empty.
+	Make, Model string
+	// UserComment describes the capture. It is left out if empty.
+	UserComment string
+}
+
+// Embed returns a copy of the JPEG with EXIF data describing the frame,
+// replacing any EXIF data it already had
+func Embed(jpeg []byte, info Info) ([]byte, error) {
+	if len(jpeg) < 2 || jpeg[0] != 0xFF || jpeg[1] != markerSOI {
+		return nil, fmt.Errorf("image isn't a JPEG")
+	}
+	segment := append(append([]byte{}, exifHeader...), encodeTIFF(info)...)
+	if len(segment) > maxSegmentSize {
+		return nil, fmt.Errorf("EXIF data is too large (%d bytes)", len(segment))
+	}
+
+	var out bytes.Buffer
+	out.Grow(len(jpeg) + len(segment) + 4)
+	out.Write([]byte{0xFF, markerSOI, 0xFF, markerAPP1})
+	binary.Write(&out, binary.BigEndian, uint16(len(segment)+2))
+	out.Write(segment)
+
+	// Copy the remaining segments, leaving out any existing EXIF data
+	rest := jpeg[2:]
+	for len(rest) >= 4 && rest[0] == 0xFF && rest[1] != markerSOS && rest[1] != markerEOI {
+		length := int(binary.BigEndian.Uint16(rest[2:4])) + 2
+		if length < 4 {
+			// The length counts its own two bytes
+			return nil, fmt.Errorf("invalid JPEG segment length")
+		}
+		if length > len(rest) {
+			return nil, fmt.Errorf("JPEG segment overruns the image")
+		}
+		if rest[1] != markerAPP1 || !bytes.HasPrefix(rest[4:length], exifHeader) {
+			out.Write(rest[:length])
+		}
+		rest = rest[length:]
+	}
+	out.Write(rest)
+	return out.Bytes(), nil
+}
+
+// entry is an entry of an image file directory (IFD)
+type entry struct {
+	tag   uint16
+	typ   uint16
+	count uint32
+	value []byte
+}
+
+// asciiEntry returns an entry holding the NUL terminated string
+func asciiEntry(tag uint16, s string) entry {
+	return entry{tag: tag, typ: typeASCII, count: uint32(len(s) + 1), value: append([]byte(s), 0)}
+}
+
+// userCommentEntry returns a UserComment entry, which starts with the
+// character code of the comment: ASCII if it can be, otherwise big endian
+// UTF-16 to match the byte order of the TIFF data
+func userCommentEntry(comment string) entry {
+	var value []byte
+	if isASCII(comment) {
+		value = append([]byte("ASCII\x00\x00\x00"), comment...)
+	} else {
+		value = []byte("UNICODE\x00")
+		for _, unit := range utf16.Encode([]rune(comment)) {
+			value = binary.BigEndian.AppendUint16(value, unit)
+		}
+	}
+	return entry{tag: tagUserComment, typ: typeUndefined, count: uint32(len(value)), value: value}
+}
+
+// isASCII reports whether the string is 7-bit ASCII
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+// ifdSize returns how many bytes the IFD and its values take
+func ifdSize(entries []entry) uint32 {
+	size := uint32(2 + 12*len(entries) + 4)
+	for _, e := range entries {
+		if len(e.value) > 4 {
+			size += uint32(len(e.value) + len(e.value)%2)
+		}
+	}
+	return size
+}
+
+// appendIFD appends the IFD, which starts at offset within the TIFF data,
+// followed by the values that don't fit in its entries. The entries must be
+// sorted by tag.
+func appendIFD(b []byte, entries []entry, offset uint32) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(len(entries)))
+	valueOffset := offset + uint32(2+12*len(entries)+4)
+	var values []byte
+	for _, e := range entries {
+		b = binary.BigEndian.AppendUint16(b, e.tag)
+		b = binary.BigEndian.AppendUint16(b, e.typ)
+		b = binary.BigEndian.AppendUint32(b, e.count)
+		if len(e.value) <= 4 {
+			var inline [4]byte
+			copy(inline[:], e.value)
+			b = append(b, inline[:]...)
+			continue
+		}
+		b = binary.BigEndian.AppendUint32(b, valueOffset+uint32(len(values)))
+		values = append(values, e.value...)
+		if len(e.value)%2 == 1 {
+			values = append(values, 0)
+		}
+	}
+	b = binary.BigEndian.AppendUint32(b, 0) // no next IFD
+	return append(b, values...)
+}
+
+// encodeTIFF encodes the info as big endian TIFF data, with the camera in the
+// first IFD and the rest in the EXIF IFD it points to
+func encodeTIFF(info Info) []byte {
+	var ifd0 []entry
+	if info.Make != "" {
+		ifd0 = append(ifd0, asciiEntry(tagMake, info.Make))
+	}
+	if info.Model != "" {
+		ifd0 = append(ifd0, asciiEntry(tagModel, info.Model))
+	}
+	exifPointer := entry{tag: tagExifIFD, typ: typeLong, count: 1}
+	ifd0 = append(ifd0, exifPointer)
+
+	exifIFD := []entry{
+		asciiEntry(tagDateTimeOriginal, info.Time.Format(dateTimeFormat)),
+		asciiEntry(tagOffsetTimeOriginal, info.Time.Format(offsetFormat)),
+	}
+	if info.UserComment != "" {
+		exifIFD = append(exifIFD, userCommentEntry(info.UserComment))
+	}
+
+	const ifd0Offset = 8
+	exifOffset := ifd0Offset + ifdSize(ifd0)
+	ifd0[len(ifd0)-1].value = binary.BigEndian.AppendUint32(nil, exifOffset)
+
+	b := []byte{'M', 'M', 0, 42, 0, 0, 0, ifd0Offset}
+	b = appendIFD(b, ifd0, ifd0Offset)
+	return appendIFD(b, exifIFD, exifOffset)
+}
+
+// ReadDateTimeOriginal reads when a JPEG was taken from its EXIF
+// DateTimeOriginal, in the timezone of its OffsetTimeOriginal, or in the
+// local timezone if it doesn't have one. It returns ErrNotFound if the image
+// doesn't have a date. Only the image's header is read.
+func ReadDateTimeOriginal(r io.Reader) (time.Time, error) {
+	br := bufio.NewReader(r)
+	var soi [2]byte
+	if _, err := io.ReadFull(br, soi[:]); err != nil || soi[0] != 0xFF || soi[1] != markerSOI {
+		return time.Time{}, fmt.Errorf("image isn't a JPEG")
+	}
+
+	for {
+		var header [4]byte
+		if _, err := io.ReadFull(br, header[:]); err != nil {
+			return time.Time{}, fmt.Errorf("failed to read JPEG segment: %w", err)
+		}
+		if header[0] != 0xFF {
+			return time.Time{}, fmt.Errorf("invalid JPEG segment marker")
+		}
+		if header[1] == markerSOS || header[1] == markerEOI {
+			return time.Time{}, ErrNotFound
+		}
+		length := int(binary.BigEndian.Uint16(header[2:])) - 2
+		if length < 0 {
+			return time.Time{}, fmt.Errorf("invalid JPEG segment length")
+		}
+		if header[1] != markerAPP1 {
+			if _, err := br.Discard(length); err != nil {
+				return time.Time{}, fmt.Errorf("failed to read JPEG segment: %w", err)
+			}
+			continue
+		}
+
+		segment := make([]byte, length)
+		if _, err := io.ReadFull(br, segment); err != nil {
+			return time.Time{}, fmt.Errorf("failed to read JPEG segment: %w", err)
+		}
+		if bytes.HasPrefix(segment, exifHeader) {
+			return parseDateTimeOriginal(segment[len(exifHeader):])
+		}
+	}
+}
+
+// tiff reads values from TIFF data
+type tiff struct {
+	data  []byte
+	order binary.ByteOrder
+}
+
+// ifd returns the tags of the IFD at offset, mapped to the offsets of their
+// entries
+func (t tiff) ifd(offset uint32) (map[uint16]uint32, error) {
+	if uint64(offset)+2 > uint64(len(t.data)) {
+		return nil, fmt.Errorf("EXIF IFD is out of range")
+	}
+	count := uint32(t.order.Uint16(t.data[offset:]))
+	if uint64(offset)+2+12*uint64(count) > uint64(len(t.data)) {
+		return nil, fmt.Errorf("EXIF IFD is out of range")
+	}
+	tags := make(map[uint16]uint32, count)
+	for i := uint32(0); i < count; i++ {
+		entryOffset := offset + 2 + 12*i
+		tags[t.order.Uint16(t.data[entryOffset:])] = entryOffset
+	}
+	return tags, nil
+}
+
+// ascii returns the string held by the ASCII entry at entryOffset
+func (t tiff) ascii(entryOffset uint32) (string, error) {
+	if t.order.Uint16(t.data[entryOffset+2:]) != typeASCII {
+		return "", fmt.Errorf("EXIF tag isn't text")
+	}
+	count := t.order.Uint32(t.data[entryOffset+4:])
+	valueOffset := entryOffset + 8
+	if count > 4 {
+		valueOffset = t.order.Uint32(t.data[entryOffset+8:])
+	}
+	if uint64(valueOffset)+uint64(count) > uint64(len(t.data)) {
+		return "", fmt.Errorf("EXIF value is out of range")
+	}
+	return string(bytes.TrimRight(t.data[valueOffset:valueOffset+count], "\x00")), nil
+}
+
+// parseDateTimeOriginal reads DateTimeOriginal and OffsetTimeOriginal from
+// the TIFF data of an EXIF segment
+func parseDateTimeOriginal(data []byte) (time.Time, error) {
+	if len(data) < 8 {
+		return time.Time{}, fmt.Errorf("EXIF data is too short")
+	}
+	t := tiff{data: data}
+	switch string(data[:2]) {
+	case "II":
+		t.order = binary.LittleEndian
+	case "MM":
+		t.order = binary.BigEndian
+	default:
+		return time.Time{}, fmt.Errorf("invalid EXIF byte order")
+	}
+
+	ifd0, err := t.ifd(t.order.Uint32(data[4:]))
+	if err != nil {
+		return time.Time{}, err
+	}
+	pointer, ok := ifd0[tagExifIFD]
+	if !ok {
+		return time.Time{}, ErrNotFound
+	}
+	exifIFD, err := t.ifd(t.order.Uint32(data[pointer+8:]))
+	if err != nil {
+		return time.Time{}, err
+	}
+	dateEntry, ok := exifIFD[tagDateTimeOriginal]
+	if !ok {
+		return time.Time{}, ErrNotFound
+	}
+	date, err := t.ascii(dateEntry)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	if offsetEntry, ok := exifIFD[tagOffsetTimeOriginal]; ok {
+		if offset, err := t.ascii(offsetEntry); err == nil {
+			if taken, err := time.Parse(dateTimeFormat+offsetFormat, date+offset); err == nil {
+				return taken, nil
+			}
+		}
+	}
+	taken, err := time.ParseInLocation(dateTimeFormat, date, time.Local)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid EXIF date %q", date)
+	}
+	return taken, nil
+}
@@ -0,0 +1,103 @@
+package exif
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/jpeg"
+	"testing"
+	"time"
+)
+
+// testJPEG returns a small JPEG without EXIF data
+func testJPEG(t *testing.T) []byte {
+	t.Helper()
+	var b bytes.Buffer
+	if err := jpeg.Encode(&b, image.NewGray(image.Rect(0, 0, 16, 8)), nil); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+func TestEmbedAndRead(t *testing.T) {
+	taken := time.Date(2025, 5, 1, 12, 30, 0, 0, time.FixedZone("CEST", 2*60*60))
+	info := Info{Time: taken, Make: "Google", Model: "Garden", UserComment: "source=nest-webrtc"}
+	withEXIF, err := Embed(testJPEG(t), info)
+	if err != nil {
+		t.Fatalf("Embed() error = %v", err)
+	}
+
+	img, err := jpeg.Decode(bytes.NewReader(withEXIF))
+	if err != nil {
+		t.Fatalf("image doesn't decode with EXIF data: %v", err)
+	}
+	if img.Bounds().Dx() != 16 || img.Bounds().Dy() != 8 {
+		t.Errorf("image is %v, want 16x8", img.Bounds())
+	}
+	for _, want := range []string{"Google", "Garden", "2025:05:01 12:30:00", "+02:00", "ASCII\x00\x00\x00source=nest-webrtc"} {
+		if !bytes.Contains(withEXIF, []byte(want)) {
+			t.Errorf("EXIF data doesn't contain %q", want)
+		}
+	}
+
+	got, err := ReadDateTimeOriginal(bytes.NewReader(withEXIF))
+	if err != nil {
+		t.Fatalf("ReadDateTimeOriginal() error = %v", err)
+	}
+	if !got.Equal(taken) {
+		t.Errorf("ReadDateTimeOriginal() = %v, want %v", got, taken)
+	}
+	if _, offset := got.Zone(); offset != 2*60*60 {
+		t.Errorf("ReadDateTimeOriginal() offset = %d, want 7200", offset)
+	}
+}
+
+func TestEmbedReplacesEXIF(t *testing.T) {
+	first, err := Embed(testJPEG(t), Info{Time: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), Model: "Old"})
+	if err != nil {
+		t.Fatalf("Embed() error = %v", err)
+	}
+	taken := time.Date(2025, 5, 1, 12, 30, 0, 0, time.UTC)
+	second, err := Embed(first, Info{Time: taken, UserComment: "Café"})
+	if err != nil {
+		t.Fatalf("Embed() error = %v", err)
+	}
+
+	if n := bytes.Count(second, exifHeader); n != 1 {
+		t.Errorf("image has %d EXIF segments, want 1", n)
+	}
+	if bytes.Contains(second, []byte("Old")) {
+		t.Error("image still has the old EXIF data")
+	}
+	if !bytes.Contains(second, []byte("UNICODE\x00\x00C\x00a\x00f\x00\xe9")) {
+		t.Error("non-ASCII comment isn't UTF-16")
+	}
+	if got, err := ReadDateTimeOriginal(bytes.NewReader(second)); err != nil || !got.Equal(taken) {
+		t.Errorf("ReadDateTimeOriginal() = %v, %v, want %v", got, err, taken)
+	}
+}
+
+func TestReadDateTimeOriginalWithoutEXIF(t *testing.T) {
+	if _, err := ReadDateTimeOriginal(bytes.NewReader(testJPEG(t))); !errors.Is(err, ErrNotFound) {
+		t.Errorf("ReadDateTimeOriginal() error = %v, want ErrNotFound", err)
+	}
+	if _, err := ReadDateTimeOriginal(bytes.NewReader([]byte("not a jpeg"))); err == nil || errors.Is(err, ErrNotFound) {
+		t.Errorf("ReadDateTimeOriginal() error = %v, want an invalid image", err)
+	}
+	if _, err := Embed([]byte("not a jpeg"), Info{}); err == nil {
+		t.Error("Embed() succeeded on an invalid image")
+	}
+}
+
+func TestEmbedMalformedSegment(t *testing.T) {
+	for _, length := range []byte{0, 1} {
+		// A comment segment whose length is too short to count itself
+		jpeg := []byte{0xFF, 0xD8, 0xFF, 0xFE, 0x00, length, 0xFF, 0xD9}
+		if _, err := Embed(jpeg, Info{}); err == nil {
+			t.Errorf("Embed() with a segment length of %d succeeded, want an error", length)
+		}
+		if _, err := ReadDateTimeOriginal(bytes.NewReader(jpeg)); err == nil || errors.Is(err, ErrNotFound) {
+			t.Errorf("ReadDateTimeOriginal() with a segment length of %d = %v, want an invalid image", length, err)
+		}
+	}
+}
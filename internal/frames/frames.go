@@ -7,7 +7,9 @@ import (
 	"sort"
 	"strings"
 	"time"
+	"unicode"
 
+	"github.com/sigh/nest-timelapse/internal/exif"
 	"github.com/sigh/nest-timelapse/internal/parsetime"
 )
 
@@ -18,6 +20,7 @@ type FrameInfo struct {
 	Path     string        // Location of the image
 	Duration time.Duration // Duration of the frame
 	Time     time.Time     // Time when the frame was captured
+	Sidecar  *Sidecar      // How the frame was captured, or nil if unknown
 }
 
 // String returns the frame information formatted for ffmpeg concat demuxer
@@ -37,21 +40,43 @@ func (f FrameInfo) String() string {
 	return fmt.Sprintf("file 'file://%s'", escapedFile)
 }
 
-// parseFrameTime extracts the timestamp from a frame filename
-// Expected format: nest_camera_frame_YYYYMMDD_HHMMSS.jpg
-func parseFrameTime(filename string) (time.Time, error) {
+// CameraDirName converts a camera name into the name of the subdirectory its
+// frames are saved under when capturing from multiple cameras. For example,
+// "Front Door" becomes "front_door".
+func CameraDirName(name string) string {
+	var b strings.Builder
+	pendingSeparator := false
+	for _, r := range strings.ToLower(name) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			if pendingSeparator && b.Len() > 0 {
+				b.WriteRune('_')
+			}
+			pendingSeparator = false
+			b.WriteRune(r)
+		} else {
+			pendingSeparator = true
+		}
+	}
+	return b.String()
+}
+
+// CameraDir returns the directory containing the frames of the named camera
+// within a multi-camera output directory
+func CameraDir(outputDir, camera string) string {
+	return filepath.Join(outputDir, CameraDirName(camera))
+}
+
+// ParseFrameTime extracts the timestamp from a frame filename
+// Expected format: nest_camera_frame_YYYYMMDD_HHMMSS.<extension>
+func ParseFrameTime(filename string) (time.Time, error) {
 	base := filepath.Base(filename)
-	parts := strings.Split(base, "_")
-	if len(parts) < 4 {
+	name, ok := strings.CutPrefix(strings.TrimSuffix(base, filepath.Ext(base)), FilePrefix)
+	if !ok {
 		return time.Time{}, fmt.Errorf("invalid filename format: %s", filename)
 	}
 
-	// Get the date and time parts
-	dateStr := parts[3]
-	timeStr := strings.TrimSuffix(parts[4], filepath.Ext(parts[4]))
-
 	// Parse the timestamp
-	t, err := time.Parse("20060102_150405", dateStr+"_"+timeStr)
+	t, err := time.Parse(fileTimeFormat, name)
 	if err != nil {
 		return time.Time{}, fmt.Errorf("invalid timestamp in filename: %s", filename)
 	}
@@ -59,9 +84,51 @@ func parseFrameTime(filename string) (time.Time, error) {
 	return t, nil
 }
 
+// frameTime returns when the frame at path was captured. Frames named like
+// captured frames are timed by their filename, and other images by their EXIF
+// DateTimeOriginal.
+func frameTime(path string) (time.Time, error) {
+	if strings.HasPrefix(filepath.Base(path), FilePrefix) {
+		if t, err := ParseFrameTime(path); err == nil {
+			return t, nil
+		}
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer f.Close()
+	taken, err := exif.ReadDateTimeOriginal(f)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	// Filenames hold the local time without a timezone, which ParseFrameTime
+	// returns as UTC, so return EXIF dates the same way to sort them together
+	local := taken.In(time.Local)
+	return time.Date(local.Year(), local.Month(), local.Day(),
+		local.Hour(), local.Minute(), local.Second(), 0, time.UTC), nil
+}
+
+// checkSameFormat returns an error if the frames aren't all in the same image
+// format
+func checkSameFormat(frames []FrameInfo) error {
+	first := fileFormat(frames[0].Path)
+	for _, frame := range frames[1:] {
+		if format := fileFormat(frame.Path); format != first {
+			return fmt.Errorf("frames must all be in the same format, but %s is %s and %s is %s",
+				frames[0].Path, first, frame.Path, format)
+		}
+	}
+	return nil
+}
+
 // GenerateFrames generates frame information for the timelapse by walking the input directory
-// and finding all image files. Returns a channel of frames and an error channel.
-func GenerateFrames(inputDir string, speedup float64, timeRange *parsetime.TimeRange) (<-chan FrameInfo, <-chan error) {
+// and finding all image files, which must all be in the same format. Each frame is annotated
+// with its sidecar, if it has a readable one, and only frames that pass the filter are used,
+// unless it is nil. Returns a channel of frames and an error channel.
+func GenerateFrames(inputDir string, speedup float64, timeRange *parsetime.TimeRange, filter Filter) (<-chan FrameInfo, <-chan error) {
 	frameChan := make(chan FrameInfo)
 	errChan := make(chan error, 1)
 
@@ -92,20 +159,15 @@ func GenerateFrames(inputDir string, speedup float64, timeRange *parsetime.TimeR
 				return nil
 			}
 
-			// Check if file is a jpg
-			if !strings.HasSuffix(strings.ToLower(path), ".jpg") {
+			// Check if file is an image
+			if !IsImage(path) {
 				return nil
 			}
 
-			// Check if filename matches our expected pattern
-			if !strings.HasPrefix(filepath.Base(path), "nest_camera_frame_") {
-				return nil
-			}
-
-			// Parse timestamp from filename
-			t, err := parseFrameTime(path)
+			// Parse timestamp from filename, or from the EXIF data of other images
+			t, err := frameTime(path)
 			if err != nil {
-				// Skip files that don't match our timestamp format
+				// Skip files without a timestamp
 				return nil
 			}
 
@@ -116,10 +178,20 @@ func GenerateFrames(inputDir string, speedup float64, timeRange *parsetime.TimeR
 				}
 			}
 
-			validFrames = append(validFrames, FrameInfo{
+			frame := FrameInfo{
 				Path: path,
 				Time: t,
-			})
+			}
+
+			// A missing or unreadable sidecar only means less is known about the frame
+			if sidecar, err := ReadSidecar(path); err == nil {
+				frame.Sidecar = sidecar
+			}
+			if filter != nil && !filter(frame) {
+				return nil
+			}
+
+			validFrames = append(validFrames, frame)
 			return nil
 		})
 
@@ -133,6 +205,12 @@ func GenerateFrames(inputDir string, speedup float64, timeRange *parsetime.TimeR
 			return
 		}
 
+		// ffmpeg's concat demuxer decodes every frame with the decoder of the first
+		if err := checkSameFormat(validFrames); err != nil {
+			errChan <- err
+			return
+		}
+
 		// Sort frames by timestamp
 		sort.Slice(validFrames, func(i, j int) bool {
 			return validFrames[i].Time.Before(validFrames[j].Time)
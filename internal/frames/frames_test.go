@@ -0,0 +1,107 @@
+package frames
+
+import (
+	"bytes"
+	"image"
+	"image/jpeg"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sigh/nest-timelapse/internal/exif"
+)
+
+func TestGenerateFramesFallsBackToEXIF(t *testing.T) {
+	inputDir := t.TempDir()
+	var plain bytes.Buffer
+	if err := jpeg.Encode(&plain, image.NewGray(image.Rect(0, 0, 8, 8)), nil); err != nil {
+		t.Fatal(err)
+	}
+	withEXIF, err := exif.Embed(plain.Bytes(), exif.Info{Time: time.Date(2025, 5, 1, 13, 0, 0, 0, time.Local)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, data := range map[string][]byte{
+		"nest_camera_frame_20250501_120000.jpg": plain.Bytes(),
+		"IMG_0001.jpg":                          withEXIF,
+		"IMG_0002.jpg":                          plain.Bytes(), // no timestamp at all
+	} {
+		if err := os.WriteFile(filepath.Join(inputDir, name), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	frameChan, errChan := GenerateFrames(inputDir, 1, nil, nil)
+	var got []FrameInfo
+	for frame := range frameChan {
+		got = append(got, frame)
+	}
+	if err := <-errChan; err != nil {
+		t.Fatalf("GenerateFrames() error = %v", err)
+	}
+
+	want := []struct {
+		name string
+		time time.Time
+	}{
+		{"nest_camera_frame_20250501_120000.jpg", time.Date(2025, 5, 1, 12, 0, 0, 0, time.UTC)},
+		{"IMG_0001.jpg", time.Date(2025, 5, 1, 13, 0, 0, 0, time.UTC)},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("GenerateFrames() = %d frames, want %d", len(got), len(want))
+	}
+	for i, w := range want {
+		if filepath.Base(got[i].Path) != w.name || !got[i].Time.Equal(w.time) {
+			t.Errorf("frame %d = %s at %v, want %s at %v", i, filepath.Base(got[i].Path), got[i].Time, w.name, w.time)
+		}
+	}
+}
+
+func TestGenerateFramesAcceptsEachFormat(t *testing.T) {
+	start := time.Date(2025, 5, 1, 12, 0, 0, 0, time.UTC)
+	for _, format := range Formats {
+		t.Run(format, func(t *testing.T) {
+			inputDir := t.TempDir()
+			for i := range 2 {
+				name := FileName(start.Add(time.Duration(i)*time.Hour), Extension(format))
+				if err := os.WriteFile(filepath.Join(inputDir, name), nil, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			frameChan, errChan := GenerateFrames(inputDir, 1, nil, nil)
+			var got []string
+			for frame := range frameChan {
+				got = append(got, filepath.Ext(frame.Path))
+			}
+			if err := <-errChan; err != nil {
+				t.Fatalf("GenerateFrames() error = %v", err)
+			}
+			if want := []string{"." + Extension(format), "." + Extension(format)}; !slices.Equal(got, want) {
+				t.Errorf("GenerateFrames() extensions = %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestGenerateFramesRejectsMixedFormats(t *testing.T) {
+	inputDir := t.TempDir()
+	start := time.Date(2025, 5, 1, 12, 0, 0, 0, time.UTC)
+	for i, format := range Formats {
+		name := FileName(start.Add(time.Duration(i)*time.Hour), Extension(format))
+		if err := os.WriteFile(filepath.Join(inputDir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	frameChan, errChan := GenerateFrames(inputDir, 1, nil, nil)
+	for range frameChan {
+		t.Error("GenerateFrames() sent a frame, want none")
+	}
+	if err := <-errChan; err == nil || !strings.Contains(err.Error(), "same format") {
+		t.Errorf("GenerateFrames() error = %v, want one about the same format", err)
+	}
+}
@@ -0,0 +1,139 @@
+package frames
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Frames are named by when they were taken, e.g.
+// nest_camera_frame_20250501_123000.jpg. Their sidecars and the recordings
+// made around them have the same name with their own extension.
+const (
+	// FilePrefix starts the name of every frame
+	FilePrefix = "nest_camera_frame_"
+	// fileTimeFormat is the time in the name of every frame
+	fileTimeFormat = "20060102_150405"
+)
+
+// Image formats that frames are saved in
+const (
+	FormatJPEG = "jpeg"
+	FormatPNG  = "png"
+	FormatWebP = "webp"
+)
+
+// Formats lists the image formats that frames are saved in
+var Formats = []string{FormatJPEG, FormatPNG, FormatWebP}
+
+// formatExtensions are the extensions of frames in each format. Frames are
+// saved with the first.
+var formatExtensions = map[string][]string{
+	FormatJPEG: {"jpg", "jpeg"},
+	FormatPNG:  {"png"},
+	FormatWebP: {"webp"},
+}
+
+// Extension returns the extension, without a dot, that frames in the format
+// are saved with, or an empty string for an unknown format
+func Extension(format string) string {
+	if extensions := formatExtensions[format]; len(extensions) > 0 {
+		return extensions[0]
+	}
+	return ""
+}
+
+// IsImage reports whether the file has the extension of a frame in any of the
+// formats, ignoring case
+func IsImage(path string) bool {
+	return fileFormat(path) != ""
+}
+
+// fileFormat returns the format of a frame from its extension, ignoring case,
+// or an empty string if it isn't an image
+func fileFormat(path string) string {
+	extension := strings.TrimPrefix(strings.ToLower(filepath.Ext(path)), ".")
+	for format, extensions := range formatExtensions {
+		if slices.Contains(extensions, extension) {
+			return format
+		}
+	}
+	return ""
+}
+
+// FileName returns the name of a frame taken at the time, or of a file saved
+// next to it, with the extension
+func FileName(t time.Time, extension string) string {
+	return FilePrefix + t.Format(fileTimeFormat) + "." + extension
+}
+
+// DetectFormat returns the format of the encoded image from its signature
+func DetectFormat(image []byte) (string, error) {
+	switch {
+	case bytes.HasPrefix(image, []byte{0xFF, 0xD8}):
+		return FormatJPEG, nil
+	case bytes.HasPrefix(image, []byte("\x89PNG\r\n\x1a\n")):
+		return FormatPNG, nil
+	case len(image) >= 12 && string(image[:4]) == "RIFF" && string(image[8:12]) == "WEBP":
+		return FormatWebP, nil
+	}
+	return "", fmt.Errorf("image isn't a JPEG, PNG or WebP")
+}
+
+// ImageSize returns the width and height of the encoded image, reading them
+// from its header
+func ImageSize(data []byte) (width, height int, err error) {
+	format, err := DetectFormat(data)
+	if err != nil {
+		return 0, 0, err
+	}
+	if format == FormatWebP {
+		return webpSize(data)
+	}
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return 0, 0, err
+	}
+	return config.Width, config.Height, nil
+}
+
+// webpSize reads the size of a WebP image from its first chunk, which is a
+// lossy (VP8), lossless (VP8L) or extended (VP8X) header
+func webpSize(data []byte) (width, height int, err error) {
+	const headerSize = 20 // RIFF header and the first chunk's header
+	if len(data) < headerSize+10 {
+		return 0, 0, fmt.Errorf("WebP image is too short")
+	}
+	chunk := data[headerSize:]
+	switch string(data[12:16]) {
+	case "VP8 ":
+		// A frame tag, then a start code before the 14 bit dimensions
+		if !bytes.Equal(chunk[3:6], []byte{0x9d, 0x01, 0x2a}) {
+			return 0, 0, fmt.Errorf("WebP VP8 frame has no start code")
+		}
+		width = int(binary.LittleEndian.Uint16(chunk[6:8]) & 0x3fff)
+		height = int(binary.LittleEndian.Uint16(chunk[8:10]) & 0x3fff)
+	case "VP8L":
+		// A signature byte, then the dimensions less one in 14 bits each
+		if chunk[0] != 0x2f {
+			return 0, 0, fmt.Errorf("WebP VP8L image has no signature")
+		}
+		bits := binary.LittleEndian.Uint32(chunk[1:5])
+		width = int(bits&0x3fff) + 1
+		height = int(bits>>14&0x3fff) + 1
+	case "VP8X":
+		// Flags, then the canvas dimensions less one in 24 bits each
+		width = int(uint32(chunk[4])|uint32(chunk[5])<<8|uint32(chunk[6])<<16) + 1
+		height = int(uint32(chunk[7])|uint32(chunk[8])<<8|uint32(chunk[9])<<16) + 1
+	default:
+		return 0, 0, fmt.Errorf("unknown WebP chunk %q", data[12:16])
+	}
+	return width, height, nil
+}
@@ -0,0 +1,97 @@
+package frames
+
+import (
+	"bytes"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"testing"
+	"time"
+)
+
+func TestFileNameRoundTrip(t *testing.T) {
+	taken := time.Date(2025, 5, 1, 12, 30, 5, 0, time.UTC)
+	for _, format := range Formats {
+		name := FileName(taken, Extension(format))
+		if !IsImage(name) {
+			t.Errorf("IsImage(%q) = false, want true", name)
+		}
+		got, err := ParseFrameTime(name)
+		if err != nil || !got.Equal(taken) {
+			t.Errorf("ParseFrameTime(%q) = %v, %v, want %v", name, got, err, taken)
+		}
+	}
+
+	for _, name := range []string{"frame.JPEG", "frame.Png", "frame.webp"} {
+		if !IsImage(name) {
+			t.Errorf("IsImage(%q) = false, want true", name)
+		}
+	}
+	for _, name := range []string{"nest_camera_frame_20250501_123005.json", "nest_camera_frame_20250501_123005.mp4"} {
+		if IsImage(name) {
+			t.Errorf("IsImage(%q) = true, want false", name)
+		}
+	}
+	for _, name := range []string{"IMG_20250501_123005.jpg", "nest_camera_frame_2025.jpg"} {
+		if _, err := ParseFrameTime(name); err == nil {
+			t.Errorf("ParseFrameTime(%q) succeeded, want an error", name)
+		}
+	}
+}
+
+func TestDetectFormat(t *testing.T) {
+	tests := map[string]string{
+		"\xff\xd8\xff\xe0":             FormatJPEG,
+		"\x89PNG\r\n\x1a\n\x00":        FormatPNG,
+		"RIFF\x10\x00\x00\x00WEBPVP8 ": FormatWebP,
+	}
+	for data, want := range tests {
+		if got, err := DetectFormat([]byte(data)); err != nil || got != want {
+			t.Errorf("DetectFormat(%q) = %q, %v, want %q", data, got, err, want)
+		}
+	}
+	if _, err := DetectFormat([]byte("GIF89a")); err == nil {
+		t.Error("DetectFormat() recognised a GIF")
+	}
+}
+
+// webpImage returns a WebP image whose first chunk has the type and data
+func webpImage(chunkType string, chunk []byte) []byte {
+	data := []byte("RIFF\x00\x00\x00\x00WEBP" + chunkType + "\x00\x00\x00\x00")
+	return append(data, chunk...)
+}
+
+func TestImageSize(t *testing.T) {
+	var jpegImage, pngImage bytes.Buffer
+	if err := jpeg.Encode(&jpegImage, image.NewGray(image.Rect(0, 0, 64, 48)), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := png.Encode(&pngImage, image.NewGray(image.Rect(0, 0, 32, 24))); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name          string
+		data          []byte
+		width, height int
+	}{
+		{"jpeg", jpegImage.Bytes(), 64, 48},
+		{"png", pngImage.Bytes(), 32, 24},
+		// 640x480 after a keyframe tag
+		{"webp lossy", webpImage("VP8 ", []byte{0x10, 0x02, 0x00, 0x9d, 0x01, 0x2a, 0x80, 0x02, 0xe0, 0x01}), 640, 480},
+		// 640x480, stored as 639 and 479 in 14 bits each
+		{"webp lossless", webpImage("VP8L", []byte{0x2f, 0x7f, 0xc2, 0x77, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}), 640, 480},
+		// 1920x1080, stored as 1919 and 1079 in 24 bits each
+		{"webp extended", webpImage("VP8X", []byte{0x00, 0x00, 0x00, 0x00, 0x7f, 0x07, 0x00, 0x37, 0x04, 0x00}), 1920, 1080},
+	}
+	for _, tt := range tests {
+		width, height, err := ImageSize(tt.data)
+		if err != nil || width != tt.width || height != tt.height {
+			t.Errorf("ImageSize(%s) = %d, %d, %v, want %d, %d", tt.name, width, height, err, tt.width, tt.height)
+		}
+	}
+
+	if _, _, err := ImageSize(webpImage("VP8 ", nil)); err == nil {
+		t.Error("ImageSize() of a truncated WebP succeeded, want an error")
+	}
+}
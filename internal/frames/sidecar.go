@@ -0,0 +1,181 @@
+package frames
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sidecarExtension is the extension of the sidecar saved next to each frame
+const sidecarExtension = ".json"
+
+// Sidecar describes how a frame was captured. It is saved next to the frame,
+// named like the frame but with a .json extension.
+type Sidecar struct {
+	// Camera is the camera's name and DeviceID its SDM device ID, if it is a
+	// Nest camera
+	Camera   string `json:"camera,omitempty"`
+	DeviceID string `json:"deviceId,omitempty"`
+	// Source is the kind of source the frame was captured from, e.g.
+	// "nest-webrtc" or "http"
+	Source string `json:"source,omitempty"`
+	// CaptureStart and CaptureEnd are when the capture started and finished.
+	// Frames taken from a continuous stream start when they are taken.
+	CaptureStart time.Time `json:"captureStart"`
+	CaptureEnd   time.Time `json:"captureEnd"`
+	// Codec is the codec of the video the frame was decoded from, if any
+	Codec string `json:"codec,omitempty"`
+	// Width and Height are the frame's size in pixels
+	Width  int `json:"width,omitempty"`
+	Height int `json:"height,omitempty"`
+	// Connection describes the WebRTC connection the frame was streamed
+	// over, if any
+	Connection *ConnectionStats `json:"connection,omitempty"`
+	// Scores are measurements of the frame, such as its sharpness or how loud
+	// its audio was
+	Scores map[string]float64 `json:"scores,omitempty"`
+	// Metadata is anything else the source recorded about the frame
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+// ConnectionStats describes how well a frame's video arrived
+type ConnectionStats struct {
+	RoundTripTimeMs float64 `json:"roundTripTimeMs"`
+	PacketsReceived uint64  `json:"packetsReceived"`
+	PacketsLost     int64   `json:"packetsLost"`
+	JitterMs        float64 `json:"jitterMs"`
+}
+
+// PacketLoss returns the fraction of the video's packets that were lost
+func (c *ConnectionStats) PacketLoss() float64 {
+	expected := float64(c.PacketsReceived) + float64(c.PacketsLost)
+	if expected <= 0 || c.PacketsLost <= 0 {
+		return 0
+	}
+	return float64(c.PacketsLost) / expected
+}
+
+// SidecarPath returns the path of the sidecar of the frame at framePath
+func SidecarPath(framePath string) string {
+	return strings.TrimSuffix(framePath, filepath.Ext(framePath)) + sidecarExtension
+}
+
+// WriteSidecar saves the sidecar next to the frame at framePath
+func WriteSidecar(framePath string, sidecar *Sidecar) error {
+	data, err := json.MarshalIndent(sidecar, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode sidecar: %w", err)
+	}
+	if err := os.WriteFile(SidecarPath(framePath), append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("failed to save sidecar: %w", err)
+	}
+	return nil
+}
+
+// ReadSidecar reads the sidecar of the frame at framePath. It returns an
+// error satisfying errors.Is(err, fs.ErrNotExist) if the frame doesn't have
+// one.
+func ReadSidecar(framePath string) (*Sidecar, error) {
+	data, err := os.ReadFile(SidecarPath(framePath))
+	if err != nil {
+		return nil, err
+	}
+	var sidecar Sidecar
+	if err := json.Unmarshal(data, &sidecar); err != nil {
+		return nil, fmt.Errorf("invalid sidecar for %s: %w", framePath, err)
+	}
+	return &sidecar, nil
+}
+
+// Value returns a numeric value from the sidecar by name: one of its scores,
+// "width", "height", or a connection stat, "roundTripTime" or "jitter" in
+// milliseconds, "packetsReceived", "packetsLost" or "packetLoss" as a
+// fraction. It reports whether the sidecar has the value.
+func (s *Sidecar) Value(name string) (float64, bool) {
+	switch name {
+	case "width":
+		return float64(s.Width), s.Width > 0
+	case "height":
+		return float64(s.Height), s.Height > 0
+	}
+	if c := s.Connection; c != nil {
+		switch name {
+		case "roundTripTime":
+			return c.RoundTripTimeMs, true
+		case "jitter":
+			return c.JitterMs, true
+		case "packetsReceived":
+			return float64(c.PacketsReceived), true
+		case "packetsLost":
+			return float64(c.PacketsLost), true
+		case "packetLoss":
+			return c.PacketLoss(), true
+		}
+	}
+	value, ok := s.Scores[name]
+	return value, ok
+}
+
+// Filter decides whether a frame is included in the timelapse
+type Filter func(FrameInfo) bool
+
+// comparisons are the operators a condition can use, longest first so that
+// "<=" isn't mistaken for "<"
+var comparisons = []struct {
+	op      string
+	compare func(a, b float64) bool
+}{
+	{"<=", func(a, b float64) bool { return a <= b }},
+	{">=", func(a, b float64) bool { return a >= b }},
+	{"!=", func(a, b float64) bool { return a != b }},
+	{"<", func(a, b float64) bool { return a < b }},
+	{">", func(a, b float64) bool { return a > b }},
+	{"=", func(a, b float64) bool { return a == b }},
+}
+
+// ParseCondition parses a condition on a sidecar value, such as
+// "sharpness>=100" or "packetLoss<0.01", into a filter. The value is looked up
+// with Sidecar.Value. Frames without a sidecar, or whose sidecar doesn't have
+// the value, pass the filter, so that frames captured before sidecars were
+// saved aren't dropped.
+func ParseCondition(condition string) (Filter, error) {
+	for _, c := range comparisons {
+		name, limitStr, found := strings.Cut(condition, c.op)
+		if !found {
+			continue
+		}
+		name = strings.TrimSpace(name)
+		if name == "" {
+			return nil, fmt.Errorf("missing value name in condition %q", condition)
+		}
+		limit, err := strconv.ParseFloat(strings.TrimSpace(limitStr), 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number in condition %q: %w", condition, err)
+		}
+		compare := c.compare
+		return func(frame FrameInfo) bool {
+			if frame.Sidecar == nil {
+				return true
+			}
+			value, ok := frame.Sidecar.Value(name)
+			return !ok || compare(value, limit)
+		}, nil
+	}
+	return nil, fmt.Errorf("condition %q must compare a value with <, <=, >, >=, = or !=", condition)
+}
+
+// AllFilters returns a filter that passes frames that pass all the filters
+func AllFilters(filters ...Filter) Filter {
+	return func(frame FrameInfo) bool {
+		for _, filter := range filters {
+			if !filter(frame) {
+				return false
+			}
+		}
+		return true
+	}
+}
@@ -0,0 +1,131 @@
+package frames
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSidecarRoundTrip(t *testing.T) {
+	framePath := filepath.Join(t.TempDir(), "nest_camera_frame_20250501_123000.jpg")
+	if _, err := ReadSidecar(framePath); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("ReadSidecar() error = %v, want not exist", err)
+	}
+
+	want := &Sidecar{
+		Camera:       "Garden",
+		CaptureStart: time.Date(2025, 5, 1, 12, 29, 58, 0, time.UTC),
+		CaptureEnd:   time.Date(2025, 5, 1, 12, 30, 5, 0, time.UTC),
+		Width:        1920,
+		Height:       1080,
+		Connection:   &ConnectionStats{PacketsReceived: 90, PacketsLost: 10},
+		Scores:       map[string]float64{"sharpness": 120.5},
+	}
+	if err := WriteSidecar(framePath, want); err != nil {
+		t.Fatalf("WriteSidecar() error = %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(filepath.Dir(framePath), "nest_camera_frame_20250501_123000.json")); err != nil {
+		t.Errorf("sidecar wasn't saved next to the frame: %v", err)
+	}
+
+	got, err := ReadSidecar(framePath)
+	if err != nil {
+		t.Fatalf("ReadSidecar() error = %v", err)
+	}
+	if got.Camera != want.Camera || !got.CaptureStart.Equal(want.CaptureStart) || !got.CaptureEnd.Equal(want.CaptureEnd) ||
+		got.Width != want.Width || got.Height != want.Height || *got.Connection != *want.Connection ||
+		got.Scores["sharpness"] != 120.5 {
+		t.Errorf("ReadSidecar() = %+v, want %+v", got, want)
+	}
+
+	for name, wantValue := range map[string]float64{"width": 1920, "packetsLost": 10, "packetLoss": 0.1, "sharpness": 120.5} {
+		if value, ok := got.Value(name); !ok || value != wantValue {
+			t.Errorf("Value(%q) = %v, %v, want %v", name, value, ok, wantValue)
+		}
+	}
+	if _, ok := got.Value("meanVolume"); ok {
+		t.Error("Value(\"meanVolume\") was found, want missing")
+	}
+}
+
+func TestParseCondition(t *testing.T) {
+	sharp := FrameInfo{Sidecar: &Sidecar{Scores: map[string]float64{"sharpness": 150}}}
+	blurry := FrameInfo{Sidecar: &Sidecar{Scores: map[string]float64{"sharpness": 50}}}
+	unscored := FrameInfo{Sidecar: &Sidecar{}}
+	noSidecar := FrameInfo{}
+
+	tests := []struct {
+		condition string
+		want      []bool // sharp, blurry, unscored, noSidecar
+	}{
+		{"sharpness>=100", []bool{true, false, true, true}},
+		{"sharpness < 100", []bool{false, true, true, true}},
+		{"sharpness<=50", []bool{false, true, true, true}},
+		{"sharpness=150", []bool{true, false, true, true}},
+		{"sharpness!=150", []bool{false, true, true, true}},
+	}
+	for _, tt := range tests {
+		filter, err := ParseCondition(tt.condition)
+		if err != nil {
+			t.Errorf("ParseCondition(%q) error = %v", tt.condition, err)
+			continue
+		}
+		for i, frame := range []FrameInfo{sharp, blurry, unscored, noSidecar} {
+			if got := filter(frame); got != tt.want[i] {
+				t.Errorf("ParseCondition(%q) on frame %d = %v, want %v", tt.condition, i, got, tt.want[i])
+			}
+		}
+	}
+
+	for _, condition := range []string{"sharpness", ">=100", "sharpness>=high"} {
+		if _, err := ParseCondition(condition); err == nil {
+			t.Errorf("ParseCondition(%q) succeeded, want an error", condition)
+		}
+	}
+}
+
+func TestGenerateFramesFiltersBySidecar(t *testing.T) {
+	inputDir := t.TempDir()
+	sharpness := map[string]float64{
+		"nest_camera_frame_20250501_120000.jpg": 150,
+		"nest_camera_frame_20250501_130000.jpg": 50,
+		"nest_camera_frame_20250501_140000.jpg": -1, // no sidecar
+	}
+	for name, score := range sharpness {
+		path := filepath.Join(inputDir, name)
+		if err := os.WriteFile(path, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if score >= 0 {
+			if err := WriteSidecar(path, &Sidecar{Scores: map[string]float64{"sharpness": score}}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	filter, err := ParseCondition("sharpness>=100")
+	if err != nil {
+		t.Fatal(err)
+	}
+	frameChan, errChan := GenerateFrames(inputDir, 1, nil, filter)
+	var got []FrameInfo
+	for frame := range frameChan {
+		got = append(got, frame)
+	}
+	if err := <-errChan; err != nil {
+		t.Fatalf("GenerateFrames() error = %v", err)
+	}
+
+	if len(got) != 2 {
+		t.Fatalf("GenerateFrames() = %d frames, want 2", len(got))
+	}
+	if filepath.Base(got[0].Path) != "nest_camera_frame_20250501_120000.jpg" || got[0].Sidecar == nil {
+		t.Errorf("frame 0 = %+v, want the sharp frame with its sidecar", got[0])
+	}
+	if filepath.Base(got[1].Path) != "nest_camera_frame_20250501_140000.jpg" || got[1].Sidecar != nil {
+		t.Errorf("frame 1 = %+v, want the frame without a sidecar", got[1])
+	}
+}
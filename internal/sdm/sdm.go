@@ -4,8 +4,13 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"net/url"
+	"slices"
+	"sort"
+	"strings"
+	"time"
 
-	"github.com/sigh/nest-timelapse/internal/auth"
+	"golang.org/x/oauth2"
 	"google.golang.org/api/option"
 	"google.golang.org/api/smartdevicemanagement/v1"
 )
@@ -15,9 +20,21 @@ type Service struct {
 	service *smartdevicemanagement.Service
 }
 
+// Options configures how the SDM API is accessed
+type Options struct {
+	// Endpoint overrides the base URL of the SDM API, e.g. to use a fake
+	// server in tests. If empty, the production API is used.
+	Endpoint string
+}
+
 // NewService creates a new SDM service using the provided token source
-func NewService(tokenSource *auth.TokenSource) (*Service, error) {
-	service, err := smartdevicemanagement.NewService(context.Background(), option.WithTokenSource(tokenSource))
+func NewService(ctx context.Context, tokenSource oauth2.TokenSource, opts Options) (*Service, error) {
+	clientOpts := []option.ClientOption{option.WithTokenSource(tokenSource)}
+	if opts.Endpoint != "" {
+		clientOpts = append(clientOpts, option.WithEndpoint(opts.Endpoint))
+	}
+
+	service, err := smartdevicemanagement.NewService(ctx, clientOpts...)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create SDM service: %w", err)
 	}
@@ -25,62 +42,463 @@ func NewService(tokenSource *auth.TokenSource) (*Service, error) {
 	return &Service{service: service}, nil
 }
 
-// FindCamera searches for a camera device in the enterprise and returns
-// the first one found
-func (s *Service) FindCamera(enterpriseID string) (*smartdevicemanagement.GoogleHomeEnterpriseSdmV1Device, error) {
+// Device types and protocols
+const (
+	// deviceTypePrefix is the common prefix of all SDM device types
+	deviceTypePrefix = "sdm.devices.types."
+	// cameraDeviceType is the SDM device type shared by all Nest cameras
+	cameraDeviceType = deviceTypePrefix + "CAMERA"
+	// ProtocolWebRTC is the live stream protocol used by newer cameras
+	ProtocolWebRTC = "WEB_RTC"
+	// ProtocolRTSP is the live stream protocol used by older cameras
+	ProtocolRTSP = "RTSP"
+)
+
+// Device is an alias for smartdevicemanagement.GoogleHomeEnterpriseSdmV1Device
+type Device = smartdevicemanagement.GoogleHomeEnterpriseSdmV1Device
+
+// Structure is an alias for smartdevicemanagement.GoogleHomeEnterpriseSdmV1Structure
+type Structure = smartdevicemanagement.GoogleHomeEnterpriseSdmV1Structure
+
+// infoTrait holds the fields of the sdm.devices.traits.Info and
+// sdm.structures.traits.Info traits
+type infoTrait struct {
+	CustomName string `json:"customName"`
+}
+
+// Resolution is a video resolution in pixels
+type Resolution struct {
+	Width  int `json:"width"`
+	Height int `json:"height"`
+}
+
+// CameraLiveStream holds the fields of the sdm.devices.traits.CameraLiveStream trait
+type CameraLiveStream struct {
+	MaxVideoResolution Resolution `json:"maxVideoResolution"`
+	VideoCodecs        []string   `json:"videoCodecs"`
+	AudioCodecs        []string   `json:"audioCodecs"`
+	SupportedProtocols []string   `json:"supportedProtocols"`
+}
+
+// deviceTraits holds the traits we care about from a device's trait map
+type deviceTraits struct {
+	Info       *infoTrait        `json:"sdm.devices.traits.Info"`
+	LiveStream *CameraLiveStream `json:"sdm.devices.traits.CameraLiveStream"`
+}
+
+// structureTraits holds the traits we care about from a structure's trait map
+type structureTraits struct {
+	Info *infoTrait `json:"sdm.structures.traits.Info"`
+}
+
+// parseTraits decodes the known traits from a raw trait map, ignoring any it
+// can't parse
+func parseTraits[T any](raw []byte) T {
+	var traits T
+	if len(raw) > 0 {
+		_ = json.Unmarshal(raw, &traits)
+	}
+	return traits
+}
+
+// TraitNames returns the sorted names of all traits reported for the device
+func TraitNames(device *Device) []string {
+	traits := parseTraits[map[string]json.RawMessage](device.Traits)
+	names := make([]string, 0, len(traits))
+	for name := range traits {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// DeviceType returns the device type without the sdm.devices.types. prefix
+// (e.g. CAMERA or DOORBELL)
+func DeviceType(device *Device) string {
+	return strings.TrimPrefix(device.Type, deviceTypePrefix)
+}
+
+// LiveStream returns the device's CameraLiveStream trait, or nil if the device
+// can't stream
+func LiveStream(device *Device) *CameraLiveStream {
+	return parseTraits[deviceTraits](device.Traits).LiveStream
+}
+
+// SupportsProtocol reports whether the device can live stream using the protocol
+func SupportsProtocol(device *Device, protocol string) bool {
+	liveStream := LiveStream(device)
+	return liveStream != nil && slices.Contains(liveStream.SupportedProtocols, protocol)
+}
+
+// StreamProtocol returns the protocol to stream from the device with,
+// preferring WebRTC over RTSP, or an empty string if it supports neither
+func StreamProtocol(device *Device) string {
+	for _, protocol := range []string{ProtocolWebRTC, ProtocolRTSP} {
+		if SupportsProtocol(device, protocol) {
+			return protocol
+		}
+	}
+	return ""
+}
+
+// CanCapture reports whether the capture tool can stream from the device
+func CanCapture(device *Device) bool {
+	return device.Type == cameraDeviceType && StreamProtocol(device) != ""
+}
+
+// StructureID returns the ID of the structure the device belongs to, or an
+// empty string if it isn't assigned to one
+func StructureID(device *Device) string {
+	for _, relation := range device.ParentRelations {
+		// Parents are enterprises/{enterprise}/structures/{structure}[/rooms/{room}]
+		parts := strings.Split(relation.Parent, "/")
+		if len(parts) >= 4 && parts[2] == "structures" {
+			return parts[3]
+		}
+	}
+	return ""
+}
+
+// StructureName returns the custom name of the structure, falling back to its ID
+func StructureName(structure *Structure) string {
+	if info := parseTraits[structureTraits](structure.Traits).Info; info != nil && info.CustomName != "" {
+		return info.CustomName
+	}
+	return structure.Name[strings.LastIndex(structure.Name, "/")+1:]
+}
+
+// DeviceID returns the device ID, which is the last component of the device name
+// (enterprises/{enterprise}/devices/{device})
+func DeviceID(device *Device) string {
+	return device.Name[strings.LastIndex(device.Name, "/")+1:]
+}
+
+// RoomName returns the display name of the room the device is assigned to,
+// or an empty string if it isn't assigned to a room
+func RoomName(device *Device) string {
+	for _, relation := range device.ParentRelations {
+		if strings.Contains(relation.Parent, "/rooms/") {
+			return relation.DisplayName
+		}
+	}
+	return ""
+}
+
+// CustomName returns the name the user gave the device, or an empty string if
+// it hasn't been named
+func CustomName(device *Device) string {
+	if info := parseTraits[deviceTraits](device.Traits).Info; info != nil {
+		return info.CustomName
+	}
+	return ""
+}
+
+// DisplayName returns a human readable name for the device. This is the custom
+// name set by the user if there is one, otherwise the room name, falling back
+// to the device ID.
+func DisplayName(device *Device) string {
+	if name := CustomName(device); name != "" {
+		return name
+	}
+	if room := RoomName(device); room != "" {
+		return room
+	}
+	return DeviceID(device)
+}
+
+// MatchesCamera reports whether the selector identifies the device. A selector
+// matches the device ID, display name or room name, ignoring case.
+func MatchesCamera(device *Device, selector string) bool {
+	for _, candidate := range []string{DeviceID(device), DisplayName(device), RoomName(device)} {
+		if candidate != "" && strings.EqualFold(candidate, selector) {
+			return true
+		}
+	}
+	return false
+}
+
+// ListDevices returns all devices the enterprise has been granted access to
+func (s *Service) ListDevices(ctx context.Context, enterpriseID string) ([]*Device, error) {
 	if enterpriseID == "" {
 		return nil, fmt.Errorf("enterprise ID is required")
 	}
 
-	listDeviceResponse, err := s.service.Enterprises.Devices.List("enterprises/" + enterpriseID).Do()
+	listDeviceResponse, err := s.service.Enterprises.Devices.List("enterprises/" + enterpriseID).Context(ctx).Do()
 	if err != nil {
 		return nil, fmt.Errorf("failed to list devices: %w", err)
 	}
 
-	if len(listDeviceResponse.Devices) == 0 {
+	return listDeviceResponse.Devices, nil
+}
+
+// ListStructures returns all structures the enterprise has been granted access to
+func (s *Service) ListStructures(ctx context.Context, enterpriseID string) ([]*Structure, error) {
+	if enterpriseID == "" {
+		return nil, fmt.Errorf("enterprise ID is required")
+	}
+
+	listStructuresResponse, err := s.service.Enterprises.Structures.List("enterprises/" + enterpriseID).Context(ctx).Do()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list structures: %w", err)
+	}
+
+	return listStructuresResponse.Structures, nil
+}
+
+// ListCameras returns all camera devices in the enterprise
+func (s *Service) ListCameras(ctx context.Context, enterpriseID string) ([]*Device, error) {
+	devices, err := s.ListDevices(ctx, enterpriseID)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(devices) == 0 {
 		return nil, fmt.Errorf("no devices found")
 	}
 
-	for _, device := range listDeviceResponse.Devices {
-		if device.Type == "sdm.devices.types.CAMERA" {
-			return device, nil
+	var cameras []*Device
+	for _, device := range devices {
+		if device.Type == cameraDeviceType {
+			cameras = append(cameras, device)
 		}
 	}
 
-	return nil, fmt.Errorf("no camera found in device list")
+	if len(cameras) == 0 {
+		return nil, fmt.Errorf("no camera found in device list")
+	}
+
+	return cameras, nil
+}
+
+// FindCamera searches for a camera device in the enterprise and returns
+// the first one found
+func (s *Service) FindCamera(ctx context.Context, enterpriseID string) (*Device, error) {
+	cameras, err := s.ListCameras(ctx, enterpriseID)
+	if err != nil {
+		return nil, err
+	}
+	return cameras[0], nil
 }
 
-// GenerateWebRTCStream sends the WebRTC offer to the camera and returns
-// the answer SDP for establishing the connection
-func (s *Service) GenerateWebRTCStream(camera *smartdevicemanagement.GoogleHomeEnterpriseSdmV1Device, offerSDP string) (string, error) {
-	cmdParams := map[string]interface{}{
-		"offerSdp": offerSDP,
+// SelectCameras returns the cameras in the enterprise matching any of the
+// selectors (see MatchesCamera), ordered by the first selector that matched.
+// Every selector must match at least one camera.
+func (s *Service) SelectCameras(ctx context.Context, enterpriseID string, selectors []string) ([]*Device, error) {
+	cameras, err := s.ListCameras(ctx, enterpriseID)
+	if err != nil {
+		return nil, err
+	}
+
+	matched := make(map[string]bool)
+	var selected []*Device
+	for _, selector := range selectors {
+		found := false
+		for _, camera := range cameras {
+			if !MatchesCamera(camera, selector) {
+				continue
+			}
+			found = true
+			if !matched[camera.Name] {
+				matched[camera.Name] = true
+				selected = append(selected, camera)
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("no camera matches %q", selector)
+		}
 	}
-	cmdParamsJSON, err := json.Marshal(cmdParams)
+
+	return selected, nil
+}
+
+// Live stream commands
+const (
+	commandGenerateWebRtcStream = "sdm.devices.commands.CameraLiveStream.GenerateWebRtcStream"
+	commandExtendWebRtcStream   = "sdm.devices.commands.CameraLiveStream.ExtendWebRtcStream"
+	commandStopWebRtcStream     = "sdm.devices.commands.CameraLiveStream.StopWebRtcStream"
+	commandGenerateRtspStream   = "sdm.devices.commands.CameraLiveStream.GenerateRtspStream"
+	commandExtendRtspStream     = "sdm.devices.commands.CameraLiveStream.ExtendRtspStream"
+	commandStopRtspStream       = "sdm.devices.commands.CameraLiveStream.StopRtspStream"
+)
+
+// StreamSession is a live stream started on a camera. It expires at
+// ExpiresAt unless it is extended.
+type StreamSession struct {
+	// AnswerSDP is the camera's answer to the WebRTC offer
+	AnswerSDP string
+	// MediaSessionID identifies the stream when extending or stopping it
+	MediaSessionID string
+	ExpiresAt      time.Time
+}
+
+// streamResults holds the fields of the live stream command results
+type streamResults struct {
+	AnswerSdp      string    `json:"answerSdp"`
+	MediaSessionID string    `json:"mediaSessionId"`
+	ExpiresAt      time.Time `json:"expiresAt"`
+}
+
+// executeCommand executes the command on the device, decoding its results
+// into results if it isn't nil
+func (s *Service) executeCommand(ctx context.Context, device *Device, command string, params, results any) error {
+	paramsJSON, err := json.Marshal(params)
 	if err != nil {
-		return "", fmt.Errorf("failed to marshal command parameters: %w", err)
+		return fmt.Errorf("failed to marshal command parameters: %w", err)
 	}
 
-	command := &smartdevicemanagement.GoogleHomeEnterpriseSdmV1ExecuteDeviceCommandRequest{
-		Command: "sdm.devices.commands.CameraLiveStream.GenerateWebRtcStream",
-		Params:  cmdParamsJSON,
+	request := &smartdevicemanagement.GoogleHomeEnterpriseSdmV1ExecuteDeviceCommandRequest{
+		Command: command,
+		Params:  paramsJSON,
 	}
 
-	cmdResponse, err := s.service.Enterprises.Devices.ExecuteCommand(camera.Name, command).Do()
+	commandName := command[strings.LastIndex(command, ".")+1:]
+	response, err := s.service.Enterprises.Devices.ExecuteCommand(device.Name, request).Context(ctx).Do()
 	if err != nil {
-		return "", fmt.Errorf("failed to execute GenerateWebRtcStream command: %w", err)
+		return fmt.Errorf("failed to execute %s command: %w", commandName, err)
 	}
 
-	var response struct {
-		AnswerSdp string `json:"answerSdp"`
+	if results != nil {
+		if err := json.Unmarshal(response.Results, results); err != nil {
+			return fmt.Errorf("failed to parse %s response: %w", commandName, err)
+		}
 	}
-	if err := json.Unmarshal(cmdResponse.Results, &response); err != nil {
-		return "", fmt.Errorf("failed to parse command response: %w", err)
+	return nil
+}
+
+// GenerateWebRTCStream sends the WebRTC offer to the camera and returns the
+// stream session, including the answer SDP for establishing the connection.
+// Stop the session with StopWebRTCStream when done.
+func (s *Service) GenerateWebRTCStream(ctx context.Context, camera *Device, offerSDP string) (*StreamSession, error) {
+	var results streamResults
+	params := map[string]string{"offerSdp": offerSDP}
+	if err := s.executeCommand(ctx, camera, commandGenerateWebRtcStream, params, &results); err != nil {
+		return nil, err
 	}
 
-	if response.AnswerSdp == "" {
-		return "", fmt.Errorf("failed to get answer SDP: empty response")
+	if results.AnswerSdp == "" {
+		return nil, fmt.Errorf("failed to get answer SDP: empty response")
 	}
 
-	return response.AnswerSdp, nil
+	return &StreamSession{
+		AnswerSDP:      results.AnswerSdp,
+		MediaSessionID: results.MediaSessionID,
+		ExpiresAt:      results.ExpiresAt,
+	}, nil
+}
+
+// ExtendWebRTCStream extends the stream session before it expires, updating
+// its expiry time and media session ID. The session is left unchanged if the
+// response has no expiry time.
+func (s *Service) ExtendWebRTCStream(ctx context.Context, camera *Device, session *StreamSession) error {
+	var results streamResults
+	params := map[string]string{"mediaSessionId": session.MediaSessionID}
+	if err := s.executeCommand(ctx, camera, commandExtendWebRtcStream, params, &results); err != nil {
+		return err
+	}
+
+	if results.ExpiresAt.IsZero() {
+		return fmt.Errorf("failed to extend stream: no expiry time in response")
+	}
+
+	if results.MediaSessionID != "" {
+		session.MediaSessionID = results.MediaSessionID
+	}
+	session.ExpiresAt = results.ExpiresAt
+	return nil
+}
+
+// StopWebRTCStream stops the stream session
+func (s *Service) StopWebRTCStream(ctx context.Context, camera *Device, session *StreamSession) error {
+	params := map[string]string{"mediaSessionId": session.MediaSessionID}
+	return s.executeCommand(ctx, camera, commandStopWebRtcStream, params, nil)
+}
+
+// RTSPSession is an RTSP live stream started on a camera. It expires at
+// ExpiresAt unless it is extended.
+type RTSPSession struct {
+	// URL is the RTSP URL to stream from, including the stream token
+	URL string
+	// StreamToken authorizes access to the stream
+	StreamToken string
+	// ExtensionToken identifies the stream when extending or stopping it
+	ExtensionToken string
+	ExpiresAt      time.Time
+}
+
+// rtspResults holds the fields of the RTSP stream command results
+type rtspResults struct {
+	StreamURLs struct {
+		RTSPURL string `json:"rtspUrl"`
+	} `json:"streamUrls"`
+	StreamToken          string    `json:"streamToken"`
+	StreamExtensionToken string    `json:"streamExtensionToken"`
+	ExpiresAt            time.Time `json:"expiresAt"`
+}
+
+// GenerateRTSPStream starts an RTSP stream on the camera and returns the
+// stream session. Stop the session with StopRTSPStream when done.
+func (s *Service) GenerateRTSPStream(ctx context.Context, camera *Device) (*RTSPSession, error) {
+	var results rtspResults
+	if err := s.executeCommand(ctx, camera, commandGenerateRtspStream, struct{}{}, &results); err != nil {
+		return nil, err
+	}
+
+	if results.StreamURLs.RTSPURL == "" {
+		return nil, fmt.Errorf("failed to get RTSP URL: empty response")
+	}
+
+	return &RTSPSession{
+		URL:            results.StreamURLs.RTSPURL,
+		StreamToken:    results.StreamToken,
+		ExtensionToken: results.StreamExtensionToken,
+		ExpiresAt:      results.ExpiresAt,
+	}, nil
+}
+
+// ExtendRTSPStream extends the stream session before it expires, updating
+// its tokens and expiry time. The URL is updated to use the new stream token.
+// The session is left unchanged if the response has no expiry time.
+func (s *Service) ExtendRTSPStream(ctx context.Context, camera *Device, session *RTSPSession) error {
+	var results rtspResults
+	params := map[string]string{"streamExtensionToken": session.ExtensionToken}
+	if err := s.executeCommand(ctx, camera, commandExtendRtspStream, params, &results); err != nil {
+		return err
+	}
+
+	if results.ExpiresAt.IsZero() {
+		return fmt.Errorf("failed to extend stream: no expiry time in response")
+	}
+
+	if results.StreamToken != "" {
+		streamURL, err := withStreamToken(session.URL, results.StreamToken)
+		if err != nil {
+			return err
+		}
+		session.URL = streamURL
+		session.StreamToken = results.StreamToken
+	}
+	if results.StreamExtensionToken != "" {
+		session.ExtensionToken = results.StreamExtensionToken
+	}
+	session.ExpiresAt = results.ExpiresAt
+	return nil
+}
+
+// withStreamToken returns the RTSP URL with its auth query set to the stream
+// token
+func withStreamToken(streamURL, streamToken string) (string, error) {
+	u, err := url.Parse(streamURL)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse RTSP URL: %w", err)
+	}
+	query := u.Query()
+	query.Set("auth", streamToken)
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
+
+// StopRTSPStream stops the stream session
+func (s *Service) StopRTSPStream(ctx context.Context, camera *Device, session *RTSPSession) error {
+	params := map[string]string{"streamExtensionToken": session.ExtensionToken}
+	return s.executeCommand(ctx, camera, commandStopRtspStream, params, nil)
 }
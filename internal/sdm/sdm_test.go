@@ -0,0 +1,341 @@
+package sdm_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/sigh/nest-timelapse/internal/sdm"
+	"github.com/sigh/nest-timelapse/internal/sdm/sdmtest"
+	"golang.org/x/oauth2"
+	"google.golang.org/api/googleapi"
+)
+
+const enterpriseID = "test-enterprise"
+
+// newTestService returns a service talking to a new fake server
+func newTestService(t *testing.T) (*sdm.Service, *sdmtest.Server) {
+	t.Helper()
+	server := sdmtest.NewServer(enterpriseID)
+	t.Cleanup(server.Close)
+
+	tokenSource := oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "test-token"})
+	service, err := sdm.NewService(context.Background(), tokenSource, sdm.Options{Endpoint: server.Endpoint()})
+	if err != nil {
+		t.Fatalf("NewService() error = %v", err)
+	}
+	return service, server
+}
+
+func TestServiceListing(t *testing.T) {
+	ctx := context.Background()
+	service, server := newTestService(t)
+	server.AddStructure("home", "Home")
+	server.AddCamera("cam-1", "Garden", "home", sdm.ProtocolWebRTC)
+	server.AddCamera("cam-2", "Porch", "home", sdm.ProtocolRTSP)
+	server.AddCamera("cam-3", "Attic", "home")
+	server.AddDevice(&sdm.Device{
+		Name: server.DeviceName("thermostat"),
+		Type: "sdm.devices.types.THERMOSTAT",
+	})
+
+	structures, err := service.ListStructures(ctx, enterpriseID)
+	if err != nil {
+		t.Fatalf("ListStructures() error = %v", err)
+	}
+	if len(structures) != 1 || sdm.StructureName(structures[0]) != "Home" {
+		t.Errorf("ListStructures() = %v, want the Home structure", structures)
+	}
+
+	devices, err := service.ListDevices(ctx, enterpriseID)
+	if err != nil {
+		t.Fatalf("ListDevices() error = %v", err)
+	}
+	if len(devices) != 4 {
+		t.Errorf("ListDevices() returned %d devices, want 4", len(devices))
+	}
+
+	cameras, err := service.ListCameras(ctx, enterpriseID)
+	if err != nil {
+		t.Fatalf("ListCameras() error = %v", err)
+	}
+	if len(cameras) != 3 {
+		t.Fatalf("ListCameras() returned %d cameras, want 3", len(cameras))
+	}
+	for i, want := range []string{sdm.ProtocolWebRTC, sdm.ProtocolRTSP, ""} {
+		if got := sdm.StreamProtocol(cameras[i]); got != want {
+			t.Errorf("StreamProtocol(%s) = %q, want %q", sdm.DeviceID(cameras[i]), got, want)
+		}
+		if got := sdm.CanCapture(cameras[i]); got != (want != "") {
+			t.Errorf("CanCapture(%s) = %v, want %v", sdm.DeviceID(cameras[i]), got, want != "")
+		}
+	}
+	if got := sdm.StructureID(cameras[0]); got != "home" {
+		t.Errorf("StructureID() = %q, want %q", got, "home")
+	}
+
+	selected, err := service.SelectCameras(ctx, enterpriseID, []string{"porch", "cam-1"})
+	if err != nil {
+		t.Fatalf("SelectCameras() error = %v", err)
+	}
+	if len(selected) != 2 || sdm.DeviceID(selected[0]) != "cam-2" || sdm.DeviceID(selected[1]) != "cam-1" {
+		t.Errorf("SelectCameras() = %v, want cam-2 then cam-1", selected)
+	}
+	if _, err := service.SelectCameras(ctx, enterpriseID, []string{"cellar"}); err == nil {
+		t.Error("SelectCameras() with unknown camera succeeded, want error")
+	}
+}
+
+func TestWebRTCStreamSession(t *testing.T) {
+	ctx := context.Background()
+	service, server := newTestService(t)
+	camera := server.AddCamera("cam-1", "Garden", "", sdm.ProtocolWebRTC)
+
+	now := time.Date(2024, 3, 20, 14, 30, 0, 0, time.UTC)
+	server.SetClock(func() time.Time { return now })
+
+	var gotOffer string
+	server.SetAnswer(func(device *sdm.Device, offerSDP string) (string, error) {
+		gotOffer = offerSDP
+		return "v=0 answer", nil
+	})
+
+	session, err := service.GenerateWebRTCStream(ctx, camera, "v=0 offer")
+	if err != nil {
+		t.Fatalf("GenerateWebRTCStream() error = %v", err)
+	}
+	if session.AnswerSDP != "v=0 answer" {
+		t.Errorf("AnswerSDP = %q, want %q", session.AnswerSDP, "v=0 answer")
+	}
+	if gotOffer != "v=0 offer" {
+		t.Errorf("server received offer %q, want %q", gotOffer, "v=0 offer")
+	}
+	if session.MediaSessionID == "" {
+		t.Error("MediaSessionID is empty")
+	}
+	if want := now.Add(5 * time.Minute); !session.ExpiresAt.Equal(want) {
+		t.Errorf("ExpiresAt = %v, want %v", session.ExpiresAt, want)
+	}
+
+	now = now.Add(4 * time.Minute)
+	if err := service.ExtendWebRTCStream(ctx, camera, session); err != nil {
+		t.Fatalf("ExtendWebRTCStream() error = %v", err)
+	}
+	if want := now.Add(5 * time.Minute); !session.ExpiresAt.Equal(want) {
+		t.Errorf("ExpiresAt after extending = %v, want %v", session.ExpiresAt, want)
+	}
+
+	if err := service.StopWebRTCStream(ctx, camera, session); err != nil {
+		t.Fatalf("StopWebRTCStream() error = %v", err)
+	}
+	sessions := server.Sessions()
+	if len(sessions) != 1 || sessions[0].Extensions != 1 || !sessions[0].Stopped {
+		t.Errorf("Sessions() = %+v, want one stopped session extended once", sessions)
+	}
+
+	// A stopped session can't be extended
+	if err := service.ExtendWebRTCStream(ctx, camera, session); err == nil {
+		t.Error("ExtendWebRTCStream() of stopped session succeeded, want error")
+	}
+}
+
+func TestRTSPStreamSession(t *testing.T) {
+	ctx := context.Background()
+	service, server := newTestService(t)
+	camera := server.AddCamera("cam-1", "Porch", "", sdm.ProtocolRTSP)
+	server.SetRTSPURL("rtsps://nest.example.com/camera")
+
+	session, err := service.GenerateRTSPStream(ctx, camera)
+	if err != nil {
+		t.Fatalf("GenerateRTSPStream() error = %v", err)
+	}
+	if want := "rtsps://nest.example.com/camera?auth=" + session.StreamToken; session.URL != want {
+		t.Errorf("URL = %q, want %q", session.URL, want)
+	}
+	if session.StreamToken == "" || session.ExtensionToken == "" {
+		t.Errorf("session = %+v, want stream and extension tokens", session)
+	}
+
+	oldToken, oldURL := session.ExtensionToken, session.URL
+	if err := service.ExtendRTSPStream(ctx, camera, session); err != nil {
+		t.Fatalf("ExtendRTSPStream() error = %v", err)
+	}
+	if session.ExtensionToken == oldToken {
+		t.Error("ExtendRTSPStream() didn't update the extension token")
+	}
+	if session.URL == oldURL {
+		t.Error("ExtendRTSPStream() didn't update the URL")
+	}
+	if want := "rtsps://nest.example.com/camera?auth=" + session.StreamToken; session.URL != want {
+		t.Errorf("URL after extension = %q, want %q", session.URL, want)
+	}
+
+	if err := service.StopRTSPStream(ctx, camera, session); err != nil {
+		t.Fatalf("StopRTSPStream() error = %v", err)
+	}
+	sessions := server.Sessions()
+	if len(sessions) != 1 || sessions[0].Protocol != sdm.ProtocolRTSP || sessions[0].Extensions != 1 || !sessions[0].Stopped {
+		t.Errorf("Sessions() = %+v, want one stopped RTSP session extended once", sessions)
+	}
+}
+
+func TestExtendStreamWithoutExpiry(t *testing.T) {
+	ctx := context.Background()
+	service, server := newTestService(t)
+	webrtcCamera := server.AddCamera("cam-1", "Garden", "", sdm.ProtocolWebRTC)
+	rtspCamera := server.AddCamera("cam-2", "Porch", "", sdm.ProtocolRTSP)
+
+	webrtcSession, err := service.GenerateWebRTCStream(ctx, webrtcCamera, "v=0 offer")
+	if err != nil {
+		t.Fatalf("GenerateWebRTCStream() error = %v", err)
+	}
+	rtspSession, err := service.GenerateRTSPStream(ctx, rtspCamera)
+	if err != nil {
+		t.Fatalf("GenerateRTSPStream() error = %v", err)
+	}
+
+	server.SetOmitExpiry(true)
+	webrtcBefore, rtspBefore := *webrtcSession, *rtspSession
+	if err := service.ExtendWebRTCStream(ctx, webrtcCamera, webrtcSession); err == nil {
+		t.Error("ExtendWebRTCStream() without an expiry succeeded, want error")
+	}
+	if *webrtcSession != webrtcBefore {
+		t.Errorf("session = %+v, want it unchanged from %+v", *webrtcSession, webrtcBefore)
+	}
+	if err := service.ExtendRTSPStream(ctx, rtspCamera, rtspSession); err == nil {
+		t.Error("ExtendRTSPStream() without an expiry succeeded, want error")
+	}
+	if *rtspSession != rtspBefore {
+		t.Errorf("session = %+v, want it unchanged from %+v", *rtspSession, rtspBefore)
+	}
+}
+
+func TestExtendExpiredWebRTCStream(t *testing.T) {
+	ctx := context.Background()
+	service, server := newTestService(t)
+	camera := server.AddCamera("cam-1", "Garden", "", sdm.ProtocolWebRTC)
+
+	now := time.Now()
+	server.SetClock(func() time.Time { return now })
+	session, err := service.GenerateWebRTCStream(ctx, camera, "v=0 offer")
+	if err != nil {
+		t.Fatalf("GenerateWebRTCStream() error = %v", err)
+	}
+
+	now = session.ExpiresAt.Add(time.Second)
+	err = service.ExtendWebRTCStream(ctx, camera, session)
+	var apiErr *googleapi.Error
+	if !errors.As(err, &apiErr) || apiErr.Code != http.StatusBadRequest {
+		t.Errorf("ExtendWebRTCStream() of expired session error = %v, want %d", err, http.StatusBadRequest)
+	}
+}
+
+func TestServiceErrors(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name     string
+		method   string
+		err      *sdmtest.Error
+		call     func(*sdm.Service, *sdm.Device) error
+		wantCode int
+	}{
+		{
+			name:   "list devices quota",
+			method: sdmtest.MethodListDevices,
+			err:    sdmtest.QuotaExceeded(),
+			call: func(s *sdm.Service, _ *sdm.Device) error {
+				_, err := s.ListDevices(ctx, enterpriseID)
+				return err
+			},
+			wantCode: http.StatusTooManyRequests,
+		},
+		{
+			name:   "list structures permission denied",
+			method: sdmtest.MethodListStructures,
+			err:    &sdmtest.Error{Code: http.StatusForbidden, Message: "The caller does not have permission", Status: "PERMISSION_DENIED"},
+			call: func(s *sdm.Service, _ *sdm.Device) error {
+				_, err := s.ListStructures(ctx, enterpriseID)
+				return err
+			},
+			wantCode: http.StatusForbidden,
+		},
+		{
+			name:   "generate stream quota",
+			method: sdmtest.CommandGenerateWebRtcStream,
+			err:    sdmtest.QuotaExceeded(),
+			call: func(s *sdm.Service, camera *sdm.Device) error {
+				_, err := s.GenerateWebRTCStream(ctx, camera, "v=0 offer")
+				return err
+			},
+			wantCode: http.StatusTooManyRequests,
+		},
+		{
+			name:   "extend stream quota",
+			method: sdmtest.CommandExtendWebRtcStream,
+			err:    sdmtest.QuotaExceeded(),
+			call: func(s *sdm.Service, camera *sdm.Device) error {
+				session, err := s.GenerateWebRTCStream(ctx, camera, "v=0 offer")
+				if err != nil {
+					return err
+				}
+				return s.ExtendWebRTCStream(ctx, camera, session)
+			},
+			wantCode: http.StatusTooManyRequests,
+		},
+		{
+			name: "generate stream for missing device",
+			call: func(s *sdm.Service, _ *sdm.Device) error {
+				missing := &sdm.Device{Name: "enterprises/" + enterpriseID + "/devices/missing"}
+				_, err := s.GenerateWebRTCStream(ctx, missing, "v=0 offer")
+				return err
+			},
+			wantCode: http.StatusNotFound,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			service, server := newTestService(t)
+			camera := server.AddCamera("cam-1", "Garden", "", sdm.ProtocolWebRTC)
+			if tt.err != nil {
+				server.FailNext(tt.method, tt.err)
+			}
+
+			err := tt.call(service, camera)
+			var apiErr *googleapi.Error
+			if !errors.As(err, &apiErr) {
+				t.Fatalf("error = %v, want a *googleapi.Error", err)
+			}
+			if apiErr.Code != tt.wantCode {
+				t.Errorf("error code = %d, want %d", apiErr.Code, tt.wantCode)
+			}
+			if tt.err != nil && apiErr.Message != tt.err.Message {
+				t.Errorf("error message = %q, want %q", apiErr.Message, tt.err.Message)
+			}
+
+			// Failures only apply to the next call
+			if tt.err != nil {
+				if err := tt.call(service, camera); err != nil {
+					t.Errorf("second call error = %v, want success", err)
+				}
+			}
+		})
+	}
+}
+
+func TestNewServiceRequiresAuthentication(t *testing.T) {
+	server := sdmtest.NewServer(enterpriseID)
+	defer server.Close()
+
+	tokenSource := oauth2.StaticTokenSource(&oauth2.Token{})
+	service, err := sdm.NewService(context.Background(), tokenSource, sdm.Options{Endpoint: server.Endpoint()})
+	if err != nil {
+		t.Fatalf("NewService() error = %v", err)
+	}
+	if _, err := service.ListDevices(context.Background(), enterpriseID); err == nil {
+		t.Error("ListDevices() without a token succeeded, want error")
+	}
+}
@@ -0,0 +1,464 @@
+// Package sdmtest provides an in-process fake of the Smart Device Management
+// API for tests. It implements listing devices and structures, and the
+// CameraLiveStream commands for WebRTC and RTSP streams.
+package sdmtest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sigh/nest-timelapse/internal/sdm"
+	"google.golang.org/api/smartdevicemanagement/v1"
+)
+
+// Commands implemented by the fake server
+const (
+	CommandGenerateWebRtcStream = "sdm.devices.commands.CameraLiveStream.GenerateWebRtcStream"
+	CommandExtendWebRtcStream   = "sdm.devices.commands.CameraLiveStream.ExtendWebRtcStream"
+	CommandStopWebRtcStream     = "sdm.devices.commands.CameraLiveStream.StopWebRtcStream"
+	CommandGenerateRtspStream   = "sdm.devices.commands.CameraLiveStream.GenerateRtspStream"
+	CommandExtendRtspStream     = "sdm.devices.commands.CameraLiveStream.ExtendRtspStream"
+	CommandStopRtspStream       = "sdm.devices.commands.CameraLiveStream.StopRtspStream"
+)
+
+// Methods that can be made to fail with Server.FailNext, along with the
+// command names above
+const (
+	MethodListDevices    = "devices.list"
+	MethodListStructures = "structures.list"
+)
+
+// streamDuration is how long a stream session lasts before it must be extended
+const streamDuration = 5 * time.Minute
+
+// Error is an error response from the API
+type Error struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+	Status  string `json:"status"`
+}
+
+// QuotaExceeded returns the error the API responds with when the rate limit
+// has been exceeded
+func QuotaExceeded() *Error {
+	return &Error{
+		Code:    http.StatusTooManyRequests,
+		Message: "Rate limited for the command.",
+		Status:  "RESOURCE_EXHAUSTED",
+	}
+}
+
+// Session is a stream session started with GenerateWebRtcStream or
+// GenerateRtspStream
+type Session struct {
+	Device string
+	// Protocol is sdm.ProtocolWebRTC or sdm.ProtocolRTSP
+	Protocol string
+	// MediaSessionID identifies WebRTC sessions
+	MediaSessionID string
+	// ExtensionToken identifies RTSP sessions. It changes when the session is
+	// extended.
+	ExtensionToken string
+	ExpiresAt      time.Time
+	Extensions     int
+	Stopped        bool
+}
+
+// AnswerFunc returns the answer SDP for an offer sent to the device
+type AnswerFunc func(device *sdm.Device, offerSDP string) (string, error)
+
+// Server is a fake SDM API server. Its methods are safe for concurrent use.
+type Server struct {
+	*httptest.Server
+
+	mu           sync.Mutex
+	enterpriseID string
+	devices      []*sdm.Device
+	structures   []*sdm.Structure
+	answer       AnswerFunc
+	rtspURL      string
+	failures     map[string][]*Error
+	sessions     []*Session
+	nextID       int
+	now          func() time.Time
+	// omitExpiry leaves expiresAt out of the results of extension commands
+	omitExpiry bool
+}
+
+// NewServer starts a fake server for the enterprise. Close it when done.
+func NewServer(enterpriseID string) *Server {
+	s := &Server{
+		enterpriseID: enterpriseID,
+		failures:     make(map[string][]*Error),
+		now:          time.Now,
+		answer: func(device *sdm.Device, offerSDP string) (string, error) {
+			return "answer for " + device.Name, nil
+		},
+		rtspURL: "rtsps://stream.example.com/camera",
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+// Endpoint returns the endpoint to pass in sdm.Options
+func (s *Server) Endpoint() string {
+	return s.URL + "/"
+}
+
+// DeviceName returns the full resource name of a device in the enterprise
+func (s *Server) DeviceName(deviceID string) string {
+	return "enterprises/" + s.enterpriseID + "/devices/" + deviceID
+}
+
+// AddStructure adds a structure with the custom name
+func (s *Server) AddStructure(structureID, customName string) *sdm.Structure {
+	traits, _ := json.Marshal(map[string]any{
+		"sdm.structures.traits.Info": map[string]string{"customName": customName},
+	})
+	structure := &sdm.Structure{
+		Name:   "enterprises/" + s.enterpriseID + "/structures/" + structureID,
+		Traits: traits,
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.structures = append(s.structures, structure)
+	return structure
+}
+
+// AddCamera adds a camera in the structure that supports the live stream
+// protocols. The custom name and structure ID may be empty.
+func (s *Server) AddCamera(deviceID, customName, structureID string, protocols ...string) *sdm.Device {
+	traits, _ := json.Marshal(map[string]any{
+		"sdm.devices.traits.Info": map[string]string{"customName": customName},
+		"sdm.devices.traits.CameraLiveStream": sdm.CameraLiveStream{
+			MaxVideoResolution: sdm.Resolution{Width: 640, Height: 480},
+			VideoCodecs:        []string{"H264"},
+			AudioCodecs:        []string{"OPUS"},
+			SupportedProtocols: protocols,
+		},
+	})
+	device := &sdm.Device{
+		Name:   s.DeviceName(deviceID),
+		Type:   "sdm.devices.types.CAMERA",
+		Traits: traits,
+	}
+	if structureID != "" {
+		device.ParentRelations = []*smartdevicemanagement.GoogleHomeEnterpriseSdmV1ParentRelation{{
+			Parent: "enterprises/" + s.enterpriseID + "/structures/" + structureID,
+		}}
+	}
+	s.AddDevice(device)
+	return device
+}
+
+// AddDevice adds a device to the enterprise
+func (s *Server) AddDevice(device *sdm.Device) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.devices = append(s.devices, device)
+}
+
+// SetAnswer sets the function that answers WebRTC offers. By default a fixed
+// string is returned, which isn't a valid SDP.
+func (s *Server) SetAnswer(answer AnswerFunc) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.answer = answer
+}
+
+// SetRTSPURL sets the URL returned for RTSP streams, before the stream token
+// is added
+func (s *Server) SetRTSPURL(url string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rtspURL = url
+}
+
+// SetClock sets the function used to get the current time for session expiry
+func (s *Server) SetClock(now func() time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.now = now
+}
+
+// SetOmitExpiry makes extension commands leave the new expiry time out of
+// their results, as a malformed response would
+func (s *Server) SetOmitExpiry(omit bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.omitExpiry = omit
+}
+
+// FailNext makes the next call to the method or command fail with the error.
+// Calling it repeatedly queues up several failures.
+func (s *Server) FailNext(method string, err *Error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures[method] = append(s.failures[method], err)
+}
+
+// Sessions returns a copy of the stream sessions started so far
+func (s *Server) Sessions() []Session {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sessions := make([]Session, len(s.sessions))
+	for i, session := range s.sessions {
+		sessions[i] = *session
+	}
+	return sessions
+}
+
+// takeFailure returns the next queued failure for the method, if any
+func (s *Server) takeFailure(method string) *Error {
+	queued := s.failures[method]
+	if len(queued) == 0 {
+		return nil
+	}
+	s.failures[method] = queued[1:]
+	return queued[0]
+}
+
+// writeJSON writes a successful JSON response
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeError writes an error response in the API's format
+func writeError(w http.ResponseWriter, err *Error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(err.Code)
+	json.NewEncoder(w).Encode(map[string]*Error{"error": err})
+}
+
+// serveHTTP routes requests to the API methods
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); !ok || token == "" {
+		writeError(w, &Error{
+			Code:    http.StatusUnauthorized,
+			Message: "Request is missing required authentication credential.",
+			Status:  "UNAUTHENTICATED",
+		})
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	enterprise := "/v1/enterprises/" + s.enterpriseID
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == enterprise+"/devices":
+		s.listDevices(w)
+	case r.Method == http.MethodGet && r.URL.Path == enterprise+"/structures":
+		s.listStructures(w)
+	case r.Method == http.MethodPost && strings.HasPrefix(r.URL.Path, enterprise+"/devices/") &&
+		strings.HasSuffix(r.URL.Path, ":executeCommand"):
+		name := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/v1/"), ":executeCommand")
+		s.executeCommand(w, r, name)
+	default:
+		writeError(w, &Error{
+			Code:    http.StatusNotFound,
+			Message: fmt.Sprintf("Requested entity was not found: %s %s", r.Method, r.URL.Path),
+			Status:  "NOT_FOUND",
+		})
+	}
+}
+
+// listDevices implements enterprises.devices.list
+func (s *Server) listDevices(w http.ResponseWriter) {
+	if err := s.takeFailure(MethodListDevices); err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, &smartdevicemanagement.GoogleHomeEnterpriseSdmV1ListDevicesResponse{Devices: s.devices})
+}
+
+// listStructures implements enterprises.structures.list
+func (s *Server) listStructures(w http.ResponseWriter) {
+	if err := s.takeFailure(MethodListStructures); err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, &smartdevicemanagement.GoogleHomeEnterpriseSdmV1ListStructuresResponse{Structures: s.structures})
+}
+
+// findDevice returns the device with the resource name
+func (s *Server) findDevice(name string) *sdm.Device {
+	for _, device := range s.devices {
+		if device.Name == name {
+			return device
+		}
+	}
+	return nil
+}
+
+// findSession returns the active session of the device with the ID, which is
+// the media session ID for WebRTC and the extension token for RTSP
+func (s *Server) findSession(device, protocol, id string) *Session {
+	for _, session := range s.sessions {
+		sessionID := session.MediaSessionID
+		if protocol == sdm.ProtocolRTSP {
+			sessionID = session.ExtensionToken
+		}
+		if session.Device == device && session.Protocol == protocol && sessionID == id &&
+			!session.Stopped && s.now().Before(session.ExpiresAt) {
+			return session
+		}
+	}
+	return nil
+}
+
+// newID returns a new unique ID with the prefix
+func (s *Server) newID(prefix string) string {
+	s.nextID++
+	return fmt.Sprintf("%s-%d", prefix, s.nextID)
+}
+
+// newSession starts a session on the device
+func (s *Server) newSession(device, protocol string) *Session {
+	session := &Session{
+		Device:    device,
+		Protocol:  protocol,
+		ExpiresAt: s.now().Add(streamDuration).UTC(),
+	}
+	if protocol == sdm.ProtocolWebRTC {
+		session.MediaSessionID = s.newID("session")
+	} else {
+		session.ExtensionToken = s.newID("extension")
+	}
+	s.sessions = append(s.sessions, session)
+	return session
+}
+
+// rtspResults returns the results of an RTSP command for the session
+func (s *Server) rtspResults(session *Session) map[string]any {
+	streamToken := "token-" + session.ExtensionToken
+	return map[string]any{
+		"streamUrls":           map[string]string{"rtspUrl": s.rtspURL + "?auth=" + streamToken},
+		"streamToken":          streamToken,
+		"streamExtensionToken": session.ExtensionToken,
+		"expiresAt":            session.ExpiresAt.Format(time.RFC3339Nano),
+	}
+}
+
+// invalidArgument returns an INVALID_ARGUMENT error with the message
+func invalidArgument(message string) *Error {
+	return &Error{Code: http.StatusBadRequest, Message: message, Status: "INVALID_ARGUMENT"}
+}
+
+// executeCommand implements enterprises.devices.executeCommand
+func (s *Server) executeCommand(w http.ResponseWriter, r *http.Request, name string) {
+	var request smartdevicemanagement.GoogleHomeEnterpriseSdmV1ExecuteDeviceCommandRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeError(w, invalidArgument("Invalid JSON payload received."))
+		return
+	}
+
+	device := s.findDevice(name)
+	if device == nil {
+		writeError(w, &Error{Code: http.StatusNotFound, Message: "Device " + name + " not found.", Status: "NOT_FOUND"})
+		return
+	}
+	if err := s.takeFailure(request.Command); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	var params struct {
+		OfferSdp             string `json:"offerSdp"`
+		MediaSessionID       string `json:"mediaSessionId"`
+		StreamExtensionToken string `json:"streamExtensionToken"`
+	}
+	if len(request.Params) > 0 {
+		if err := json.Unmarshal(request.Params, &params); err != nil {
+			writeError(w, invalidArgument("Invalid command parameters."))
+			return
+		}
+	}
+
+	var results any
+	switch request.Command {
+	case CommandGenerateWebRtcStream:
+		if params.OfferSdp == "" {
+			writeError(w, invalidArgument("Offer SDP is required."))
+			return
+		}
+		answer, err := s.answer(device, params.OfferSdp)
+		if err != nil {
+			writeError(w, invalidArgument(err.Error()))
+			return
+		}
+		session := s.newSession(name, sdm.ProtocolWebRTC)
+		results = map[string]string{
+			"answerSdp":      answer,
+			"mediaSessionId": session.MediaSessionID,
+			"expiresAt":      session.ExpiresAt.Format(time.RFC3339Nano),
+		}
+
+	case CommandExtendWebRtcStream:
+		session := s.findSession(name, sdm.ProtocolWebRTC, params.MediaSessionID)
+		if session == nil {
+			writeError(w, invalidArgument("Media session not found or expired."))
+			return
+		}
+		session.Extensions++
+		session.ExpiresAt = s.now().Add(streamDuration).UTC()
+		extended := map[string]string{
+			"mediaSessionId": session.MediaSessionID,
+			"expiresAt":      session.ExpiresAt.Format(time.RFC3339Nano),
+		}
+		if s.omitExpiry {
+			delete(extended, "expiresAt")
+		}
+		results = extended
+
+	case CommandStopWebRtcStream:
+		session := s.findSession(name, sdm.ProtocolWebRTC, params.MediaSessionID)
+		if session == nil {
+			writeError(w, invalidArgument("Media session not found or expired."))
+			return
+		}
+		session.Stopped = true
+		results = map[string]string{}
+
+	case CommandGenerateRtspStream:
+		results = s.rtspResults(s.newSession(name, sdm.ProtocolRTSP))
+
+	case CommandExtendRtspStream:
+		session := s.findSession(name, sdm.ProtocolRTSP, params.StreamExtensionToken)
+		if session == nil {
+			writeError(w, invalidArgument("Stream extension token not found or expired."))
+			return
+		}
+		session.Extensions++
+		session.ExtensionToken = s.newID("extension")
+		session.ExpiresAt = s.now().Add(streamDuration).UTC()
+		extended := s.rtspResults(session)
+		if s.omitExpiry {
+			delete(extended, "expiresAt")
+		}
+		results = extended
+
+	case CommandStopRtspStream:
+		session := s.findSession(name, sdm.ProtocolRTSP, params.StreamExtensionToken)
+		if session == nil {
+			writeError(w, invalidArgument("Stream extension token not found or expired."))
+			return
+		}
+		session.Stopped = true
+		results = map[string]string{}
+
+	default:
+		writeError(w, invalidArgument("Command not supported."))
+		return
+	}
+
+	resultsJSON, _ := json.Marshal(results)
+	writeJSON(w, &smartdevicemanagement.GoogleHomeEnterpriseSdmV1ExecuteDeviceCommandResponse{Results: resultsJSON})
+}
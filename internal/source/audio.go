@@ -0,0 +1,22 @@
+package source
+
+import (
+	"time"
+)
+
+// AudioOptions configures recording the camera's audio alongside frames.
+// Audio is only recorded from Nest cameras that stream over WebRTC.
+type AudioOptions struct {
+	// Record saves the audio as an Ogg Opus file next to the frame
+	Record bool
+	// Loudness measures how loud the audio is and records it in the frame's
+	// metadata
+	Loudness bool
+	// Duration is how long to record for after the frame is taken
+	Duration time.Duration
+}
+
+// Enabled reports whether audio should be recorded
+func (o AudioOptions) Enabled() bool {
+	return o.Record || o.Loudness
+}
@@ -0,0 +1,75 @@
+package source
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// ClipOptions configures recording video clips alongside frames. Sources that
+// only take still images, such as HTTP snapshots, don't record clips.
+type ClipOptions struct {
+	// Format is the container format of the clip, video.ClipFormatMP4 or
+	// video.ClipFormatMKV. Clips are only recorded if it is set.
+	Format string
+	// Duration is how long to record for after the frame is taken
+	Duration time.Duration
+	// Audio records the camera's audio in the clip as well as its video
+	Audio bool
+}
+
+// Enabled reports whether clips should be recorded
+func (o ClipOptions) Enabled() bool {
+	return o.Format != ""
+}
+
+// tempFile returns the path of a new temporary file with the extension to
+// record into
+func tempFile(extension string) (string, error) {
+	f, err := os.CreateTemp("", "nest_recording_*."+extension)
+	if err != nil {
+		return "", fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	f.Close()
+	return f.Name(), nil
+}
+
+// recordStreamClip records a clip from the stream URL into a temporary file
+// and returns its path. The frame is still worth saving if the clip fails, so
+// failures are only reported and an empty path returned.
+func recordStreamClip(ctx context.Context, opts ClipOptions, streamURL string,
+	record func(ctx context.Context, streamURL string, duration time.Duration, audio bool, clipPath string) error) string {
+	fmt.Printf("Recording a %s clip...\n", opts.Duration)
+	clipPath, err := tempFile(opts.Format)
+	if err == nil {
+		err = record(ctx, streamURL, opts.Duration, opts.Audio, clipPath)
+	}
+	if err != nil {
+		fmt.Printf("Warning: failed to record clip: %v\n", err)
+		os.Remove(clipPath)
+		return ""
+	}
+	return clipPath
+}
+
+// clipWriter writes a recording to the clip file as well as to the decoder,
+// carrying on once the decoder has stopped reading
+type clipWriter struct {
+	clip    io.Writer
+	decoder io.Writer
+	decoded bool
+}
+
+func (w *clipWriter) Write(p []byte) (int, error) {
+	if !w.decoded {
+		if _, err := w.decoder.Write(p); errors.Is(err, errDecoded) {
+			w.decoded = true
+		} else if err != nil {
+			return 0, err
+		}
+	}
+	return w.clip.Write(p)
+}
@@ -0,0 +1,91 @@
+package source
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+
+	"github.com/sigh/nest-timelapse/internal/frames"
+)
+
+// KindDirectory is the kind of source that replays a directory of images
+const KindDirectory = "directory"
+
+// Directory replays the JPEG, PNG and WebP images in a directory, and its subdirectories,
+// in name order. Each image keeps the time in its name if it was saved by
+// capture, or otherwise its modification time.
+type Directory struct {
+	name string
+	dir  string
+
+	mu    sync.Mutex
+	files []string
+}
+
+// NewDirectory returns a source replaying the images in dir
+func NewDirectory(name, dir string) (*Directory, error) {
+	var files []string
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !entry.IsDir() && frames.IsImage(path) {
+			files = append(files, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list images: %w", err)
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no images found in %s", dir)
+	}
+	slices.Sort(files)
+	return &Directory{name: name, dir: dir, files: files}, nil
+}
+
+// Name returns the source's name
+func (d *Directory) Name() string {
+	return d.name
+}
+
+// Capture returns the next image, or ErrExhausted once every image has been
+// replayed
+func (d *Directory) Capture(ctx context.Context) (*Frame, error) {
+	d.mu.Lock()
+	if len(d.files) == 0 {
+		d.mu.Unlock()
+		return nil, ErrExhausted
+	}
+	path := d.files[0]
+	d.files = d.files[1:]
+	d.mu.Unlock()
+
+	image, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read image: %w", err)
+	}
+
+	t, err := frames.ParseFrameTime(path)
+	if err != nil {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read image: %w", err)
+		}
+		t = info.ModTime()
+	}
+
+	return &Frame{
+		Image: image,
+		Time:  t,
+		Metadata: map[string]string{
+			MetadataSource: KindDirectory,
+			MetadataCamera: d.name,
+			MetadataFile:   path,
+		},
+	}, nil
+}
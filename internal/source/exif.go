@@ -0,0 +1,45 @@
+package source
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/sigh/nest-timelapse/internal/exif"
+	"github.com/sigh/nest-timelapse/internal/frames"
+)
+
+// nestMake is recorded as the manufacturer of Nest cameras
+const nestMake = "Google"
+
+// addEXIF embeds EXIF data into the frame's image, recording when it was
+// taken, the camera's name as its model and the frame's metadata as a
+// comment. It is only used for frames decoded from video, which have no EXIF
+// data of their own, and only JPEGs get it. The frame is still worth saving
+// without it, so failures are only reported.
+func (f *Frame) addEXIF(cameraMake string) {
+	if format, _ := frames.DetectFormat(f.Image); format != frames.FormatJPEG {
+		return
+	}
+	image, err := exif.Embed(f.Image, exif.Info{
+		Time:        f.Time,
+		Make:        cameraMake,
+		Model:       f.Metadata[MetadataCamera],
+		UserComment: metadataComment(f.Metadata),
+	})
+	if err != nil {
+		fmt.Printf("Warning: failed to add EXIF data: %v\n", err)
+		return
+	}
+	f.Image = image
+}
+
+// metadataComment formats the metadata as "key=value" pairs, sorted by key
+func metadataComment(metadata map[string]string) string {
+	pairs := make([]string, 0, len(metadata))
+	for key, value := range metadata {
+		pairs = append(pairs, key+"="+value)
+	}
+	slices.Sort(pairs)
+	return strings.Join(pairs, ", ")
+}
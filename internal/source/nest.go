@@ -0,0 +1,714 @@
+package source
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sigh/nest-timelapse/internal/sdm"
+	"github.com/sigh/nest-timelapse/internal/video"
+	"github.com/sigh/nest-timelapse/internal/webrtc"
+)
+
+// Kinds of source, recorded in the frame metadata
+const (
+	KindNestWebRTC = "nest-webrtc"
+	KindNestRTSP   = "nest-rtsp"
+)
+
+// Timeouts and durations for Nest cameras
+const (
+	// recordingDuration is the longest to record video from the camera while
+	// waiting for a keyframe
+	recordingDuration = 5 * time.Second
+	// webRtcTimeout is the maximum time to wait for WebRTC operations
+	webRtcTimeout = 30 * time.Second
+	// defaultFrameTimeout is the default deadline for setting up a stream and
+	// for taking each frame from it
+	defaultFrameTimeout = 90 * time.Second
+	// extendMargin is how long before a stream session expires it is extended
+	extendMargin = 30 * time.Second
+	// keyframeTimeout is the longest to wait for a requested keyframe
+	keyframeTimeout = 10 * time.Second
+	// maxMissedFrames is how many frames in a row can fail before the stream,
+	// or a polled source, is assumed to be broken
+	maxMissedFrames = 3
+	// maxRecordingSize is the most H264 data recorded for a single capture
+	maxRecordingSize = 64 << 20
+)
+
+// errDecoded stops a recording once the decoder has stopped reading it
+var errDecoded = errors.New("decoder stopped reading video")
+
+// NestOptions configures how frames are taken from Nest cameras
+type NestOptions struct {
+	// WebRTC configures the connection to cameras that stream over WebRTC
+	WebRTC webrtc.Options
+	// FrameTimeout bounds setting up a stream and taking each frame from it
+	// when streaming. Defaults to 90 seconds.
+	FrameTimeout time.Duration
+	// Still is the format of stills decoded from video or taken from streams
+	Still video.StillFormat
+	// DecodeH264 decodes the first frame of H264 video into a still. The
+	// video is passed to it while it is still being recorded. Defaults to
+	// Still.DecodeFirstFrame.
+	DecodeH264 func(ctx context.Context, h264Data io.Reader) ([]byte, error)
+	// GrabFrame takes a still from a stream URL. Defaults to
+	// Still.GrabFrame.
+	GrabFrame func(ctx context.Context, streamURL string) ([]byte, error)
+	// SelectFrames, if more than one, decodes that many frames from the start
+	// of each WebRTC capture and keeps the one that makes the best still,
+	// instead of the first. Frames taken while streaming are always the
+	// latest keyframe.
+	SelectFrames int
+	// DecodeBestFrame decodes frames of H264 video and picks the best. The
+	// video is passed to it while it is still being recorded. Defaults to
+	// Still.DecodeBestFrame.
+	DecodeBestFrame func(ctx context.Context, h264Data io.Reader, frames int) (*video.Selection, error)
+	// StackFrames, if more than one, decodes that many frames from the start
+	// of each WebRTC capture and stacks them into a single still with less
+	// noise, using StackMethod. It can't be used with SelectFrames.
+	StackFrames int
+	// StackMethod is how frames are stacked, video.StackMean or
+	// video.StackMedian. Defaults to video.StackMean.
+	StackMethod string
+	// DecodeStackedFrame decodes frames of H264 video and stacks them. The
+	// video is passed to it while it is still being recorded. Defaults to
+	// Still.DecodeStackedFrame.
+	DecodeStackedFrame func(ctx context.Context, h264Data io.Reader, frames int, method string) ([]byte, int, error)
+	// Clip configures recording a clip with each captured frame. Clips aren't
+	// recorded when streaming.
+	Clip ClipOptions
+	// RemuxClip puts video and audio recorded over WebRTC into a clip.
+	// Defaults to video.RemuxClip.
+	RemuxClip func(ctx context.Context, input video.ClipInput, clipPath string) error
+	// RecordClip records a clip from a stream URL. Defaults to
+	// video.RecordClip.
+	RecordClip func(ctx context.Context, streamURL string, duration time.Duration, audio bool, clipPath string) error
+	// Audio configures recording the camera's audio with each captured frame.
+	// Audio isn't recorded when streaming.
+	Audio AudioOptions
+	// MeasureLoudness measures how loud recorded audio is. Defaults to
+	// video.MeasureLoudness.
+	MeasureLoudness func(ctx context.Context, audioPath string) (video.Loudness, error)
+}
+
+// decodedFrames returns how many frames are decoded from each WebRTC capture
+func (o NestOptions) decodedFrames() int {
+	return max(1, o.SelectFrames, o.StackFrames)
+}
+
+// extraRecording returns how long to keep recording after a frame is taken
+// for its clip and audio
+func (o NestOptions) extraRecording() time.Duration {
+	var d time.Duration
+	if o.Clip.Enabled() {
+		d = o.Clip.Duration
+	}
+	if o.Audio.Enabled() {
+		d = max(d, o.Audio.Duration)
+	}
+	return d
+}
+
+// nestCamera holds what both kinds of Nest camera need
+type nestCamera struct {
+	service *sdm.Service
+	device  *sdm.Device
+	name    string
+	opts    NestOptions
+}
+
+// NestWebRTC is a Nest camera that streams over WebRTC
+type NestWebRTC struct {
+	nestCamera
+}
+
+// NestRTSP is a Nest camera that streams over RTSP
+type NestRTSP struct {
+	nestCamera
+}
+
+// NewNest returns a source for the Nest camera, streaming with the best
+// protocol it supports
+func NewNest(service *sdm.Service, device *sdm.Device, name string, opts NestOptions) (Streamer, error) {
+	if opts.FrameTimeout == 0 {
+		opts.FrameTimeout = defaultFrameTimeout
+	}
+	if err := opts.Still.Validate(); err != nil {
+		return nil, err
+	}
+	if opts.DecodeH264 == nil {
+		opts.DecodeH264 = opts.Still.DecodeFirstFrame
+	}
+	if opts.GrabFrame == nil {
+		opts.GrabFrame = opts.Still.GrabFrame
+	}
+	if opts.DecodeBestFrame == nil {
+		opts.DecodeBestFrame = opts.Still.DecodeBestFrame
+	}
+	if opts.StackMethod == "" {
+		opts.StackMethod = video.StackMean
+	}
+	if opts.DecodeStackedFrame == nil {
+		opts.DecodeStackedFrame = opts.Still.DecodeStackedFrame
+	}
+	if opts.SelectFrames > 1 && opts.StackFrames > 1 {
+		return nil, fmt.Errorf("frames can't be both selected and stacked")
+	}
+	if opts.RemuxClip == nil {
+		opts.RemuxClip = video.RemuxClip
+	}
+	if opts.RecordClip == nil {
+		opts.RecordClip = video.RecordClip
+	}
+	if opts.MeasureLoudness == nil {
+		opts.MeasureLoudness = video.MeasureLoudness
+	}
+
+	camera := nestCamera{service: service, device: device, name: name, opts: opts}
+	switch protocol := sdm.StreamProtocol(device); protocol {
+	case sdm.ProtocolWebRTC:
+		return &NestWebRTC{camera}, nil
+	case sdm.ProtocolRTSP:
+		return &NestRTSP{camera}, nil
+	default:
+		return nil, fmt.Errorf("camera %q doesn't support WebRTC or RTSP streaming", name)
+	}
+}
+
+// Name returns the camera's name
+func (c *nestCamera) Name() string {
+	return c.name
+}
+
+// frame returns a frame from the camera with the image
+func (c *nestCamera) frame(image []byte, t time.Time, kind string) *Frame {
+	return &Frame{
+		Image: image,
+		Time:  t,
+		Metadata: map[string]string{
+			MetadataSource:   kind,
+			MetadataCamera:   c.name,
+			MetadataDeviceID: sdm.DeviceID(c.device),
+		},
+	}
+}
+
+// decode decodes a frame of the H264 video into a still, picking the best of
+// several frames if frames are selected or stacking them if frames are
+// stacked, and returns it with metadata describing how it was made
+func (c *nestCamera) decode(ctx context.Context, h264Data io.Reader) ([]byte, map[string]string, error) {
+	if c.opts.StackFrames > 1 {
+		image, stacked, err := c.opts.DecodeStackedFrame(ctx, h264Data, c.opts.StackFrames, c.opts.StackMethod)
+		if err != nil {
+			return nil, nil, err
+		}
+		fmt.Printf("Stacked %d frames (%s)\n", stacked, c.opts.StackMethod)
+		return image, map[string]string{
+			MetadataStackedFrames: strconv.Itoa(stacked),
+			MetadataStackMethod:   c.opts.StackMethod,
+		}, nil
+	}
+	if c.opts.SelectFrames <= 1 {
+		image, err := c.opts.DecodeH264(ctx, h264Data)
+		return image, nil, err
+	}
+
+	selection, err := c.opts.DecodeBestFrame(ctx, h264Data, c.opts.SelectFrames)
+	if err != nil {
+		return nil, nil, err
+	}
+	fmt.Printf("Selected frame %d of %d (sharpness %.1f, brightness change %.1f)\n",
+		selection.Index+1, selection.Decoded, selection.Score.Sharpness, selection.Score.BrightnessChange)
+	return selection.Image, map[string]string{
+		MetadataFrameIndex:       strconv.Itoa(selection.Index),
+		MetadataFrameScore:       strconv.FormatFloat(selection.Score.Score, 'f', 2, 64),
+		MetadataSharpness:        strconv.FormatFloat(selection.Score.Sharpness, 'f', 2, 64),
+		MetadataBrightnessChange: strconv.FormatFloat(selection.Score.BrightnessChange, 'f', 2, 64),
+	}, nil
+}
+
+// stopStream stops the camera's stream session so that it doesn't count
+// against the camera's limits until it expires. The session is stopped even
+// if the capture's context is done.
+func (c *NestWebRTC) stopStream(ctx context.Context, session *sdm.StreamSession) {
+	stopCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), webRtcTimeout)
+	defer cancel()
+	if err := c.service.StopWebRTCStream(stopCtx, c.device, session); err != nil {
+		fmt.Printf("Warning: failed to stop stream on camera %q: %v\n", c.name, err)
+	}
+}
+
+// connect sets up a WebRTC connection to the camera, calling prepare with the
+// connection before negotiating so that it can handle the camera's tracks.
+// The caller must close the connection and stop the returned session.
+func (c *NestWebRTC) connect(ctx context.Context, prepare func(*webrtc.Connection)) (*webrtc.Connection, *sdm.StreamSession, error) {
+	peerConnection, err := webrtc.SetupWebRTC(c.opts.WebRTC)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := webrtc.SetupTransceivers(peerConnection); err != nil {
+		peerConnection.Close()
+		return nil, nil, err
+	}
+
+	offer, err := webrtc.CreateOffer(ctx, peerConnection)
+	if err != nil {
+		peerConnection.Close()
+		return nil, nil, err
+	}
+	prepare(peerConnection)
+
+	session, err := c.service.GenerateWebRTCStream(ctx, c.device, offer.SDP)
+	if err != nil {
+		peerConnection.Close()
+		return nil, nil, err
+	}
+
+	answer := webrtc.SessionDescription{
+		Type: webrtc.SDPTypeAnswer,
+		SDP:  session.AnswerSDP,
+	}
+	if err := peerConnection.SetRemoteDescription(answer); err != nil {
+		c.stopStream(ctx, session)
+		peerConnection.Close()
+		return nil, nil, fmt.Errorf("failed to set remote description: %w", err)
+	}
+
+	connectCtx, cancelConnect := context.WithTimeout(ctx, webRtcTimeout)
+	defer cancelConnect()
+	if err := webrtc.WaitForConnection(connectCtx, peerConnection); err != nil {
+		c.stopStream(ctx, session)
+		peerConnection.Close()
+		return nil, nil, err
+	}
+	return peerConnection, session, nil
+}
+
+// videoTrackRecorder records the first H264 video track of a capture to w.
+// Only one track can be written to the decoder, so any others are skipped.
+type videoTrackRecorder struct {
+	w    io.Writer
+	opts webrtc.RecordOptions
+	// done is called once the track has been recorded
+	done    func()
+	started atomic.Bool
+}
+
+// record records the track if it is the first H264 video track, until it ends
+// or the context is done
+func (r *videoTrackRecorder) record(ctx context.Context, track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+	if webrtc.IsH264Video(track) && !r.started.CompareAndSwap(false, true) {
+		fmt.Printf("Skipping extra video track: %s\n", track.ID())
+		return
+	}
+	err := webrtc.HandleTrack(ctx, track, receiver, r.w, r.opts)
+	if errors.Is(err, webrtc.ErrSkippedTrack) {
+		return
+	}
+	if err != nil && !errors.Is(err, errDecoded) {
+		// Whatever was recorded can still be decoded
+		fmt.Println("Error recording video:", err)
+	}
+	r.done()
+}
+
+// Capture records from the camera until the first keyframe and decodes it.
+// If clips or audio are enabled, recording carries on for as long as they
+// need. The whole capture is abandoned if the context is done.
+func (c *NestWebRTC) Capture(ctx context.Context) (*Frame, error) {
+	var rec *webrtcRecording
+	if c.opts.Clip.Enabled() || c.opts.Audio.Enabled() {
+		var err error
+		if rec, err = newWebRTCRecording(c.opts.Clip, c.opts.Audio); err != nil {
+			return nil, err
+		}
+		defer rec.close()
+	}
+
+	// Decode the video as it is recorded, through a pipe, rather than
+	// buffering the whole recording first
+	videoReader, videoWriter := io.Pipe()
+	defer videoWriter.Close()
+	var recording io.Writer = videoWriter
+	var onFrame func()
+	if rec != nil && rec.video != nil {
+		recording = &clipWriter{clip: rec.video, decoder: videoWriter}
+		onFrame = rec.onFrame
+	}
+	type decodeResult struct {
+		image    []byte
+		metadata map[string]string
+		err      error
+	}
+	decoded := make(chan decodeResult, 1)
+	// decoderDone is closed once the decoder has stopped reading
+	decoderDone := make(chan struct{})
+	go func() {
+		image, metadata, err := c.decode(ctx, videoReader)
+		// Don't let the recording block once the decoder has stopped reading
+		videoReader.CloseWithError(errDecoded)
+		close(decoderDone)
+		decoded <- decodeResult{image, metadata, err}
+	}()
+
+	// Create a channel that is closed once a decodable keyframe has arrived,
+	// and one that is closed once the video track has been recorded
+	keyframe := make(chan struct{})
+	var keyframeTime time.Time
+	onKeyframe := sync.OnceFunc(func() {
+		keyframeTime = time.Now()
+		close(keyframe)
+	})
+	recorded := make(chan struct{})
+	videoTrack := &videoTrackRecorder{
+		w:    recording,
+		opts: webrtc.RecordOptions{MaxBytes: maxRecordingSize, OnKeyframe: onKeyframe, OnFrame: onFrame},
+		done: sync.OnceFunc(func() {
+			videoWriter.Close()
+			close(recorded)
+		}),
+	}
+	peerConnection, session, err := c.connect(ctx, func(pc *webrtc.Connection) {
+		pc.OnTrack(func(remoteTrack *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+			if rec != nil && rec.recordsAudio(remoteTrack) {
+				rec.recordAudio(ctx, remoteTrack)
+				return
+			}
+			videoTrack.record(ctx, remoteTrack, receiver)
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer peerConnection.Close()
+	defer c.stopStream(ctx, session)
+
+	// Stop as soon as we have a frame to extract, recording for at most
+	// recordingDuration
+	fmt.Printf("Recording until the first keyframe (at most %s)...\n", recordingDuration)
+	captureTime := time.Now()
+	select {
+	case <-keyframe:
+		captureTime = keyframeTime
+	case <-time.After(recordingDuration):
+		fmt.Println("No keyframe received before the recording limit")
+	case <-ctx.Done():
+		return nil, fmt.Errorf("recording interrupted: %w", ctx.Err())
+	}
+	if frames := c.opts.decodedFrames(); frames > 1 {
+		// Keep recording until the decoder has all the frames it needs, or
+		// the recording limit if they don't all arrive
+		fmt.Printf("Recording %d frames to decode...\n", frames)
+		select {
+		case <-decoderDone:
+		case <-time.After(recordingDuration):
+			fmt.Println("Not all frames received before the recording limit")
+		case <-ctx.Done():
+			return nil, fmt.Errorf("recording interrupted: %w", ctx.Err())
+		}
+	}
+	if extra := c.opts.extraRecording(); extra > 0 {
+		fmt.Printf("Recording for another %s...\n", extra)
+		select {
+		case <-time.After(extra):
+		case <-ctx.Done():
+			return nil, fmt.Errorf("recording interrupted: %w", ctx.Err())
+		}
+	}
+
+	// Close the connection even if the capture's context is done, once its
+	// stats have been collected
+	connectionStats := peerConnection.Stats()
+	closeCtx, cancelClose := context.WithTimeout(context.WithoutCancel(ctx), webRtcTimeout)
+	defer cancelClose()
+	if err := webrtc.WaitForConnectionClose(closeCtx, peerConnection); err != nil {
+		return nil, fmt.Errorf("failed to clean up connection: %w", err)
+	}
+
+	// Wait for the video track to end
+	select {
+	case <-recorded:
+	case <-time.After(5 * time.Second):
+		return nil, fmt.Errorf("timeout waiting for video data")
+	case <-ctx.Done():
+		return nil, fmt.Errorf("interrupted waiting for video data: %w", ctx.Err())
+	}
+
+	fmt.Println("Recording complete")
+
+	select {
+	case result := <-decoded:
+		if result.err != nil {
+			return nil, fmt.Errorf("failed to extract frame: %w", result.err)
+		}
+		frame := c.frame(result.image, captureTime, KindNestWebRTC)
+		maps.Copy(frame.Metadata, result.metadata)
+		maps.Copy(frame.Metadata, connectionMetadata(connectionStats))
+		if rec != nil {
+			c.addRecording(ctx, rec, frame)
+		}
+		frame.addEXIF(nestMake)
+		return frame, nil
+	case <-ctx.Done():
+		return nil, fmt.Errorf("interrupted extracting frame: %w", ctx.Err())
+	}
+}
+
+// connectionMetadata returns metadata describing how well the video arrived
+func connectionMetadata(stats webrtc.Stats) map[string]string {
+	metadata := map[string]string{
+		MetadataRoundTripTime:   formatMilliseconds(stats.RoundTripTime),
+		MetadataPacketsReceived: strconv.FormatUint(stats.PacketsReceived, 10),
+		MetadataPacketsLost:     strconv.FormatInt(stats.PacketsLost, 10),
+		MetadataJitter:          formatMilliseconds(stats.Jitter),
+	}
+	if stats.Codec != "" {
+		metadata[MetadataCodec] = stats.Codec
+	}
+	return metadata
+}
+
+// formatMilliseconds formats the duration as a number of milliseconds
+func formatMilliseconds(d time.Duration) string {
+	return strconv.FormatFloat(float64(d)/float64(time.Millisecond), 'f', 1, 64)
+}
+
+// addRecording adds the clip, audio and loudness recorded during a capture to
+// its frame. The frame is still worth saving without them, so failures are
+// only reported.
+func (c *NestWebRTC) addRecording(ctx context.Context, rec *webrtcRecording, frame *Frame) {
+	audioPath := rec.waitForAudio(ctx)
+	if c.opts.Clip.Enabled() {
+		clipAudio := ""
+		if c.opts.Clip.Audio {
+			clipAudio = audioPath
+		}
+		frame.Clip = rec.clip(ctx, c.opts.Clip, clipAudio, c.opts.RemuxClip)
+	}
+	if !c.opts.Audio.Enabled() {
+		return
+	}
+	if audioPath == "" {
+		fmt.Println("Warning: no audio was recorded")
+		return
+	}
+
+	if c.opts.Audio.Loudness {
+		loudness, err := c.opts.MeasureLoudness(ctx, audioPath)
+		if err != nil {
+			fmt.Printf("Warning: %v\n", err)
+		} else {
+			fmt.Printf("Audio loudness: mean %.1f dB, max %.1f dB\n", loudness.Mean, loudness.Max)
+			frame.Metadata[MetadataMeanVolume] = strconv.FormatFloat(loudness.Mean, 'f', 1, 64)
+			frame.Metadata[MetadataMaxVolume] = strconv.FormatFloat(loudness.Max, 'f', 1, 64)
+		}
+	}
+	if c.opts.Audio.Record {
+		frame.Audio = rec.keepAudio(audioPath)
+	}
+}
+
+// Stream keeps a WebRTC stream open to the camera and calls save with a frame
+// from it every interval, extending the stream session before it expires
+func (c *NestWebRTC) Stream(ctx context.Context, interval time.Duration, save func(*Frame) error) error {
+	setupCtx, cancelSetup := context.WithTimeout(ctx, c.opts.FrameTimeout)
+	defer cancelSetup()
+
+	// Record the video track until the stream ends
+	var live *webrtc.LiveVideo
+	recordCtx, stopRecording := context.WithCancel(ctx)
+	defer stopRecording()
+	peerConnection, session, err := c.connect(setupCtx, func(pc *webrtc.Connection) {
+		live = webrtc.NewLiveVideo(pc)
+		pc.OnTrack(func(remoteTrack *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+			if remoteTrack.Kind().String() != "video" {
+				return
+			}
+			if err := live.Record(recordCtx, remoteTrack); err != nil && recordCtx.Err() == nil {
+				fmt.Printf("Error recording camera %q: %v\n", c.name, err)
+			}
+		})
+	})
+	if err != nil {
+		return err
+	}
+	defer peerConnection.Close()
+	defer c.stopStream(ctx, session)
+
+	lost := make(chan error, 1)
+	go func() {
+		lost <- webrtc.WaitForConnectionLoss(recordCtx, peerConnection)
+	}()
+
+	fmt.Printf("Streaming from camera %q, saving a frame every %s\n", c.name, interval)
+	return streamLoop(ctx, c.name, interval, lost,
+		func() (time.Time, error) {
+			err := c.service.ExtendWebRTCStream(ctx, c.device, session)
+			return session.ExpiresAt, err
+		},
+		session.ExpiresAt,
+		func() error {
+			frame, err := c.liveFrame(ctx, live)
+			if err != nil {
+				return err
+			}
+			return save(frame)
+		})
+}
+
+// liveFrame requests a keyframe from the live stream and decodes it, giving
+// up on the decode after the frame timeout
+func (c *NestWebRTC) liveFrame(ctx context.Context, live *webrtc.LiveVideo) (*Frame, error) {
+	keyframeCtx, cancel := context.WithTimeout(ctx, keyframeTimeout)
+	defer cancel()
+	keyframe, err := live.Keyframe(keyframeCtx)
+	if err != nil {
+		return nil, err
+	}
+	captureTime := time.Now()
+	decodeCtx, cancelDecode := context.WithTimeout(ctx, c.opts.FrameTimeout)
+	defer cancelDecode()
+	image, err := c.opts.DecodeH264(decodeCtx, keyframe)
+	if err != nil {
+		return nil, fmt.Errorf("failed to extract frame: %w", err)
+	}
+	frame := c.frame(image, captureTime, KindNestWebRTC)
+	frame.addEXIF(nestMake)
+	return frame, nil
+}
+
+// stopStream stops the camera's RTSP stream session, even if the capture's
+// context is done
+func (c *NestRTSP) stopStream(ctx context.Context, session *sdm.RTSPSession) {
+	stopCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), webRtcTimeout)
+	defer cancel()
+	if err := c.service.StopRTSPStream(stopCtx, c.device, session); err != nil {
+		fmt.Printf("Warning: failed to stop RTSP stream on camera %q: %v\n", c.name, err)
+	}
+}
+
+// grab takes a frame from the RTSP stream
+func (c *NestRTSP) grab(ctx context.Context, session *sdm.RTSPSession) (*Frame, error) {
+	captureTime := time.Now()
+	image, err := c.opts.GrabFrame(ctx, session.URL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to extract frame: %w", err)
+	}
+	frame := c.frame(image, captureTime, KindNestRTSP)
+	frame.addEXIF(nestMake)
+	return frame, nil
+}
+
+// Capture starts an RTSP stream on the camera and takes a frame from it,
+// letting ffmpeg read the stream directly. If clips are enabled, a clip is
+// then recorded from the same stream.
+func (c *NestRTSP) Capture(ctx context.Context) (*Frame, error) {
+	session, err := c.service.GenerateRTSPStream(ctx, c.device)
+	if err != nil {
+		return nil, err
+	}
+	defer c.stopStream(ctx, session)
+
+	fmt.Println("Reading a frame from the RTSP stream...")
+	frame, err := c.grab(ctx, session)
+	if err != nil {
+		return nil, err
+	}
+	if c.opts.Clip.Enabled() {
+		frame.Clip = recordStreamClip(ctx, c.opts.Clip, session.URL, c.opts.RecordClip)
+	}
+	return frame, nil
+}
+
+// Stream starts an RTSP stream on the camera and calls save with a frame from
+// it every interval, extending the stream session before it expires. ffmpeg
+// connects to the stream for each frame, but the session is kept open so that
+// a new one isn't needed each time.
+func (c *NestRTSP) Stream(ctx context.Context, interval time.Duration, save func(*Frame) error) error {
+	session, err := c.service.GenerateRTSPStream(ctx, c.device)
+	if err != nil {
+		return err
+	}
+	defer c.stopStream(ctx, session)
+
+	fmt.Printf("Streaming from camera %q over RTSP, saving a frame every %s\n", c.name, interval)
+	return streamLoop(ctx, c.name, interval, nil,
+		func() (time.Time, error) {
+			err := c.service.ExtendRTSPStream(ctx, c.device, session)
+			return session.ExpiresAt, err
+		},
+		session.ExpiresAt,
+		func() error {
+			frameCtx, cancel := context.WithTimeout(ctx, c.opts.FrameTimeout)
+			defer cancel()
+			frame, err := c.grab(frameCtx, session)
+			if err != nil {
+				return err
+			}
+			return save(frame)
+		})
+}
+
+// streamLoop calls saveFrame every interval and extends the stream session
+// before it expires, until the context is done, the stream is lost, the
+// source is exhausted or too many frames in a row fail, in which case the last
+// frame's error is wrapped. lost may be nil if loss isn't detected, and extend
+// nil if there is no session to extend.
+func streamLoop(ctx context.Context, name string, interval time.Duration, lost <-chan error,
+	extend func() (time.Time, error), expiresAt time.Time, saveFrame func() error) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	// extendC fires when the session is due to be extended, and never if
+	// there is no session
+	var extendTimer *time.Timer
+	var extendC <-chan time.Time
+	if extend != nil {
+		extendTimer = time.NewTimer(time.Until(expiresAt.Add(-extendMargin)))
+		defer extendTimer.Stop()
+		extendC = extendTimer.C
+	}
+
+	missed := 0
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+
+		case err := <-lost:
+			return err
+
+		case <-extendC:
+			var err error
+			if expiresAt, err = extend(); err != nil {
+				return err
+			}
+			fmt.Printf("Extended stream from camera %q until %s\n", name, expiresAt.Format(time.RFC3339))
+			extendTimer.Reset(time.Until(expiresAt.Add(-extendMargin)))
+
+		case <-ticker.C:
+			err := saveFrame()
+			if errors.Is(err, ErrExhausted) {
+				return err
+			}
+			if err != nil {
+				missed++
+				fmt.Printf("Capture from camera %q failed: %v\n", name, err)
+				if missed >= maxMissedFrames {
+					return fmt.Errorf("%d frames in a row failed: %w", missed, err)
+				}
+				continue
+			}
+			missed = 0
+		}
+	}
+}
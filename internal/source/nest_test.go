@@ -0,0 +1,452 @@
+package source_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sigh/nest-timelapse/internal/exif"
+	"github.com/sigh/nest-timelapse/internal/sdm"
+	"github.com/sigh/nest-timelapse/internal/sdm/sdmtest"
+	"github.com/sigh/nest-timelapse/internal/source"
+	"github.com/sigh/nest-timelapse/internal/video"
+	"github.com/sigh/nest-timelapse/internal/webrtc"
+	"github.com/sigh/nest-timelapse/internal/webrtc/webrtctest"
+	"golang.org/x/oauth2"
+)
+
+// H264 NAL unit headers in the sample video
+var (
+	spsHeader = []byte{0, 0, 0, 1, 0x67}
+	ppsHeader = []byte{0, 0, 0, 1, 0x68}
+	idrHeader = []byte{0, 0, 0, 1, 0x65}
+)
+
+// fakeJPEG stands in for decoded images, as ffmpeg may not be installed
+var fakeJPEG = []byte{0xFF, 0xD8, 0xFF, 0xD9}
+
+// newTestService returns an SDM service talking to a fake server whose
+// WebRTC cameras are answered by a fake camera
+func newTestService(t *testing.T) (*sdm.Service, *sdmtest.Server) {
+	t.Helper()
+
+	fakeCamera, err := webrtctest.NewCamera(webrtctest.SampleH264)
+	if err != nil {
+		t.Fatalf("NewCamera() error = %v", err)
+	}
+	t.Cleanup(func() { fakeCamera.Close() })
+
+	server := sdmtest.NewServer("test-enterprise")
+	t.Cleanup(server.Close)
+	server.SetAnswer(func(_ *sdm.Device, offerSDP string) (string, error) {
+		return fakeCamera.Answer(offerSDP)
+	})
+
+	tokenSource := oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "test-token"})
+	service, err := sdm.NewService(context.Background(), tokenSource, sdm.Options{Endpoint: server.Endpoint()})
+	if err != nil {
+		t.Fatalf("NewService() error = %v", err)
+	}
+	return service, server
+}
+
+// testOptions returns options that connect to the fake camera over loopback
+// and record the H264 data passed for decoding
+func testOptions(decoded *[][]byte) source.NestOptions {
+	return source.NestOptions{
+		WebRTC:       webrtc.Options{HostOnly: true, IncludeLoopback: true},
+		FrameTimeout: 30 * time.Second,
+		DecodeH264: func(_ context.Context, h264Data io.Reader) ([]byte, error) {
+			data, err := io.ReadAll(h264Data)
+			*decoded = append(*decoded, data)
+			return fakeJPEG, err
+		},
+	}
+}
+
+func TestNestWebRTCCapture(t *testing.T) {
+	service, server := newTestService(t)
+	device := server.AddCamera("cam-1", "Garden", "", sdm.ProtocolWebRTC)
+
+	var decoded [][]byte
+	src, err := source.NewNest(service, device, "Garden", testOptions(&decoded))
+	if err != nil {
+		t.Fatalf("NewNest() error = %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	start := time.Now()
+	frame, err := src.Capture(ctx)
+	if err != nil {
+		t.Fatalf("Capture() error = %v", err)
+	}
+
+	if !bytes.HasSuffix(frame.Image, fakeJPEG[2:]) {
+		t.Errorf("Image = %x, want the decoded image", frame.Image)
+	}
+	if frame.Time.Before(start) || frame.Time.After(time.Now()) {
+		t.Errorf("Time = %v, want during the capture", frame.Time)
+	}
+	if taken, err := exif.ReadDateTimeOriginal(bytes.NewReader(frame.Image)); err != nil || !taken.Equal(frame.Time.Truncate(time.Second)) {
+		t.Errorf("EXIF DateTimeOriginal = %v, %v, want %v", taken, err, frame.Time.Truncate(time.Second))
+	}
+	if !bytes.Contains(frame.Image, []byte("deviceId=cam-1")) {
+		t.Error("EXIF data doesn't describe the capture")
+	}
+	want := map[string]string{
+		source.MetadataSource:   source.KindNestWebRTC,
+		source.MetadataCamera:   "Garden",
+		source.MetadataDeviceID: "cam-1",
+		source.MetadataCodec:    "H264",
+	}
+	for key, value := range want {
+		if frame.Metadata[key] != value {
+			t.Errorf("Metadata[%q] = %q, want %q", key, frame.Metadata[key], value)
+		}
+	}
+	if received, err := strconv.Atoi(frame.Metadata[source.MetadataPacketsReceived]); err != nil || received == 0 {
+		t.Errorf("Metadata[%q] = %q, want some packets", source.MetadataPacketsReceived, frame.Metadata[source.MetadataPacketsReceived])
+	}
+
+	if sessions := server.Sessions(); len(sessions) != 1 || !sessions[0].Stopped {
+		t.Errorf("Sessions() = %+v, want one stopped session", sessions)
+	}
+	if len(decoded) != 1 {
+		t.Fatalf("decoded %d videos, want 1", len(decoded))
+	}
+	for name, header := range map[string][]byte{"SPS": spsHeader, "PPS": ppsHeader, "IDR": idrHeader} {
+		if !bytes.Contains(decoded[0], header) {
+			t.Errorf("recorded video has no %s NAL unit", name)
+		}
+	}
+}
+
+// readKeyframe reads H264 data until a whole keyframe has arrived, and stops
+// reading, as ffmpeg would once it has decoded enough frames
+func readKeyframe(h264Data io.Reader) error {
+	var data []byte
+	chunk := make([]byte, 256)
+	for bytes.Count(data, spsHeader) < 2 {
+		n, err := h264Data.Read(chunk)
+		if err != nil {
+			return err
+		}
+		data = append(data, chunk[:n]...)
+	}
+	return nil
+}
+
+func TestNestWebRTCCaptureSelectsFrame(t *testing.T) {
+	service, server := newTestService(t)
+	device := server.AddCamera("cam-1", "Garden", "", sdm.ProtocolWebRTC)
+
+	var decoded [][]byte
+	var gotFrames int
+	opts := testOptions(&decoded)
+	opts.SelectFrames = 5
+	opts.DecodeBestFrame = func(_ context.Context, h264Data io.Reader, frames int) (*video.Selection, error) {
+		gotFrames = frames
+		if err := readKeyframe(h264Data); err != nil {
+			return nil, err
+		}
+		return &video.Selection{
+			Image:   fakeJPEG,
+			Index:   2,
+			Decoded: frames,
+			Score:   video.FrameScore{Sharpness: 120.5, BrightnessChange: 3, Score: 30.126},
+		}, nil
+	}
+	src, err := source.NewNest(service, device, "Garden", opts)
+	if err != nil {
+		t.Fatalf("NewNest() error = %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	frame, err := src.Capture(ctx)
+	if err != nil {
+		t.Fatalf("Capture() error = %v", err)
+	}
+
+	if gotFrames != 5 {
+		t.Errorf("DecodeBestFrame() asked for %d frames, want 5", gotFrames)
+	}
+	if len(decoded) != 0 {
+		t.Errorf("DecodeH264() called %d times, want only DecodeBestFrame", len(decoded))
+	}
+	want := map[string]string{
+		source.MetadataFrameIndex:       "2",
+		source.MetadataFrameScore:       "30.13",
+		source.MetadataSharpness:        "120.50",
+		source.MetadataBrightnessChange: "3.00",
+	}
+	for key, value := range want {
+		if frame.Metadata[key] != value {
+			t.Errorf("Metadata[%q] = %q, want %q", key, frame.Metadata[key], value)
+		}
+	}
+}
+
+func TestNestWebRTCCaptureStacksFrames(t *testing.T) {
+	service, server := newTestService(t)
+	device := server.AddCamera("cam-1", "Garden", "", sdm.ProtocolWebRTC)
+
+	var decoded [][]byte
+	var gotFrames int
+	var gotMethod string
+	opts := testOptions(&decoded)
+	opts.StackFrames = 8
+	opts.StackMethod = video.StackMedian
+	opts.DecodeStackedFrame = func(_ context.Context, h264Data io.Reader, frames int, method string) ([]byte, int, error) {
+		gotFrames, gotMethod = frames, method
+		if err := readKeyframe(h264Data); err != nil {
+			return nil, 0, err
+		}
+		return fakeJPEG, 6, nil
+	}
+	src, err := source.NewNest(service, device, "Garden", opts)
+	if err != nil {
+		t.Fatalf("NewNest() error = %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	frame, err := src.Capture(ctx)
+	if err != nil {
+		t.Fatalf("Capture() error = %v", err)
+	}
+
+	if gotFrames != 8 || gotMethod != video.StackMedian {
+		t.Errorf("DecodeStackedFrame() got %d frames and method %q, want 8 and %q", gotFrames, gotMethod, video.StackMedian)
+	}
+	if !bytes.HasSuffix(frame.Image, fakeJPEG[2:]) {
+		t.Errorf("Image = %x, want the stacked image", frame.Image)
+	}
+	if frame.Metadata[source.MetadataStackedFrames] != "6" || frame.Metadata[source.MetadataStackMethod] != video.StackMedian {
+		t.Errorf("Metadata = %v, want 6 frames stacked by median", frame.Metadata)
+	}
+}
+
+func TestNewNestSelectAndStack(t *testing.T) {
+	service, server := newTestService(t)
+	device := server.AddCamera("cam-1", "Garden", "", sdm.ProtocolWebRTC)
+	opts := source.NestOptions{SelectFrames: 5, StackFrames: 5}
+	if _, err := source.NewNest(service, device, "Garden", opts); err == nil {
+		t.Error("NewNest() selecting and stacking frames succeeded, want error")
+	}
+}
+
+func TestNestWebRTCCaptureClip(t *testing.T) {
+	service, server := newTestService(t)
+	device := server.AddCamera("cam-1", "Garden", "", sdm.ProtocolWebRTC)
+
+	var decoded [][]byte
+	var input video.ClipInput
+	var recordedVideo, recordedAudio []byte
+	opts := testOptions(&decoded)
+	opts.Clip = source.ClipOptions{Format: video.ClipFormatMKV, Duration: 500 * time.Millisecond, Audio: true}
+	opts.RemuxClip = func(_ context.Context, in video.ClipInput, clipPath string) error {
+		input = in
+		recordedVideo, _ = os.ReadFile(in.H264Path)
+		recordedAudio, _ = os.ReadFile(in.AudioPath)
+		return os.WriteFile(clipPath, []byte("clip"), 0644)
+	}
+	src, err := source.NewNest(service, device, "Garden", opts)
+	if err != nil {
+		t.Fatalf("NewNest() error = %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	frame, err := src.Capture(ctx)
+	if err != nil {
+		t.Fatalf("Capture() error = %v", err)
+	}
+	if frame.Clip == "" {
+		t.Fatal("Capture() returned no clip")
+	}
+	defer os.Remove(frame.Clip)
+
+	if filepath.Ext(frame.Clip) != ".mkv" {
+		t.Errorf("Clip = %q, want an mkv file", frame.Clip)
+	}
+	if _, err := os.Stat(input.H264Path); !os.IsNotExist(err) {
+		t.Errorf("recorded video %s wasn't removed", input.H264Path)
+	}
+	if len(decoded) != 1 {
+		t.Errorf("decoded %d videos, want 1", len(decoded))
+	}
+	if !bytes.Contains(recordedVideo, idrHeader) {
+		t.Error("clip video has no IDR NAL unit")
+	}
+	// The fake camera sends 10 frames a second
+	if input.FrameRate < 5 || input.FrameRate > 20 {
+		t.Errorf("FrameRate = %v, want about 10", input.FrameRate)
+	}
+	if !bytes.HasPrefix(recordedAudio, []byte("OggS")) {
+		t.Errorf("clip audio isn't an Ogg stream")
+	}
+}
+
+func TestNestWebRTCCaptureAudio(t *testing.T) {
+	service, server := newTestService(t)
+	device := server.AddCamera("cam-1", "Garden", "", sdm.ProtocolWebRTC)
+
+	var decoded [][]byte
+	var measured []byte
+	opts := testOptions(&decoded)
+	opts.Audio = source.AudioOptions{Record: true, Loudness: true, Duration: 500 * time.Millisecond}
+	opts.MeasureLoudness = func(_ context.Context, audioPath string) (video.Loudness, error) {
+		measured, _ = os.ReadFile(audioPath)
+		return video.Loudness{Mean: -52.25, Max: -30}, nil
+	}
+	src, err := source.NewNest(service, device, "Garden", opts)
+	if err != nil {
+		t.Fatalf("NewNest() error = %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	frame, err := src.Capture(ctx)
+	if err != nil {
+		t.Fatalf("Capture() error = %v", err)
+	}
+	if frame.Audio == "" {
+		t.Fatal("Capture() returned no audio")
+	}
+	defer os.Remove(frame.Audio)
+
+	audio, err := os.ReadFile(frame.Audio)
+	if err != nil || !bytes.HasPrefix(audio, []byte("OggS")) {
+		t.Errorf("audio %s isn't an Ogg stream (error %v)", frame.Audio, err)
+	}
+	if !bytes.Equal(measured, audio) {
+		t.Error("loudness wasn't measured from the recorded audio")
+	}
+	if frame.Metadata[source.MetadataMeanVolume] != "-52.2" || frame.Metadata[source.MetadataMaxVolume] != "-30.0" {
+		t.Errorf("Metadata = %v, want the measured volumes", frame.Metadata)
+	}
+}
+
+func TestNestWebRTCStream(t *testing.T) {
+	service, server := newTestService(t)
+	device := server.AddCamera("cam-1", "Garden", "", sdm.ProtocolWebRTC)
+
+	var decoded [][]byte
+	src, err := source.NewNest(service, device, "Garden", testOptions(&decoded))
+	if err != nil {
+		t.Fatalf("NewNest() error = %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	saved := 0
+	err = src.Stream(ctx, 200*time.Millisecond, func(frame *source.Frame) error {
+		saved++
+		return nil
+	})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Stream() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if saved < 3 || saved != len(decoded) {
+		t.Errorf("Stream() saved %d frames (%d decoded), want at least 3", saved, len(decoded))
+	}
+
+	// Each frame is a single keyframe with its SPS and PPS
+	for i, keyframe := range decoded {
+		if !bytes.HasPrefix(keyframe, spsHeader) || !bytes.Contains(keyframe, ppsHeader) ||
+			bytes.Count(keyframe, idrHeader) != 1 {
+			t.Errorf("frame %d isn't a single keyframe", i)
+		}
+	}
+
+	if sessions := server.Sessions(); len(sessions) != 1 || !sessions[0].Stopped {
+		t.Errorf("Sessions() = %+v, want one stopped session", sessions)
+	}
+}
+
+func TestNestWebRTCStreamDecodeTimeout(t *testing.T) {
+	service, server := newTestService(t)
+	device := server.AddCamera("cam-1", "Garden", "", sdm.ProtocolWebRTC)
+
+	opts := testOptions(new([][]byte))
+	var decodes, unbounded int
+	opts.DecodeH264 = func(ctx context.Context, h264Data io.Reader) ([]byte, error) {
+		decodes++
+		// The stream's context has no deadline, so only the frame timeout
+		// stops a stuck decoder
+		if deadline, ok := ctx.Deadline(); !ok || time.Until(deadline) > opts.FrameTimeout {
+			unbounded++
+		}
+		return fakeJPEG, nil
+	}
+	src, err := source.NewNest(service, device, "Garden", opts)
+	if err != nil {
+		t.Fatalf("NewNest() error = %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	saved := 0
+	err = src.Stream(ctx, 100*time.Millisecond, func(frame *source.Frame) error {
+		if saved++; saved == 2 {
+			cancel()
+		}
+		return nil
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Stream() error = %v, want %v", err, context.Canceled)
+	}
+	if decodes < 2 || unbounded > 0 {
+		t.Errorf("%d of %d decodes had no frame timeout", unbounded, decodes)
+	}
+}
+
+func TestNestRTSPCapture(t *testing.T) {
+	service, server := newTestService(t)
+	device := server.AddCamera("cam-2", "Porch", "", sdm.ProtocolRTSP)
+
+	var gotURL string
+	opts := source.NestOptions{
+		GrabFrame: func(_ context.Context, streamURL string) ([]byte, error) {
+			gotURL = streamURL
+			return fakeJPEG, nil
+		},
+	}
+	src, err := source.NewNest(service, device, "Porch", opts)
+	if err != nil {
+		t.Fatalf("NewNest() error = %v", err)
+	}
+
+	frame, err := src.Capture(context.Background())
+	if err != nil {
+		t.Fatalf("Capture() error = %v", err)
+	}
+	if frame.Metadata[source.MetadataSource] != source.KindNestRTSP {
+		t.Errorf("Metadata[%q] = %q, want %q", source.MetadataSource, frame.Metadata[source.MetadataSource], source.KindNestRTSP)
+	}
+
+	sessions := server.Sessions()
+	if len(sessions) != 1 || sessions[0].Protocol != sdm.ProtocolRTSP || !sessions[0].Stopped {
+		t.Fatalf("Sessions() = %+v, want one stopped RTSP session", sessions)
+	}
+	if !strings.HasPrefix(gotURL, "rtsps://") {
+		t.Errorf("frame grabbed from %q, want the RTSP URL", gotURL)
+	}
+}
+
+func TestNewNestUnsupportedCamera(t *testing.T) {
+	service, server := newTestService(t)
+	device := server.AddCamera("cam-3", "Attic", "")
+	if _, err := source.NewNest(service, device, "Attic", source.NestOptions{}); err == nil {
+		t.Error("NewNest() of camera without streaming succeeded, want error")
+	}
+}
@@ -0,0 +1,162 @@
+package source
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"github.com/sigh/nest-timelapse/internal/video"
+	"github.com/sigh/nest-timelapse/internal/webrtc"
+)
+
+// defaultClipFrameRate is assumed when too few frames arrive to measure the
+// camera's frame rate
+const defaultClipFrameRate = 15
+
+// audioTimeout is the longest to wait for the audio track to finish once the
+// video has been recorded
+const audioTimeout = 5 * time.Second
+
+// webrtcRecording records what a WebRTC capture keeps besides its frame, the
+// video for a clip and the audio, into temporary files
+type webrtcRecording struct {
+	dir string
+	// video is nil unless a clip is recorded
+	video *os.File
+	// audio is nil unless audio is recorded
+	audio *os.File
+	// audioStarted is set once an audio track arrives, and audioRecorded is
+	// closed once it has been recorded
+	audioStarted  atomic.Bool
+	audioRecorded chan struct{}
+
+	// frames is how many video frames arrived between first and last. They
+	// are only used by the track's goroutine until it has been recorded.
+	frames      int
+	first, last time.Time
+}
+
+// newWebRTCRecording creates the temporary files to record into. The caller
+// must close the recording.
+func newWebRTCRecording(clip ClipOptions, audio AudioOptions) (*webrtcRecording, error) {
+	dir, err := os.MkdirTemp("", "nest_recording_")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create recording directory: %w", err)
+	}
+	r := &webrtcRecording{dir: dir, audioRecorded: make(chan struct{})}
+	if clip.Enabled() {
+		if r.video, err = os.Create(filepath.Join(dir, "video.h264")); err != nil {
+			r.close()
+			return nil, fmt.Errorf("failed to create video file: %w", err)
+		}
+	}
+	if (clip.Enabled() && clip.Audio) || audio.Enabled() {
+		if r.audio, err = os.Create(filepath.Join(dir, "audio."+video.AudioFormatOgg)); err != nil {
+			r.close()
+			return nil, fmt.Errorf("failed to create audio file: %w", err)
+		}
+	}
+	return r, nil
+}
+
+// close removes the temporary files
+func (r *webrtcRecording) close() {
+	if r.video != nil {
+		r.video.Close()
+	}
+	if r.audio != nil {
+		r.audio.Close()
+	}
+	if err := os.RemoveAll(r.dir); err != nil {
+		fmt.Printf("Warning: failed to remove recording: %v\n", err)
+	}
+}
+
+// onFrame counts a video frame as it arrives, to measure the frame rate
+func (r *webrtcRecording) onFrame() {
+	now := time.Now()
+	if r.frames == 0 {
+		r.first = now
+	}
+	r.last = now
+	r.frames++
+}
+
+// frameRate returns the frame rate the video arrived at
+func (r *webrtcRecording) frameRate() float64 {
+	if r.frames < 2 || !r.last.After(r.first) {
+		return defaultClipFrameRate
+	}
+	return float64(r.frames-1) / r.last.Sub(r.first).Seconds()
+}
+
+// recordsAudio reports whether the track is audio that should be recorded
+func (r *webrtcRecording) recordsAudio(track *webrtc.TrackRemote) bool {
+	return r.audio != nil && track.Kind().String() == "audio"
+}
+
+// recordAudio records the audio track until it ends
+func (r *webrtcRecording) recordAudio(ctx context.Context, track *webrtc.TrackRemote) {
+	if !r.audioStarted.CompareAndSwap(false, true) {
+		return
+	}
+	defer close(r.audioRecorded)
+	if err := webrtc.HandleAudioTrack(ctx, track, r.audio); err != nil {
+		fmt.Println("Error recording audio:", err)
+	}
+}
+
+// waitForAudio waits for the audio track to be recorded, returning the path
+// of the recorded audio, or an empty path if there isn't any
+func (r *webrtcRecording) waitForAudio(ctx context.Context) string {
+	if !r.audioStarted.Load() {
+		return ""
+	}
+	select {
+	case <-r.audioRecorded:
+		if info, err := r.audio.Stat(); err == nil && info.Size() > 0 {
+			return r.audio.Name()
+		}
+	case <-time.After(audioTimeout):
+		fmt.Println("Warning: timed out recording audio")
+	case <-ctx.Done():
+	}
+	return ""
+}
+
+// clip remuxes the recorded video, and the audio at audioPath if it isn't
+// empty, into a temporary clip file, returning its path. The frame is still
+// worth saving if the clip fails, so failures are only reported and an empty
+// path returned.
+func (r *webrtcRecording) clip(ctx context.Context, opts ClipOptions, audioPath string,
+	remux func(ctx context.Context, input video.ClipInput, clipPath string) error) string {
+	input := video.ClipInput{H264Path: r.video.Name(), FrameRate: r.frameRate(), AudioPath: audioPath}
+	clipPath, err := tempFile(opts.Format)
+	if err == nil {
+		err = remux(ctx, input, clipPath)
+	}
+	if err != nil {
+		fmt.Printf("Warning: failed to save clip: %v\n", err)
+		os.Remove(clipPath)
+		return ""
+	}
+	return clipPath
+}
+
+// keepAudio moves the recorded audio at audioPath out of the recording into a
+// temporary file, returning its path, or an empty path if it fails
+func (r *webrtcRecording) keepAudio(audioPath string) string {
+	keptPath, err := tempFile(video.AudioFormatOgg)
+	if err == nil {
+		err = os.Rename(audioPath, keptPath)
+	}
+	if err != nil {
+		fmt.Printf("Warning: failed to save audio: %v\n", err)
+		os.Remove(keptPath)
+		return ""
+	}
+	return keptPath
+}
@@ -0,0 +1,104 @@
+// Package source provides the cameras and other sources that frames are
+// captured from: Nest cameras over WebRTC or RTSP, generic RTSP cameras, HTTP
+// snapshot URLs and directories of existing images.
+package source
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Metadata keys set by the sources
+const (
+	// MetadataSource is the kind of source, e.g. "nest-webrtc" or "http"
+	MetadataSource = "source"
+	// MetadataCamera is the name of the camera
+	MetadataCamera = "camera"
+	// MetadataDeviceID is the SDM device ID of a Nest camera
+	MetadataDeviceID = "deviceId"
+	// MetadataFile is the file a replayed frame was read from
+	MetadataFile = "file"
+	// MetadataMeanVolume and MetadataMaxVolume are how loud the camera's audio
+	// was around the frame, in dB relative to full scale
+	MetadataMeanVolume = "meanVolume"
+	MetadataMaxVolume  = "maxVolume"
+	// MetadataFrameIndex is which of the decoded frames was selected, from 0,
+	// and MetadataFrameScore, MetadataSharpness and MetadataBrightnessChange
+	// are how it scored (see video.FrameScore)
+	MetadataFrameIndex       = "frameIndex"
+	MetadataFrameScore       = "frameScore"
+	MetadataSharpness        = "sharpness"
+	MetadataBrightnessChange = "brightnessChange"
+	// MetadataStackedFrames is how many frames were stacked into the image,
+	// and MetadataStackMethod how they were stacked
+	MetadataStackedFrames = "stackedFrames"
+	MetadataStackMethod   = "stackMethod"
+	// MetadataCodec is the codec of the video the frame was decoded from
+	MetadataCodec = "codec"
+	// MetadataRoundTripTime is the round trip time to the camera in
+	// milliseconds, MetadataPacketsReceived and MetadataPacketsLost count the
+	// video's RTP packets, and MetadataJitter is the variation in their
+	// arrival times in milliseconds
+	MetadataRoundTripTime   = "roundTripTime"
+	MetadataPacketsReceived = "packetsReceived"
+	MetadataPacketsLost     = "packetsLost"
+	MetadataJitter          = "jitter"
+)
+
+// ErrExhausted is returned by sources that have no more frames to give
+var ErrExhausted = errors.New("no more frames")
+
+// Frame is an image captured from a source
+type Frame struct {
+	// Image is the encoded image: a JPEG, or a PNG or WebP if a source is
+	// configured to take stills in those formats
+	Image []byte
+	// Time is when the image was captured
+	Time time.Time
+	// Metadata describes where the image came from
+	Metadata map[string]string
+	// Clip, if not empty, is a temporary file holding a video clip recorded
+	// around the image. The caller must save or remove it.
+	Clip string
+	// Audio, if not empty, is a temporary Ogg Opus file holding audio
+	// recorded around the image. The caller must save or remove it.
+	Audio string
+}
+
+// Source is a camera or anything else that frames can be captured from
+type Source interface {
+	// Name returns a human readable name for the source
+	Name() string
+	// Capture captures a single frame. The capture is abandoned if the
+	// context is done.
+	Capture(ctx context.Context) (*Frame, error)
+}
+
+// Streamer is implemented by sources that can keep a stream open and take
+// frames from it more cheaply than by capturing each one separately
+type Streamer interface {
+	Source
+	// Stream opens a stream and calls save with a frame from it every
+	// interval, until the context is done or the stream fails. It returns why
+	// the stream ended.
+	Stream(ctx context.Context, interval time.Duration, save func(*Frame) error) error
+}
+
+// Poll captures a frame from a source that can't stream every interval and
+// calls save with it, abandoning each capture after frameTimeout. Like
+// Stream, it runs until the context is done or too many frames in a row fail,
+// and returns ErrExhausted once the source has no more frames.
+func Poll(ctx context.Context, src Source, interval, frameTimeout time.Duration, save func(*Frame) error) error {
+	fmt.Printf("Capturing from camera %q every %s\n", src.Name(), interval)
+	return streamLoop(ctx, src.Name(), interval, nil, nil, time.Time{}, func() error {
+		frameCtx, cancel := context.WithTimeout(ctx, frameTimeout)
+		defer cancel()
+		frame, err := src.Capture(frameCtx)
+		if err != nil {
+			return err
+		}
+		return save(frame)
+	})
+}
@@ -0,0 +1,165 @@
+package source_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sigh/nest-timelapse/internal/source"
+	"github.com/sigh/nest-timelapse/internal/video"
+)
+
+func TestSnapshot(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  int
+		body    []byte
+		wantErr bool
+	}{
+		{name: "jpeg", status: http.StatusOK, body: fakeJPEG},
+		{name: "not found", status: http.StatusNotFound, body: []byte("not found"), wantErr: true},
+		{name: "not a jpeg", status: http.StatusOK, body: []byte("<html></html>"), wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+				w.Write(tt.body)
+			}))
+			defer server.Close()
+
+			src := source.NewSnapshot("Gate", server.URL, nil)
+			frame, err := src.Capture(context.Background())
+			if tt.wantErr {
+				if err == nil {
+					t.Error("Capture() succeeded, want error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Capture() error = %v", err)
+			}
+			if !bytes.Equal(frame.Image, tt.body) {
+				t.Errorf("Image = %x, want %x", frame.Image, tt.body)
+			}
+			if frame.Metadata[source.MetadataSource] != source.KindHTTP || frame.Metadata[source.MetadataCamera] != "Gate" {
+				t.Errorf("Metadata = %v, want an http source named Gate", frame.Metadata)
+			}
+		})
+	}
+}
+
+func TestDirectory(t *testing.T) {
+	dir := t.TempDir()
+	captured := time.Date(2024, 3, 20, 14, 30, 0, 0, time.UTC)
+	framePath, err := video.SaveFrame([]byte{0xFF, 0xD8, 1}, captured, dir)
+	if err != nil {
+		t.Fatalf("SaveFrame() error = %v", err)
+	}
+	otherPath := filepath.Join(dir, "zz_other.jpeg")
+	if err := os.WriteFile(otherPath, []byte{0xFF, 0xD8, 2}, 0644); err != nil {
+		t.Fatal(err)
+	}
+	modified := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := os.Chtimes(otherPath, modified, modified); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "notes.txt"), []byte("ignored"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	src, err := source.NewDirectory("Replay", dir)
+	if err != nil {
+		t.Fatalf("NewDirectory() error = %v", err)
+	}
+
+	// Frames come in name order, timed by their names or modification times
+	for _, want := range []struct {
+		path string
+		time time.Time
+	}{
+		{framePath, captured},
+		{otherPath, modified},
+	} {
+		frame, err := src.Capture(context.Background())
+		if err != nil {
+			t.Fatalf("Capture() error = %v", err)
+		}
+		if frame.Metadata[source.MetadataFile] != want.path {
+			t.Errorf("frame from %q, want %q", frame.Metadata[source.MetadataFile], want.path)
+		}
+		if !frame.Time.Equal(want.time) {
+			t.Errorf("frame %s Time = %v, want %v", want.path, frame.Time, want.time)
+		}
+	}
+
+	if _, err := src.Capture(context.Background()); !errors.Is(err, source.ErrExhausted) {
+		t.Errorf("Capture() after last frame error = %v, want %v", err, source.ErrExhausted)
+	}
+}
+
+func TestDirectoryEmpty(t *testing.T) {
+	if _, err := source.NewDirectory("Replay", t.TempDir()); err == nil {
+		t.Error("NewDirectory() of empty directory succeeded, want error")
+	}
+}
+
+func TestPoll(t *testing.T) {
+	dir := t.TempDir()
+	for i, data := range [][]byte{{0xFF, 0xD8, 1}, {0xFF, 0xD8, 2}} {
+		if err := os.WriteFile(filepath.Join(dir, fmt.Sprintf("frame%d.jpg", i)), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	src, err := source.NewDirectory("Replay", dir)
+	if err != nil {
+		t.Fatalf("NewDirectory() error = %v", err)
+	}
+
+	// Failing to save a frame counts as a missed frame, but doesn't stop
+	// polling the rest
+	var saved [][]byte
+	save := func(frame *source.Frame) error {
+		saved = append(saved, frame.Image)
+		if len(saved) == 1 {
+			return errors.New("disk full")
+		}
+		return nil
+	}
+	err = source.Poll(context.Background(), src, time.Millisecond, time.Second, save)
+	if !errors.Is(err, source.ErrExhausted) {
+		t.Errorf("Poll() error = %v, want %v", err, source.ErrExhausted)
+	}
+	if len(saved) != 2 || !bytes.Equal(saved[1], []byte{0xFF, 0xD8, 2}) {
+		t.Errorf("Poll() saved %v, want both frames", saved)
+	}
+}
+
+// failingSource fails every capture with its error
+type failingSource struct {
+	err error
+}
+
+func (s failingSource) Name() string { return "Broken" }
+
+func (s failingSource) Capture(ctx context.Context) (*source.Frame, error) {
+	return nil, s.err
+}
+
+func TestPollKeepsLastError(t *testing.T) {
+	errBroken := errors.New("camera offline")
+	src := failingSource{err: fmt.Errorf("capture failed: %w", errBroken)}
+	save := func(*source.Frame) error { return nil }
+	err := source.Poll(context.Background(), src, time.Millisecond, time.Second, save)
+	if !errors.Is(err, errBroken) {
+		t.Errorf("Poll() error = %v, want it to wrap %v", err, errBroken)
+	}
+}
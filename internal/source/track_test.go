@@ -0,0 +1,97 @@
+package source
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	pionwebrtc "github.com/pion/webrtc/v4"
+	"github.com/sigh/nest-timelapse/internal/webrtc"
+	"github.com/sigh/nest-timelapse/internal/webrtc/webrtctest"
+)
+
+// trackWriter counts the writes to it, and how many happened at once
+type trackWriter struct {
+	writes, writing, overlaps atomic.Int32
+}
+
+func (w *trackWriter) Write(p []byte) (int, error) {
+	if w.writing.Add(1) > 1 {
+		w.overlaps.Add(1)
+	}
+	defer w.writing.Add(-1)
+	w.writes.Add(1)
+	time.Sleep(time.Millisecond)
+	return len(p), nil
+}
+
+func TestVideoTrackRecorderRecordsFirstTrack(t *testing.T) {
+	camera, err := webrtctest.NewCamera(webrtctest.SampleH264)
+	if err != nil {
+		t.Fatalf("NewCamera() error = %v", err)
+	}
+	defer camera.Close()
+	camera.SetVideoTracks(2)
+
+	pc, err := webrtc.SetupWebRTC(webrtc.Options{HostOnly: true, IncludeLoopback: true})
+	if err != nil {
+		t.Fatalf("SetupWebRTC() error = %v", err)
+	}
+	defer pc.Close()
+	if err := webrtc.SetupTransceivers(pc); err != nil {
+		t.Fatalf("SetupTransceivers() error = %v", err)
+	}
+	// Nest cameras are only offered one video track, so offer another here
+	if _, err := pc.AddTransceiverFromKind(pionwebrtc.RTPCodecTypeVideo,
+		pionwebrtc.RTPTransceiverInit{Direction: pionwebrtc.RTPTransceiverDirectionRecvonly}); err != nil {
+		t.Fatalf("AddTransceiverFromKind() error = %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	var writer trackWriter
+	var done atomic.Int32
+	recorder := &videoTrackRecorder{w: &writer, done: func() { done.Add(1) }}
+	var tracks sync.WaitGroup
+	var videoTracks atomic.Int32
+	pc.OnTrack(func(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+		tracks.Add(1)
+		defer tracks.Done()
+		if webrtc.IsH264Video(track) && videoTracks.Add(1) == 2 {
+			// Both tracks have arrived, so stop once the first has recorded more
+			time.AfterFunc(500*time.Millisecond, cancel)
+		}
+		recorder.record(ctx, track, receiver)
+	})
+
+	offer, err := webrtc.CreateOffer(ctx, pc)
+	if err != nil {
+		t.Fatalf("CreateOffer() error = %v", err)
+	}
+	answerSDP, err := camera.Answer(offer.SDP)
+	if err != nil {
+		t.Fatalf("Answer() error = %v", err)
+	}
+	if err := pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: answerSDP}); err != nil {
+		t.Fatalf("SetRemoteDescription() error = %v", err)
+	}
+	if err := webrtc.WaitForConnection(ctx, pc); err != nil {
+		t.Fatalf("WaitForConnection() error = %v", err)
+	}
+
+	<-ctx.Done()
+	pc.Close()
+	tracks.Wait()
+
+	if n := videoTracks.Load(); n != 2 {
+		t.Fatalf("camera sent %d video tracks, want 2", n)
+	}
+	if n := done.Load(); n != 1 {
+		t.Errorf("done called %d times, want 1", n)
+	}
+	if writer.writes.Load() == 0 || writer.overlaps.Load() > 0 {
+		t.Errorf("%d writes, %d at the same time as another, want writes from one track", writer.writes.Load(), writer.overlaps.Load())
+	}
+}
@@ -0,0 +1,133 @@
+package source
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/sigh/nest-timelapse/internal/video"
+)
+
+// Kinds of source, recorded in the frame metadata
+const (
+	KindRTSP = "rtsp"
+	KindHTTP = "http"
+)
+
+// maxSnapshotSize is the largest snapshot image that is read
+const maxSnapshotSize = 32 << 20
+
+// jpegMagic starts every JPEG image
+var jpegMagic = []byte{0xFF, 0xD8}
+
+// Stream is a camera with a stream URL, such as an RTSP camera, that ffmpeg
+// can read frames from directly
+type Stream struct {
+	name string
+	url  string
+	clip ClipOptions
+	// grabFrame takes a still from the stream URL
+	grabFrame func(ctx context.Context, streamURL string) ([]byte, error)
+	// recordClip records a clip from the stream URL
+	recordClip func(ctx context.Context, streamURL string, duration time.Duration, audio bool, clipPath string) error
+}
+
+// NewStream returns a source that takes frames in the still format from the
+// stream URL with ffmpeg, recording a clip with each frame if clips are enabled
+func NewStream(name, streamURL string, still video.StillFormat, clip ClipOptions) *Stream {
+	return &Stream{
+		name:       name,
+		url:        streamURL,
+		clip:       clip,
+		grabFrame:  still.GrabFrame,
+		recordClip: video.RecordClip,
+	}
+}
+
+// Name returns the camera's name
+func (s *Stream) Name() string {
+	return s.name
+}
+
+// Capture takes a frame from the stream
+func (s *Stream) Capture(ctx context.Context) (*Frame, error) {
+	captureTime := time.Now()
+	image, err := s.grabFrame(ctx, s.url)
+	if err != nil {
+		return nil, fmt.Errorf("failed to extract frame: %w", err)
+	}
+	frame := &Frame{
+		Image: image,
+		Time:  captureTime,
+		Metadata: map[string]string{
+			MetadataSource: KindRTSP,
+			MetadataCamera: s.name,
+		},
+	}
+	frame.addEXIF("")
+	if s.clip.Enabled() {
+		frame.Clip = recordStreamClip(ctx, s.clip, s.url, s.recordClip)
+	}
+	return frame, nil
+}
+
+// Snapshot is a camera that serves its current image as a JPEG over HTTP
+type Snapshot struct {
+	name   string
+	url    string
+	client *http.Client
+}
+
+// NewSnapshot returns a source that downloads JPEG snapshots from the URL. If
+// client is nil, http.DefaultClient is used.
+func NewSnapshot(name, snapshotURL string, client *http.Client) *Snapshot {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &Snapshot{name: name, url: snapshotURL, client: client}
+}
+
+// Name returns the camera's name
+func (s *Snapshot) Name() string {
+	return s.name
+}
+
+// Capture downloads a snapshot from the camera
+func (s *Snapshot) Capture(ctx context.Context) (*Frame, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create snapshot request: %w", err)
+	}
+	captureTime := time.Now()
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download snapshot: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to download snapshot: %s", resp.Status)
+	}
+	image, err := io.ReadAll(io.LimitReader(resp.Body, maxSnapshotSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read snapshot: %w", err)
+	}
+	if len(image) > maxSnapshotSize {
+		return nil, fmt.Errorf("snapshot is larger than %d bytes", maxSnapshotSize)
+	}
+	if !bytes.HasPrefix(image, jpegMagic) {
+		return nil, fmt.Errorf("snapshot isn't a JPEG image (Content-Type %q)", resp.Header.Get("Content-Type"))
+	}
+
+	return &Frame{
+		Image: image,
+		Time:  captureTime,
+		Metadata: map[string]string{
+			MetadataSource: KindHTTP,
+			MetadataCamera: s.name,
+		},
+	}, nil
+}
@@ -0,0 +1,112 @@
+package video
+
+import (
+	"image"
+	"image/draw"
+	"math"
+)
+
+// FrameScore describes how good a decoded frame is as a still
+type FrameScore struct {
+	// Sharpness is the variance of the Laplacian of the frame's brightness.
+	// Blurry frames have few edges, so a low variance.
+	Sharpness float64
+	// BrightnessChange is how much the frame's mean brightness, from 0 to
+	// 255, differs from the frames either side of it. Frames taken while the
+	// camera adjusts its exposure or switches to infrared change a lot.
+	BrightnessChange float64
+	// Score combines the two: sharp frames that are as bright as their
+	// neighbours score highest
+	Score float64
+}
+
+// ScoreFrames scores consecutive frames of a video for how good a still each
+// would make
+func ScoreFrames(frames []image.Image) []FrameScore {
+	grays := make([]*image.Gray, len(frames))
+	brightness := make([]float64, len(frames))
+	for i, frame := range frames {
+		grays[i] = toGray(frame)
+		brightness[i] = meanBrightness(grays[i])
+	}
+
+	scores := make([]FrameScore, len(frames))
+	for i := range frames {
+		var change float64
+		if i > 0 {
+			change += math.Abs(brightness[i] - brightness[i-1])
+		}
+		if i < len(frames)-1 {
+			change += math.Abs(brightness[i] - brightness[i+1])
+		}
+		sharpness := laplacianVariance(grays[i])
+		scores[i] = FrameScore{
+			Sharpness:        sharpness,
+			BrightnessChange: change,
+			Score:            sharpness / (1 + change),
+		}
+	}
+	return scores
+}
+
+// BestFrame returns the index of the frame with the highest score, preferring
+// earlier frames on a tie
+func BestFrame(scores []FrameScore) int {
+	best := 0
+	for i, score := range scores {
+		if score.Score > scores[best].Score {
+			best = i
+		}
+	}
+	return best
+}
+
+// toGray returns the brightness of the image
+func toGray(img image.Image) *image.Gray {
+	if gray, ok := img.(*image.Gray); ok {
+		return gray
+	}
+	bounds := img.Bounds()
+	gray := image.NewGray(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(gray, gray.Bounds(), img, bounds.Min, draw.Src)
+	return gray
+}
+
+// meanBrightness returns the mean brightness of the image, from 0 to 255
+func meanBrightness(gray *image.Gray) float64 {
+	bounds := gray.Bounds()
+	if bounds.Empty() {
+		return 0
+	}
+	var sum float64
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		row := gray.Pix[gray.PixOffset(bounds.Min.X, y):gray.PixOffset(bounds.Max.X, y)]
+		for _, pixel := range row {
+			sum += float64(pixel)
+		}
+	}
+	return sum / float64(bounds.Dx()*bounds.Dy())
+}
+
+// laplacianVariance returns the variance of the image convolved with the 3x3
+// Laplacian kernel, a standard measure of focus. Edge pixels are skipped.
+func laplacianVariance(gray *image.Gray) float64 {
+	bounds := gray.Bounds()
+	if bounds.Dx() < 3 || bounds.Dy() < 3 {
+		return 0
+	}
+	var sum, sumSquares float64
+	var n int
+	for y := bounds.Min.Y + 1; y < bounds.Max.Y-1; y++ {
+		for x := bounds.Min.X + 1; x < bounds.Max.X-1; x++ {
+			i := gray.PixOffset(x, y)
+			laplacian := float64(gray.Pix[i-gray.Stride]) + float64(gray.Pix[i+gray.Stride]) +
+				float64(gray.Pix[i-1]) + float64(gray.Pix[i+1]) - 4*float64(gray.Pix[i])
+			sum += laplacian
+			sumSquares += laplacian * laplacian
+			n++
+		}
+	}
+	mean := sum / float64(n)
+	return sumSquares/float64(n) - mean*mean
+}
@@ -0,0 +1,72 @@
+package video
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+// testFrame returns a grayscale frame of the brightness, with a checkerboard
+// of the contrast on top if sharp
+func testFrame(brightness uint8, contrast uint8, sharp bool) image.Image {
+	img := image.NewGray(image.Rect(0, 0, 32, 32))
+	for y := 0; y < 32; y++ {
+		for x := 0; x < 32; x++ {
+			value := brightness
+			if sharp && (x/2+y/2)%2 == 0 {
+				value += contrast
+			}
+			img.SetGray(x, y, color.Gray{Y: value})
+		}
+	}
+	return img
+}
+
+func TestScoreFramesPrefersSharpFrames(t *testing.T) {
+	frames := []image.Image{
+		testFrame(100, 40, false),
+		testFrame(100, 40, true),
+		testFrame(100, 40, false),
+	}
+	scores := ScoreFrames(frames)
+	if scores[0].Sharpness != 0 {
+		t.Errorf("flat frame Sharpness = %v, want 0", scores[0].Sharpness)
+	}
+	if scores[1].Sharpness <= 0 {
+		t.Errorf("checkerboard Sharpness = %v, want positive", scores[1].Sharpness)
+	}
+	if best := BestFrame(scores); best != 1 {
+		t.Errorf("BestFrame() = %d, want the sharp frame 1 (scores %+v)", best, scores)
+	}
+}
+
+func TestScoreFramesPenalizesBrightnessChanges(t *testing.T) {
+	// The middle frame is as sharp as the others, but brighter, as when the
+	// camera is adjusting its exposure
+	frames := []image.Image{
+		testFrame(60, 40, true),
+		testFrame(160, 40, true),
+		testFrame(60, 40, true),
+	}
+	scores := ScoreFrames(frames)
+	if scores[1].BrightnessChange != 200 {
+		t.Errorf("middle frame BrightnessChange = %v, want 200", scores[1].BrightnessChange)
+	}
+	if scores[1].Score >= scores[0].Score {
+		t.Errorf("middle frame Score = %v, want less than %v", scores[1].Score, scores[0].Score)
+	}
+	if best := BestFrame(scores); best != 0 {
+		t.Errorf("BestFrame() = %d, want 0", best)
+	}
+}
+
+func TestScoreFramesConvertsColorFrames(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 8, 8))
+	for i := range img.Pix {
+		img.Pix[i] = 255
+	}
+	scores := ScoreFrames([]image.Image{img})
+	if len(scores) != 1 || scores[0].Sharpness != 0 || scores[0].BrightnessChange != 0 {
+		t.Errorf("ScoreFrames() = %+v, want one flat frame", scores)
+	}
+}
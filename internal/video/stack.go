@@ -0,0 +1,84 @@
+package video
+
+import (
+	"fmt"
+	"image"
+	"image/draw"
+	"slices"
+)
+
+// Ways of stacking frames
+const (
+	// StackMean averages the frames, which removes the most noise
+	StackMean = "mean"
+	// StackMedian takes the median of the frames, which also removes
+	// anything that only appears in a few of them, such as passing insects
+	StackMedian = "median"
+)
+
+// StackFrames combines consecutive frames of a video pixel by pixel into a
+// single image with less noise, such as the noise in night frames from an
+// infrared camera. The frames must all be the same size. Anything that moves
+// while the frames are taken is blurred.
+func StackFrames(frames []image.Image, method string) (*image.RGBA, error) {
+	if len(frames) == 0 {
+		return nil, fmt.Errorf("no frames to stack")
+	}
+	if method != StackMean && method != StackMedian {
+		return nil, fmt.Errorf("unknown stacking method %q (want %q or %q)", method, StackMean, StackMedian)
+	}
+
+	size := frames[0].Bounds().Size()
+	rgbas := make([]*image.RGBA, len(frames))
+	for i, frame := range frames {
+		if frame.Bounds().Size() != size {
+			return nil, fmt.Errorf("frame %d is %v, want %v like the first frame", i, frame.Bounds().Size(), size)
+		}
+		rgbas[i] = toRGBA(frame)
+	}
+
+	stacked := image.NewRGBA(image.Rectangle{Max: size})
+	values := make([]int, len(frames))
+	for i := range stacked.Pix {
+		for j, rgba := range rgbas {
+			values[j] = int(rgba.Pix[i])
+		}
+		if method == StackMedian {
+			stacked.Pix[i] = uint8(median(values))
+		} else {
+			stacked.Pix[i] = uint8(mean(values))
+		}
+	}
+	return stacked, nil
+}
+
+// toRGBA returns the image as RGBA, with its bounds starting at the origin
+func toRGBA(img image.Image) *image.RGBA {
+	bounds := img.Bounds()
+	if rgba, ok := img.(*image.RGBA); ok && bounds.Min == (image.Point{}) {
+		return rgba
+	}
+	rgba := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(rgba, rgba.Bounds(), img, bounds.Min, draw.Src)
+	return rgba
+}
+
+// mean returns the mean of the values, rounded to the nearest integer
+func mean(values []int) int {
+	sum := 0
+	for _, value := range values {
+		sum += value
+	}
+	return (sum + len(values)/2) / len(values)
+}
+
+// median returns the median of the values, averaging the middle two if there
+// are an even number. The values are sorted in place.
+func median(values []int) int {
+	slices.Sort(values)
+	middle := len(values) / 2
+	if len(values)%2 == 1 {
+		return values[middle]
+	}
+	return (values[middle-1] + values[middle] + 1) / 2
+}
@@ -0,0 +1,63 @@
+package video
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+// solidFrame returns a frame filled with the gray level
+func solidFrame(level uint8) image.Image {
+	img := image.NewGray(image.Rect(0, 0, 4, 4))
+	for i := range img.Pix {
+		img.Pix[i] = level
+	}
+	return img
+}
+
+func TestStackFrames(t *testing.T) {
+	// The last frame has a bright speck of noise that the median ignores
+	frames := []image.Image{solidFrame(10), solidFrame(20), solidFrame(30), solidFrame(40), solidFrame(250)}
+
+	tests := []struct {
+		method string
+		want   uint8
+	}{
+		{StackMean, 70},
+		{StackMedian, 30},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method, func(t *testing.T) {
+			stacked, err := StackFrames(frames, tt.method)
+			if err != nil {
+				t.Fatalf("StackFrames() error = %v", err)
+			}
+			if got := stacked.RGBAAt(2, 2); got != (color.RGBA{tt.want, tt.want, tt.want, 255}) {
+				t.Errorf("stacked pixel = %v, want gray %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStackFramesMedianOfEvenCount(t *testing.T) {
+	stacked, err := StackFrames([]image.Image{solidFrame(10), solidFrame(21), solidFrame(40), solidFrame(200)}, StackMedian)
+	if err != nil {
+		t.Fatalf("StackFrames() error = %v", err)
+	}
+	if got := stacked.RGBAAt(0, 0).R; got != 31 {
+		t.Errorf("stacked pixel = %d, want 31", got)
+	}
+}
+
+func TestStackFramesErrors(t *testing.T) {
+	if _, err := StackFrames(nil, StackMean); err == nil {
+		t.Error("StackFrames() of no frames succeeded, want error")
+	}
+	if _, err := StackFrames([]image.Image{solidFrame(1)}, "mode"); err == nil {
+		t.Error("StackFrames() with unknown method succeeded, want error")
+	}
+	mismatched := []image.Image{solidFrame(1), image.NewGray(image.Rect(0, 0, 8, 8))}
+	if _, err := StackFrames(mismatched, StackMean); err == nil {
+		t.Error("StackFrames() of different sized frames succeeded, want error")
+	}
+}
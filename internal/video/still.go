@@ -0,0 +1,78 @@
+package video
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/sigh/nest-timelapse/internal/frames"
+)
+
+// StillFormat is how stills taken from video are encoded. The zero value
+// encodes JPEGs at ffmpeg's default quality.
+type StillFormat struct {
+	// Format is frames.FormatJPEG, frames.FormatPNG or frames.FormatWebP.
+	// Defaults to JPEG.
+	Format string
+	// Quality is the quality of JPEG and WebP stills, from 1 (the smallest
+	// files) to 100 (the best images). Zero uses ffmpeg's default. PNG is
+	// lossless, so it can't be set.
+	Quality int
+}
+
+// format returns the image format, defaulting to JPEG
+func (s StillFormat) format() string {
+	if s.Format == "" {
+		return frames.FormatJPEG
+	}
+	return s.Format
+}
+
+// Validate checks that the format and quality are supported
+func (s StillFormat) Validate() error {
+	switch s.format() {
+	case frames.FormatJPEG, frames.FormatWebP:
+	case frames.FormatPNG:
+		if s.Quality != 0 {
+			return fmt.Errorf("quality can't be set for lossless %s stills", frames.FormatPNG)
+		}
+	default:
+		return fmt.Errorf("unknown still format %q (want %q, %q or %q)", s.Format, frames.FormatJPEG, frames.FormatPNG, frames.FormatWebP)
+	}
+	if s.Quality < 0 || s.Quality > 100 {
+		return fmt.Errorf("still quality must be between 1 and 100, not %d", s.Quality)
+	}
+	return nil
+}
+
+// outputArgs returns the ffmpeg arguments that write a single still to stdout
+func (s StillFormat) outputArgs() []string {
+	args := []string{"-frames:v", "1", "-f", "image2pipe"}
+	switch s.format() {
+	case frames.FormatPNG:
+		args = append(args, "-c:v", "png")
+	case frames.FormatWebP:
+		args = append(args, "-c:v", "libwebp")
+		if s.Quality != 0 {
+			args = append(args, "-quality", strconv.Itoa(s.Quality))
+		}
+	default:
+		args = append(args, "-c:v", "mjpeg")
+		if s.Quality != 0 {
+			// ffmpeg's JPEG quality scale runs from 31, the worst, to 2
+			args = append(args, "-q:v", strconv.Itoa(2+(100-s.Quality)*29/99))
+		}
+	}
+	return append(args, "pipe:1")
+}
+
+// fromPNG uses ffmpeg to convert a PNG image into a still, encoded the same
+// way as the other stills
+func (s StillFormat) fromPNG(ctx context.Context, pngData []byte) ([]byte, error) {
+	if s.format() == frames.FormatPNG {
+		return pngData, nil
+	}
+	return runFFmpeg(ctx, bytes.NewReader(pngData),
+		append([]string{"-f", "png_pipe", "-i", "pipe:0"}, s.outputArgs()...)...)
+}
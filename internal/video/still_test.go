@@ -0,0 +1,58 @@
+package video
+
+import (
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/sigh/nest-timelapse/internal/frames"
+)
+
+func TestStillFormatOutputArgs(t *testing.T) {
+	tests := []struct {
+		still StillFormat
+		codec []string
+	}{
+		{StillFormat{}, []string{"-c:v", "mjpeg"}},
+		{StillFormat{Format: frames.FormatJPEG, Quality: 100}, []string{"-c:v", "mjpeg", "-q:v", "2"}},
+		{StillFormat{Format: frames.FormatJPEG, Quality: 1}, []string{"-c:v", "mjpeg", "-q:v", "31"}},
+		{StillFormat{Format: frames.FormatPNG}, []string{"-c:v", "png"}},
+		{StillFormat{Format: frames.FormatWebP, Quality: 80}, []string{"-c:v", "libwebp", "-quality", "80"}},
+	}
+	for _, tt := range tests {
+		want := append(append([]string{"-frames:v", "1", "-f", "image2pipe"}, tt.codec...), "pipe:1")
+		if got := tt.still.outputArgs(); !slices.Equal(got, want) {
+			t.Errorf("%+v outputArgs() = %q, want %q", tt.still, got, want)
+		}
+	}
+}
+
+func TestStillFormatValidate(t *testing.T) {
+	for _, valid := range []StillFormat{{}, {Format: frames.FormatJPEG, Quality: 90}, {Format: frames.FormatPNG}, {Format: frames.FormatWebP, Quality: 1}} {
+		if err := valid.Validate(); err != nil {
+			t.Errorf("%+v Validate() error = %v", valid, err)
+		}
+	}
+	for _, invalid := range []StillFormat{{Format: "gif"}, {Format: frames.FormatPNG, Quality: 90}, {Quality: 101}, {Quality: -1}} {
+		if err := invalid.Validate(); err == nil {
+			t.Errorf("%+v Validate() succeeded, want an error", invalid)
+		}
+	}
+}
+
+func TestSaveFrameUsesImageFormat(t *testing.T) {
+	dir := t.TempDir()
+	taken := time.Date(2025, 5, 1, 12, 30, 0, 0, time.UTC)
+	pngData := []byte("\x89PNG\r\n\x1a\nrest")
+	path, err := SaveFrame(pngData, taken, dir)
+	if err != nil {
+		t.Fatalf("SaveFrame() error = %v", err)
+	}
+	if want := filepath.Join(dir, "2025", "05", "01", "nest_camera_frame_20250501_123000.png"); path != want {
+		t.Errorf("SaveFrame() = %s, want %s", path, want)
+	}
+	if _, err := SaveFrame([]byte("GIF89a"), taken, dir); err == nil {
+		t.Error("SaveFrame() saved an unknown image format")
+	}
+}
@@ -4,82 +4,374 @@ import (
 	"bytes"
 	"context"
 	"fmt"
+	"image"
+	"image/png"
 	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"time"
+
+	"github.com/sigh/nest-timelapse/internal/frames"
 )
 
+// Clip container formats
 const (
-	imageFilePrefix    = "nest_camera_frame_"
-	imageFileExtension = "jpg"
-	// timeFormat is used for generating unique filenames
-	timeFormat = "20060102_150405"
+	ClipFormatMP4 = "mp4"
+	ClipFormatMKV = "mkv"
 )
 
-// ExtractFirstFrame uses ffmpeg to extract the first frame from H264 data in memory
-func ExtractFirstFrame(h264Data *bytes.Buffer, outputDir string) error {
-	now := time.Now()
+// AudioFormatOgg is the format audio recordings are saved in
+const AudioFormatOgg = "ogg"
+
+// FramePath returns the path a frame in the image format taken at the time is
+// saved to: outputDir/YYYY/MM/DD/nest_camera_frame_YYYYMMDD_HHMMSS.jpg for a
+// JPEG
+func FramePath(outputDir string, t time.Time, format string) string {
+	return mediaPath(outputDir, t, frames.Extension(format))
+}
+
+// RecordingPath returns the path a clip or audio recording made around a
+// frame taken at the time is saved to, next to the frame with the extension of
+// its format
+func RecordingPath(outputDir string, t time.Time, format string) string {
+	return mediaPath(outputDir, t, format)
+}
 
-	// Create year/month/day directory structure
+// mediaPath returns the path of a file taken at the time with the extension,
+// in the year/month/day directory structure under outputDir
+func mediaPath(outputDir string, t time.Time, extension string) string {
 	dateDir := filepath.Join(outputDir,
-		fmt.Sprintf("%d", now.Year()),
-		fmt.Sprintf("%02d", now.Month()),
-		fmt.Sprintf("%02d", now.Day()),
+		fmt.Sprintf("%d", t.Year()),
+		fmt.Sprintf("%02d", t.Month()),
+		fmt.Sprintf("%02d", t.Day()),
 	)
+	return filepath.Join(dateDir, frames.FileName(t, extension))
+}
+
+// SaveFrame saves a JPEG, PNG or WebP image taken at the time into the
+// year/month/day directory structure under outputDir, with the extension of
+// its format, returning the path it was saved to
+func SaveFrame(image []byte, t time.Time, outputDir string) (string, error) {
+	format, err := frames.DetectFormat(image)
+	if err != nil {
+		return "", fmt.Errorf("failed to save frame: %w", err)
+	}
+	imagePath := FramePath(outputDir, t, format)
 
 	// Create the directory structure if it doesn't exist
-	if err := os.MkdirAll(dateDir, 0755); err != nil {
-		return fmt.Errorf("failed to create directory structure: %w", err)
+	if err := os.MkdirAll(filepath.Dir(imagePath), 0755); err != nil {
+		return "", fmt.Errorf("failed to create directory structure: %w", err)
 	}
 
-	timestamp := now.Format(timeFormat)
-	filename := fmt.Sprintf("%s%s.%s", imageFilePrefix, timestamp, imageFileExtension)
-	imagePath := filepath.Join(dateDir, filename)
+	if err := os.WriteFile(imagePath, image, 0644); err != nil {
+		return "", fmt.Errorf("failed to save frame: %w", err)
+	}
+	return imagePath, nil
+}
+
+// runFFmpeg runs ffmpeg with the arguments, reading stdin if it isn't nil,
+// and returns what it writes to stdout. ffmpeg is killed if the context is
+// done before it finishes.
+func runFFmpeg(ctx context.Context, stdin io.Reader, args ...string) ([]byte, error) {
+	stdout, _, err := runFFmpegOutput(ctx, stdin, args...)
+	return stdout, err
+}
 
-	// Prepare ffmpeg command to read from stdin
-	cmd := exec.CommandContext(context.Background(), "ffmpeg",
+// runFFmpegOutput is runFFmpeg, also returning what ffmpeg writes to stderr,
+// which is where its filters report what they measure
+func runFFmpegOutput(ctx context.Context, stdin io.Reader, args ...string) ([]byte, []byte, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "ffmpeg", args...)
+	cmd.Stdin = stdin
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return nil, nil, fmt.Errorf("ffmpeg failed: %w\nffmpeg output: %s", err, stderr.String())
+	}
+	return stdout.Bytes(), stderr.Bytes(), nil
+}
+
+// DecodeFirstFrame uses ffmpeg to decode the first frame of H264 data into a
+// still. ffmpeg is killed if the context is done before it finishes.
+func (s StillFormat) DecodeFirstFrame(ctx context.Context, h264Data io.Reader) ([]byte, error) {
+	args := append([]string{
 		"-f", "h264", // Input format is H264
 		"-i", "pipe:0", // Read from stdin
-		"-update", "1",
-		"-frames:v", "1",
-		imagePath,
-	)
+	}, s.outputArgs()...)
+	return runFFmpeg(ctx, h264Data, args...)
+}
 
-	stdout, err := cmd.StdoutPipe()
+// Selection is the frame picked from a video by DecodeBestFrame
+type Selection struct {
+	// Image is the encoded frame
+	Image []byte
+	// Index is the frame's position among the frames decoded, from 0
+	Index int
+	// Decoded is how many frames were decoded to choose from
+	Decoded int
+	// Score is how the frame scored
+	Score FrameScore
+}
+
+// DecodeBestFrame uses ffmpeg to decode up to the given number of frames from
+// the start of the H264 data, and returns the one that makes the best still.
+// Frames are scored by ScoreFrames. ffmpeg is killed if the context is done
+// before it finishes.
+func (s StillFormat) DecodeBestFrame(ctx context.Context, h264Data io.Reader, frames int) (*Selection, error) {
+	images, encoded, err := decodeFrames(ctx, h264Data, frames)
+	if err != nil {
+		return nil, err
+	}
+
+	scores := ScoreFrames(images)
+	best := BestFrame(scores)
+	still, err := s.fromPNG(ctx, encoded[best])
+	if err != nil {
+		return nil, err
+	}
+	return &Selection{Image: still, Index: best, Decoded: len(images), Score: scores[best]}, nil
+}
+
+// DecodeStackedFrame uses ffmpeg to decode up to the given number of frames
+// from the start of the H264 data, and stacks them with StackFrames into a
+// single still with less noise than any one of them. It returns the still and
+// how many frames were stacked. ffmpeg is killed if the context is done before
+// it finishes.
+func (s StillFormat) DecodeStackedFrame(ctx context.Context, h264Data io.Reader, frames int, method string) ([]byte, int, error) {
+	images, _, err := decodeFrames(ctx, h264Data, frames)
 	if err != nil {
-		return fmt.Errorf("failed to create stdout pipe: %w", err)
+		return nil, 0, err
 	}
-	stderr, err := cmd.StderrPipe()
+
+	stacked, err := StackFrames(images, method)
 	if err != nil {
-		return fmt.Errorf("failed to create stderr pipe: %w", err)
+		return nil, 0, err
+	}
+	var encoded bytes.Buffer
+	if err := png.Encode(&encoded, stacked); err != nil {
+		return nil, 0, fmt.Errorf("failed to encode stacked frame: %w", err)
 	}
-	stdin, err := cmd.StdinPipe()
+	still, err := s.fromPNG(ctx, encoded.Bytes())
 	if err != nil {
-		return fmt.Errorf("failed to create stdin pipe: %w", err)
+		return nil, 0, err
 	}
+	return still, len(images), nil
+}
 
-	if err := cmd.Start(); err != nil {
-		return fmt.Errorf("failed to start ffmpeg: %w", err)
+// decodeFrames uses ffmpeg to decode up to the given number of frames from
+// the start of the H264 data, returning each frame and its PNG encoding
+func decodeFrames(ctx context.Context, h264Data io.Reader, frames int) ([]image.Image, [][]byte, error) {
+	// Have ffmpeg write the frames as a stream of PNG images, which are
+	// lossless and can be decoded one after another
+	output, err := runFFmpeg(ctx, h264Data,
+		"-f", "h264",
+		"-i", "pipe:0",
+		"-frames:v", strconv.Itoa(frames),
+		"-f", "image2pipe",
+		"-c:v", "png",
+		"pipe:1",
+	)
+	if err != nil {
+		return nil, nil, err
 	}
 
-	if _, err := io.Copy(stdin, h264Data); err != nil {
-		return fmt.Errorf("failed to write to ffmpeg: %w", err)
+	var images []image.Image
+	var encoded [][]byte
+	reader := bytes.NewReader(output)
+	for reader.Len() > 0 {
+		start := len(output) - reader.Len()
+		img, err := png.Decode(reader)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to decode frame %d: %w", len(images), err)
+		}
+		images = append(images, img)
+		encoded = append(encoded, output[start:len(output)-reader.Len()])
 	}
-	if err := stdin.Close(); err != nil {
-		return fmt.Errorf("failed to close stdin: %w", err)
+	if len(images) == 0 {
+		return nil, nil, fmt.Errorf("no frames decoded")
 	}
+	return images, encoded, nil
+}
+
+// GrabFrame uses ffmpeg to take a still from a live stream, such as an RTSP
+// URL. ffmpeg is killed if the context is done before it finishes.
+func (s StillFormat) GrabFrame(ctx context.Context, streamURL string) ([]byte, error) {
+	var args []string
+	if strings.HasPrefix(streamURL, "rtsp") {
+		// Nest cameras only stream RTSP over TCP
+		args = append(args, "-rtsp_transport", "tcp")
+	}
+	args = append(args, "-i", streamURL)
+	return runFFmpeg(ctx, nil, append(args, s.outputArgs()...)...)
+}
 
-	output, err := io.ReadAll(io.MultiReader(stdout, stderr))
+// SaveRecording moves a clip or audio recording made around a frame taken at
+// the time from recordingPath into the year/month/day directory structure
+// under outputDir, next to the frame, returning the path it was saved to. The
+// recording keeps the extension of recordingPath.
+func SaveRecording(recordingPath string, t time.Time, outputDir string) (string, error) {
+	savedPath := RecordingPath(outputDir, t, strings.TrimPrefix(filepath.Ext(recordingPath), "."))
+	if err := os.MkdirAll(filepath.Dir(savedPath), 0755); err != nil {
+		return "", fmt.Errorf("failed to create directory structure: %w", err)
+	}
+
+	// Recordings are made in the temporary directory, which may be on another
+	// filesystem, so fall back to copying
+	if err := os.Rename(recordingPath, savedPath); err == nil {
+		return savedPath, nil
+	}
+	if err := copyFile(recordingPath, savedPath); err != nil {
+		return "", fmt.Errorf("failed to save recording: %w", err)
+	}
+	if err := os.Remove(recordingPath); err != nil {
+		fmt.Printf("Warning: failed to remove temporary recording: %v\n", err)
+	}
+	return savedPath, nil
+}
+
+// copyFile copies the file at src to dst
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
 	if err != nil {
-		return fmt.Errorf("failed to read ffmpeg output: %w", err)
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
 	}
+	return out.Close()
+}
+
+// ClipInput is recorded video, and optionally audio, to remux into a clip
+type ClipInput struct {
+	// H264Path is the raw H264 video
+	H264Path string
+	// FrameRate is the rate the video was recorded at. Raw H264 has no
+	// timestamps, so this times the frames in the clip.
+	FrameRate float64
+	// AudioPath, if not empty, is Ogg Opus audio recorded with the video
+	AudioPath string
+}
 
-	if err := cmd.Wait(); err != nil {
-		return fmt.Errorf("failed to extract frame: %w\nffmpeg output: %s", err, string(output))
+// RemuxClip uses ffmpeg to put the recorded video and audio into a clip,
+// without re-encoding them. The container format is taken from the extension
+// of clipPath. ffmpeg is killed if the context is done before it finishes.
+func RemuxClip(ctx context.Context, input ClipInput, clipPath string) error {
+	args := []string{
+		"-y",
+		"-f", "h264",
+		"-framerate", strconv.FormatFloat(input.FrameRate, 'f', 3, 64),
+		"-i", input.H264Path,
 	}
+	if input.AudioPath != "" {
+		args = append(args, "-i", input.AudioPath)
+	}
+	args = append(args, "-c", "copy")
+	args = append(args, clipOutputArgs(clipPath)...)
+	if _, err := runFFmpeg(ctx, nil, args...); err != nil {
+		return fmt.Errorf("failed to remux clip: %w", err)
+	}
+	return nil
+}
 
-	fmt.Printf("Extracted first frame to: %s\n", imagePath)
+// RecordClip uses ffmpeg to record a clip of the duration from a live stream,
+// such as an RTSP URL, without re-encoding it. Audio is dropped unless audio
+// is true. The container format is taken from the extension of clipPath.
+// ffmpeg is killed if the context is done before it finishes.
+func RecordClip(ctx context.Context, streamURL string, duration time.Duration, audio bool, clipPath string) error {
+	args := []string{"-y"}
+	if strings.HasPrefix(streamURL, "rtsp") {
+		// Nest cameras only stream RTSP over TCP
+		args = append(args, "-rtsp_transport", "tcp")
+	}
+	args = append(args,
+		"-i", streamURL,
+		"-t", strconv.FormatFloat(duration.Seconds(), 'f', 3, 64),
+		"-c", "copy",
+	)
+	if !audio {
+		args = append(args, "-an")
+	}
+	args = append(args, clipOutputArgs(clipPath)...)
+	if _, err := runFFmpeg(ctx, nil, args...); err != nil {
+		return fmt.Errorf("failed to record clip: %w", err)
+	}
 	return nil
 }
+
+// clipOutputArgs are the ffmpeg arguments that write a clip to clipPath
+func clipOutputArgs(clipPath string) []string {
+	if strings.HasSuffix(clipPath, "."+ClipFormatMP4) {
+		// Let players start the clip before it has fully downloaded
+		return []string{"-movflags", "+faststart", clipPath}
+	}
+	return []string{clipPath}
+}
+
+// Loudness is how loud some audio is, in dB relative to full scale
+type Loudness struct {
+	// Mean is the mean volume
+	Mean float64
+	// Max is the volume of the loudest sample
+	Max float64
+}
+
+// MeasureLoudness uses ffmpeg to measure the loudness of an audio file.
+// ffmpeg is killed if the context is done before it finishes.
+func MeasureLoudness(ctx context.Context, audioPath string) (Loudness, error) {
+	_, output, err := runFFmpegOutput(ctx, nil,
+		"-i", audioPath,
+		"-vn",
+		"-af", "volumedetect",
+		"-f", "null", "-",
+	)
+	if err != nil {
+		return Loudness{}, fmt.Errorf("failed to measure loudness: %w", err)
+	}
+	return parseLoudness(output)
+}
+
+// parseLoudness parses the volumes reported by ffmpeg's volumedetect filter,
+// in lines such as "[Parsed_volumedetect_0 @ 0x1] mean_volume: -40.5 dB"
+func parseLoudness(output []byte) (Loudness, error) {
+	var loudness Loudness
+	var foundMean, foundMax bool
+	for _, line := range strings.Split(string(output), "\n") {
+		_, measurement, ok := strings.Cut(line, "] ")
+		if !ok {
+			continue
+		}
+		name, value, ok := strings.Cut(measurement, ": ")
+		if !ok {
+			continue
+		}
+		var dest *float64
+		switch name {
+		case "mean_volume":
+			dest, foundMean = &loudness.Mean, true
+		case "max_volume":
+			dest, foundMax = &loudness.Max, true
+		default:
+			continue
+		}
+		volume, err := strconv.ParseFloat(strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(value), "dB")), 64)
+		if err != nil {
+			return Loudness{}, fmt.Errorf("invalid %s %q: %w", name, value, err)
+		}
+		*dest = volume
+	}
+	if !foundMean || !foundMax {
+		return Loudness{}, fmt.Errorf("ffmpeg didn't report the volume; the audio may be empty")
+	}
+	return loudness, nil
+}
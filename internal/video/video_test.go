@@ -0,0 +1,50 @@
+package video
+
+import "testing"
+
+func TestParseLoudness(t *testing.T) {
+	tests := []struct {
+		name    string
+		output  string
+		want    Loudness
+		wantErr bool
+	}{
+		{
+			name: "volumes",
+			output: "Input #0, ogg, from 'audio.ogg':\n" +
+				"[Parsed_volumedetect_0 @ 0x5581] n_samples: 960000\n" +
+				"[Parsed_volumedetect_0 @ 0x5581] mean_volume: -42.7 dB\n" +
+				"[Parsed_volumedetect_0 @ 0x5581] max_volume: -12.0 dB\n" +
+				"[Parsed_volumedetect_0 @ 0x5581] histogram_12db: 4\n",
+			want: Loudness{Mean: -42.7, Max: -12},
+		},
+		{
+			name:    "no audio",
+			output:  "Output file #0 does not contain any stream\n",
+			wantErr: true,
+		},
+		{
+			name:    "invalid volume",
+			output:  "[Parsed_volumedetect_0 @ 0x1] mean_volume: loud dB\n[Parsed_volumedetect_0 @ 0x1] max_volume: 0.0 dB\n",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseLoudness([]byte(tt.output))
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("parseLoudness() = %+v, want error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseLoudness() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("parseLoudness() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
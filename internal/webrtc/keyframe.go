@@ -0,0 +1,87 @@
+package webrtc
+
+import (
+	"github.com/pion/rtp"
+)
+
+// H264 NAL unit types (RFC 6184)
+const (
+	naluTypeIDR     = 5
+	naluTypeSPS     = 7
+	naluTypePPS     = 8
+	naluTypeSTAPA   = 24
+	naluTypeFUA     = 28
+	naluTypeBitmask = 0x1F
+	fuStartBitmask  = 0x80
+)
+
+// keyframeDetector watches H264 RTP packets for the first complete IDR frame
+// that follows an SPS and PPS. Once seen, the stream contains everything
+// needed to decode a frame.
+type keyframeDetector struct {
+	sawSPS bool
+	sawPPS bool
+	inIDR  bool
+	done   bool
+}
+
+// observe inspects a packet and reports whether it completes the first
+// decodable keyframe. It returns true at most once.
+func (d *keyframeDetector) observe(packet *rtp.Packet) bool {
+	if d.done {
+		return false
+	}
+
+	for _, naluType := range packetNALUTypes(packet.Payload) {
+		switch naluType {
+		case naluTypeSPS:
+			d.sawSPS = true
+		case naluTypePPS:
+			d.sawPPS = true
+		case naluTypeIDR:
+			if d.sawSPS && d.sawPPS {
+				d.inIDR = true
+			}
+		}
+	}
+
+	// The marker bit is set on the last packet of an access unit, so the IDR
+	// frame is complete once we see it
+	if d.inIDR && packet.Marker {
+		d.done = true
+	}
+	return d.done
+}
+
+// packetNALUTypes returns the types of the NAL units that start in the RTP
+// payload. Continuation fragments of FU-A units are ignored.
+func packetNALUTypes(payload []byte) []byte {
+	if len(payload) == 0 {
+		return nil
+	}
+
+	naluType := payload[0] & naluTypeBitmask
+	switch {
+	case naluType >= 1 && naluType <= 23:
+		return []byte{naluType}
+	case naluType == naluTypeSTAPA:
+		// STAP-A: a sequence of 16 bit size prefixed NAL units
+		var types []byte
+		for offset := 1; offset+2 < len(payload); {
+			size := int(payload[offset])<<8 | int(payload[offset+1])
+			offset += 2
+			if size == 0 || offset+size > len(payload) {
+				break
+			}
+			types = append(types, payload[offset]&naluTypeBitmask)
+			offset += size
+		}
+		return types
+	case naluType == naluTypeFUA:
+		if len(payload) < 2 || payload[1]&fuStartBitmask == 0 {
+			return nil
+		}
+		return []byte{payload[1] & naluTypeBitmask}
+	}
+	return nil
+}
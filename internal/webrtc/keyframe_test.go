@@ -0,0 +1,85 @@
+package webrtc
+
+import (
+	"testing"
+
+	"github.com/pion/rtp"
+)
+
+func packet(marker bool, payload ...byte) *rtp.Packet {
+	return &rtp.Packet{Header: rtp.Header{Marker: marker}, Payload: payload}
+}
+
+func TestPacketNALUTypes(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload []byte
+		want    []byte
+	}{
+		{"empty", nil, nil},
+		{"single SPS", []byte{0x67, 0x42}, []byte{naluTypeSPS}},
+		{"single non-IDR slice", []byte{0x41, 0x9a}, []byte{1}},
+		{
+			name:    "STAP-A with SPS and PPS",
+			payload: []byte{0x78, 0x00, 0x02, 0x67, 0x42, 0x00, 0x02, 0x68, 0xce},
+			want:    []byte{naluTypeSPS, naluTypePPS},
+		},
+		{
+			name:    "STAP-A truncated",
+			payload: []byte{0x78, 0x00, 0x02, 0x67, 0x42, 0x00, 0x09, 0x68},
+			want:    []byte{naluTypeSPS},
+		},
+		{"FU-A start of IDR", []byte{0x7c, 0x85, 0x88}, []byte{naluTypeIDR}},
+		{"FU-A continuation of IDR", []byte{0x7c, 0x05, 0x88}, nil},
+		{"FU-A missing header", []byte{0x7c}, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := packetNALUTypes(tt.payload)
+			if string(got) != string(tt.want) {
+				t.Errorf("packetNALUTypes() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestKeyframeDetector(t *testing.T) {
+	sps := packet(false, 0x67, 0x42)
+	pps := packet(false, 0x68, 0xce)
+	idrStart := packet(false, 0x7c, 0x85, 0x88)
+	idrMiddle := packet(false, 0x7c, 0x05, 0x88)
+	idrEnd := packet(true, 0x7c, 0x45, 0x88)
+	slice := packet(true, 0x41, 0x9a)
+
+	tests := []struct {
+		name    string
+		packets []*rtp.Packet
+		want    int // index of the packet completing the keyframe, or -1
+	}{
+		{"complete keyframe", []*rtp.Packet{sps, pps, idrStart, idrMiddle, idrEnd, slice}, 4},
+		{"single packet IDR", []*rtp.Packet{sps, pps, packet(true, 0x65, 0x88)}, 2},
+		{"IDR without parameter sets", []*rtp.Packet{idrStart, idrEnd, slice}, -1},
+		{"IDR without PPS", []*rtp.Packet{sps, idrStart, idrEnd}, -1},
+		{"incomplete IDR", []*rtp.Packet{sps, pps, idrStart, idrMiddle}, -1},
+		{"only non-IDR slices", []*rtp.Packet{sps, pps, slice, slice}, -1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			detector := &keyframeDetector{}
+			got := -1
+			for i, p := range tt.packets {
+				if detector.observe(p) {
+					if got != -1 {
+						t.Fatalf("observe() returned true more than once")
+					}
+					got = i
+				}
+			}
+			if got != tt.want {
+				t.Errorf("keyframe completed at packet %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,134 @@
+package webrtc
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/pion/rtcp"
+	pionwebrtc "github.com/pion/webrtc/v4"
+	"github.com/pion/webrtc/v4/pkg/media/h264writer"
+)
+
+// maxKeyframeSize is the largest keyframe that is buffered. Anything larger
+// means the stream isn't what we expect, so the keyframe is dropped.
+const maxKeyframeSize = 4 << 20
+
+// errNotRecording is returned when a keyframe is requested before a track is
+// being recorded
+var errNotRecording = errors.New("no video track is being recorded")
+
+// LiveVideo records a live H264 track, keeping its most recent keyframe so
+// that frames can be extracted from a long-running stream on demand
+type LiveVideo struct {
+	conn *Connection
+
+	mu       sync.Mutex
+	ssrc     uint32
+	keyframe []byte
+	// updated is closed and replaced whenever a new keyframe arrives
+	updated chan struct{}
+}
+
+// NewLiveVideo returns a LiveVideo for a track received on the connection
+func NewLiveVideo(conn *Connection) *LiveVideo {
+	return &LiveVideo{conn: conn, updated: make(chan struct{})}
+}
+
+// Record reads the H264 track until it ends or the context is done, keeping
+// the most recent complete keyframe along with its SPS and PPS
+func (v *LiveVideo) Record(ctx context.Context, track *TrackRemote) error {
+	if codec := track.Codec().MimeType; codec != pionwebrtc.MimeTypeH264 {
+		return fmt.Errorf("unsupported video codec %s", codec)
+	}
+
+	v.mu.Lock()
+	v.ssrc = uint32(track.SSRC())
+	v.mu.Unlock()
+
+	// Unblock ReadRTP when the context is done
+	stop := context.AfterFunc(ctx, func() {
+		_ = track.SetReadDeadline(time.Now())
+	})
+	defer stop()
+
+	var buffer *bytes.Buffer
+	var writer *h264writer.H264Writer
+	var detector keyframeDetector
+	for {
+		packet, _, err := track.ReadRTP()
+		if err == io.EOF {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return fmt.Errorf("stopped reading track: %w", ctx.Err())
+		}
+		if err != nil {
+			return fmt.Errorf("track ended: %w", err)
+		}
+
+		// Keyframes start with their SPS, so start buffering afresh
+		if slices.Contains(packetNALUTypes(packet.Payload), naluTypeSPS) {
+			buffer = &bytes.Buffer{}
+			writer = h264writer.NewWith(buffer)
+			detector = keyframeDetector{}
+		}
+		if writer == nil {
+			continue
+		}
+
+		if err := writer.WriteRTP(packet); err != nil {
+			return fmt.Errorf("failed to write RTP packet: %w", err)
+		}
+		if detector.observe(packet) {
+			v.publish(buffer.Bytes())
+			writer = nil
+		} else if buffer.Len() > maxKeyframeSize {
+			fmt.Println("Dropping oversized keyframe")
+			writer = nil
+		}
+	}
+}
+
+// publish makes the keyframe available and wakes up anyone waiting for it
+func (v *LiveVideo) publish(keyframe []byte) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.keyframe = keyframe
+	close(v.updated)
+	v.updated = make(chan struct{})
+}
+
+// Keyframe asks the camera for a keyframe and returns it once it arrives, as
+// H264 data that decodes to a single frame. It waits until the context is
+// done for the keyframe.
+func (v *LiveVideo) Keyframe(ctx context.Context) (*bytes.Buffer, error) {
+	v.mu.Lock()
+	ssrc, updated := v.ssrc, v.updated
+	v.mu.Unlock()
+	if ssrc == 0 {
+		return nil, errNotRecording
+	}
+
+	// A picture loss indication makes the camera send a keyframe, rather than
+	// waiting for the next one it would send anyway
+	pli := &rtcp.PictureLossIndication{MediaSSRC: ssrc}
+	if err := v.conn.WriteRTCP([]rtcp.Packet{pli}); err != nil {
+		return nil, fmt.Errorf("failed to request keyframe: %w", err)
+	}
+
+	select {
+	case <-updated:
+	case <-ctx.Done():
+		return nil, fmt.Errorf("no keyframe received: %w", ctx.Err())
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return bytes.NewBuffer(slices.Clone(v.keyframe)), nil
+}
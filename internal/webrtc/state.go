@@ -0,0 +1,174 @@
+package webrtc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/pion/interceptor/pkg/stats"
+	pionwebrtc "github.com/pion/webrtc/v4"
+)
+
+// PeerConnectionState is an alias for pionwebrtc.PeerConnectionState
+type PeerConnectionState = pionwebrtc.PeerConnectionState
+
+// Errors describing why a connection failed
+var (
+	// ErrICEFailed means no working network path to the peer was found
+	ErrICEFailed = errors.New("ICE connectivity checks failed")
+	// ErrDTLSFailed means the network path worked but the DTLS handshake didn't
+	ErrDTLSFailed = errors.New("DTLS handshake failed")
+	// ErrConnectionFailed means the connection failed for any other reason
+	ErrConnectionFailed = errors.New("connection failed")
+	// ErrConnectionClosed means the connection was closed
+	ErrConnectionClosed = errors.New("connection closed")
+)
+
+// Connection is a peer connection with a connection state dispatcher. Unlike
+// with PeerConnection.OnConnectionStateChange, any number of handlers can watch
+// for state changes with AddStateHandler, and State records the reason for a
+// failure. The connection's own state change handler is used by the dispatcher,
+// so it must not be replaced.
+type Connection struct {
+	*PeerConnection
+
+	mu        sync.Mutex
+	state     PeerConnectionState
+	iceState  pionwebrtc.ICEConnectionState
+	dtlsState pionwebrtc.DTLSTransportState
+	err       error
+	nextID    int
+	handlers  map[int]func(PeerConnectionState)
+
+	// streamStats reports the stats of the received streams. It is nil for
+	// connections that weren't set up by SetupWebRTC.
+	streamStats stats.Getter
+}
+
+// newConnection wraps the peer connection and takes ownership of its state
+// change handlers
+func newConnection(pc *PeerConnection) *Connection {
+	c := &Connection{
+		PeerConnection: pc,
+		state:          pc.ConnectionState(),
+		iceState:       pc.ICEConnectionState(),
+		handlers:       make(map[int]func(PeerConnectionState)),
+	}
+
+	pc.OnICEConnectionStateChange(func(state pionwebrtc.ICEConnectionState) {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.iceState = state
+	})
+	pc.SCTP().Transport().OnStateChange(func(state pionwebrtc.DTLSTransportState) {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.dtlsState = state
+	})
+	pc.OnConnectionStateChange(func(PeerConnectionState) {
+		c.update()
+	})
+
+	return c
+}
+
+// update records the current connection state and notifies the handlers if it
+// has changed. pion calls state change handlers on separate goroutines, so the
+// state passed to them may arrive out of order; reading the current state
+// from the peer connection instead keeps the dispatched states consistent.
+func (c *Connection) update() {
+	c.mu.Lock()
+	state := c.ConnectionState()
+	if state == c.state {
+		c.mu.Unlock()
+		return
+	}
+	c.state = state
+
+	if c.err == nil {
+		switch state {
+		case pionwebrtc.PeerConnectionStateFailed:
+			c.err = c.failureReason()
+			fmt.Printf("WebRTC connection failed: %v\n", c.err)
+		case pionwebrtc.PeerConnectionStateClosed:
+			c.err = ErrConnectionClosed
+		}
+	}
+
+	handlers := make([]func(PeerConnectionState), 0, len(c.handlers))
+	for _, handler := range c.handlers {
+		handlers = append(handlers, handler)
+	}
+	c.mu.Unlock()
+
+	for _, handler := range handlers {
+		handler(state)
+	}
+}
+
+// failureReason works out why the connection failed from the ICE and DTLS
+// transport states. The caller must hold the lock.
+func (c *Connection) failureReason() error {
+	switch {
+	case c.dtlsState == pionwebrtc.DTLSTransportStateFailed:
+		return ErrDTLSFailed
+	case c.iceState == pionwebrtc.ICEConnectionStateFailed:
+		return fmt.Errorf("%w: no candidate pair succeeded (check STUN/TURN servers and firewall)", ErrICEFailed)
+	default:
+		return fmt.Errorf("%w: ICE state %s, DTLS state %s", ErrConnectionFailed, c.iceState, c.dtlsState)
+	}
+}
+
+// AddStateHandler adds a handler that is called whenever the connection state
+// changes. Unlike PeerConnection.OnConnectionStateChange it doesn't replace
+// other handlers. Handlers must not block. Returns a function that removes the
+// handler.
+func (c *Connection) AddStateHandler(f func(PeerConnectionState)) (remove func()) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	id := c.nextID
+	c.nextID++
+	c.handlers[id] = f
+
+	return func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		delete(c.handlers, id)
+	}
+}
+
+// State returns the current connection state and, if the connection has
+// failed or closed, the reason why
+func (c *Connection) State() (PeerConnectionState, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.state, c.err
+}
+
+// waitForState blocks until done reports that the wait is over for the
+// current state, or the context is cancelled
+func (c *Connection) waitForState(ctx context.Context, done func(PeerConnectionState, error) (bool, error)) error {
+	// Subscribe before checking the current state so that no change is missed
+	changed := make(chan struct{}, 1)
+	remove := c.AddStateHandler(func(PeerConnectionState) {
+		select {
+		case changed <- struct{}{}:
+		default:
+		}
+	})
+	defer remove()
+
+	for {
+		if finished, err := done(c.State()); finished {
+			return err
+		}
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package webrtc
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	pionwebrtc "github.com/pion/webrtc/v4"
+)
+
+func TestConnectionStateHandlers(t *testing.T) {
+	conn, err := SetupWebRTC(Options{})
+	if err != nil {
+		t.Fatalf("SetupWebRTC(Options{}) error = %v", err)
+	}
+
+	// Every handler should see the close, not just the last one registered
+	first := make(chan PeerConnectionState, 1)
+	second := make(chan PeerConnectionState, 1)
+	conn.AddStateHandler(func(state PeerConnectionState) { first <- state })
+	conn.AddStateHandler(func(state PeerConnectionState) { second <- state })
+	removed := make(chan PeerConnectionState, 1)
+	remove := conn.AddStateHandler(func(state PeerConnectionState) { removed <- state })
+	remove()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := WaitForConnectionClose(ctx, conn); err != nil {
+		t.Fatalf("WaitForConnectionClose() error = %v", err)
+	}
+
+	for _, ch := range []chan PeerConnectionState{first, second} {
+		if state := <-ch; state != pionwebrtc.PeerConnectionStateClosed {
+			t.Errorf("handler got state %s, want closed", state)
+		}
+	}
+	select {
+	case state := <-removed:
+		t.Errorf("removed handler got state %s", state)
+	default:
+	}
+
+	if err := WaitForConnection(ctx, conn); !errors.Is(err, ErrConnectionClosed) {
+		t.Errorf("WaitForConnection() error = %v, want %v", err, ErrConnectionClosed)
+	}
+}
+
+func TestWaitForConnectionContext(t *testing.T) {
+	conn, err := SetupWebRTC(Options{})
+	if err != nil {
+		t.Fatalf("SetupWebRTC(Options{}) error = %v", err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := WaitForConnection(ctx, conn); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("WaitForConnection() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
@@ -0,0 +1,58 @@
+package webrtc
+
+import (
+	"strings"
+	"time"
+
+	pionwebrtc "github.com/pion/webrtc/v4"
+)
+
+// Stats describes how well a connection's video arrived
+type Stats struct {
+	// Codec is the video codec, e.g. "H264", or empty if no video arrived
+	Codec string
+	// RoundTripTime is the latest round trip time to the camera, measured by
+	// ICE on the connection's selected candidate pair
+	RoundTripTime time.Duration
+	// PacketsReceived and PacketsLost count the video's RTP packets
+	PacketsReceived uint64
+	PacketsLost     int64
+	// Jitter is the variation in the video packets' arrival times
+	Jitter time.Duration
+}
+
+// Stats returns the connection's current stats. It must be called before the
+// connection is closed.
+func (c *Connection) Stats() Stats {
+	var s Stats
+	for _, report := range c.GetStats() {
+		if pair, ok := report.(pionwebrtc.ICECandidatePairStats); ok && pair.Nominated {
+			s.RoundTripTime = time.Duration(pair.CurrentRoundTripTime * float64(time.Second))
+		}
+	}
+
+	for _, receiver := range c.GetReceivers() {
+		for _, track := range receiver.Tracks() {
+			if track.Kind() != pionwebrtc.RTPCodecTypeVideo {
+				continue
+			}
+			codec := track.Codec()
+			s.Codec = strings.TrimPrefix(codec.MimeType, "video/")
+			if c.streamStats == nil {
+				continue
+			}
+			streamStats := c.streamStats.Get(uint32(track.SSRC()))
+			if streamStats == nil {
+				continue
+			}
+			inbound := streamStats.InboundRTPStreamStats
+			s.PacketsReceived += inbound.PacketsReceived
+			s.PacketsLost += inbound.PacketsLost
+			// Jitter is measured in units of the codec's clock
+			if codec.ClockRate > 0 {
+				s.Jitter = max(s.Jitter, time.Duration(inbound.Jitter/float64(codec.ClockRate)*float64(time.Second)))
+			}
+		}
+	}
+	return s
+}
@@ -1,15 +1,18 @@
 package webrtc
 
 import (
-	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"slices"
 	"time"
 
 	"github.com/pion/interceptor"
+	"github.com/pion/interceptor/pkg/stats"
 	pionwebrtc "github.com/pion/webrtc/v4"
 	"github.com/pion/webrtc/v4/pkg/media/h264writer"
+	"github.com/pion/webrtc/v4/pkg/media/oggwriter"
 )
 
 // SessionDescription is an alias for pionwebrtc.SessionDescription
@@ -27,9 +30,104 @@ type RTPReceiver = pionwebrtc.RTPReceiver
 // PeerConnection is an alias for pionwebrtc.PeerConnection
 type PeerConnection = pionwebrtc.PeerConnection
 
+// DefaultSTUNServer is the STUN server used unless others are configured
+const DefaultSTUNServer = "stun:stun.l.google.com:19302"
+
+// IP families that ICE can be restricted to
+const (
+	IPFamilyIPv4 = "ipv4"
+	IPFamilyIPv6 = "ipv6"
+)
+
+// ICEServer is a STUN or TURN server. TURN servers need credentials.
+type ICEServer struct {
+	URLs       []string `json:"urls"`
+	Username   string   `json:"username,omitempty"`
+	Credential string   `json:"credential,omitempty"`
+}
+
+// Options configures how the peer connection gathers ICE candidates
+type Options struct {
+	// ICEServers are the STUN and TURN servers to use
+	ICEServers []ICEServer
+	// HostOnly gathers only host candidates, ignoring ICEServers. This works
+	// when the camera can reach this host directly, and in tests.
+	HostOnly bool
+	// Interfaces restricts candidates to the named network interfaces. If
+	// empty, all interfaces are used.
+	Interfaces []string
+	// IPFamily restricts candidates to IPFamilyIPv4 or IPFamilyIPv6. If empty,
+	// both are used.
+	IPFamily string
+	// PortMin and PortMax restrict the local UDP ports used, e.g. to match
+	// firewall rules. If both are zero, any port is used.
+	PortMin, PortMax uint16
+	// IncludeLoopback gathers candidates on loopback interfaces, which are
+	// otherwise ignored. This allows connecting to a peer on the same host
+	// without any network.
+	IncludeLoopback bool
+}
+
+// DefaultOptions returns the options used for connecting to Nest cameras
+func DefaultOptions() Options {
+	return Options{ICEServers: []ICEServer{{URLs: []string{DefaultSTUNServer}}}}
+}
+
+// settingEngine returns the pion settings for the options
+func (o Options) settingEngine() (pionwebrtc.SettingEngine, error) {
+	settings := pionwebrtc.SettingEngine{}
+	settings.SetIncludeLoopbackCandidate(o.IncludeLoopback)
+
+	switch o.IPFamily {
+	case "":
+	case IPFamilyIPv4:
+		settings.SetNetworkTypes([]pionwebrtc.NetworkType{pionwebrtc.NetworkTypeUDP4})
+	case IPFamilyIPv6:
+		settings.SetNetworkTypes([]pionwebrtc.NetworkType{pionwebrtc.NetworkTypeUDP6})
+	default:
+		return settings, fmt.Errorf("unknown IP family %q (want %q or %q)", o.IPFamily, IPFamilyIPv4, IPFamilyIPv6)
+	}
+
+	if len(o.Interfaces) > 0 {
+		interfaces := slices.Clone(o.Interfaces)
+		settings.SetInterfaceFilter(func(name string) bool {
+			return slices.Contains(interfaces, name)
+		})
+	}
+
+	if o.PortMin != 0 || o.PortMax != 0 {
+		if err := settings.SetEphemeralUDPPortRange(o.PortMin, o.PortMax); err != nil {
+			return settings, fmt.Errorf("invalid UDP port range %d-%d: %w", o.PortMin, o.PortMax, err)
+		}
+	}
+
+	return settings, nil
+}
+
+// iceServers returns the pion ICE servers for the options
+func (o Options) iceServers() []pionwebrtc.ICEServer {
+	if o.HostOnly {
+		return nil
+	}
+	var servers []pionwebrtc.ICEServer
+	for _, server := range o.ICEServers {
+		servers = append(servers, pionwebrtc.ICEServer{
+			URLs:       server.URLs,
+			Username:   server.Username,
+			Credential: server.Credential,
+		})
+	}
+	return servers
+}
+
 // SetupWebRTC initializes the WebRTC peer connection with default codecs
-// and a Google STUN server
-func SetupWebRTC() (*PeerConnection, error) {
+// and the configured ICE servers
+func SetupWebRTC(opts Options) (*Connection, error) {
+	settings, err := opts.settingEngine()
+	if err != nil {
+		return nil, err
+	}
+
 	m := &pionwebrtc.MediaEngine{}
 	if err := m.RegisterDefaultCodecs(); err != nil {
 		return nil, fmt.Errorf("failed to register default codecs: %w", err)
@@ -40,25 +138,39 @@ func SetupWebRTC() (*PeerConnection, error) {
 		return nil, fmt.Errorf("failed to register default interceptors: %w", err)
 	}
 
-	api := pionwebrtc.NewAPI(pionwebrtc.WithMediaEngine(m), pionwebrtc.WithInterceptorRegistry(i))
-
-	pcConfig := pionwebrtc.Configuration{
-		ICEServers: []pionwebrtc.ICEServer{
-			{URLs: []string{"stun:stun.l.google.com:19302"}},
-		},
+	// Collect the stats of the received streams, which pion doesn't report
+	// itself
+	statsFactory, err := stats.NewInterceptor()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create stats interceptor: %w", err)
 	}
+	var streamStats stats.Getter
+	statsFactory.OnNewPeerConnection(func(_ string, getter stats.Getter) {
+		streamStats = getter
+	})
+	i.Add(statsFactory)
+
+	api := pionwebrtc.NewAPI(
+		pionwebrtc.WithMediaEngine(m),
+		pionwebrtc.WithInterceptorRegistry(i),
+		pionwebrtc.WithSettingEngine(settings),
+	)
+
+	pcConfig := pionwebrtc.Configuration{ICEServers: opts.iceServers()}
 
 	peerConnection, err := api.NewPeerConnection(pcConfig)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create peer connection: %w", err)
 	}
 
-	return peerConnection, nil
+	conn := newConnection(peerConnection)
+	conn.streamStats = streamStats
+	return conn, nil
 }
 
 // SetupTransceivers configures the peer connection to receive audio and video,
 // and sets up a data channel for camera control
-func SetupTransceivers(pc *PeerConnection) error {
+func SetupTransceivers(pc *Connection) error {
 	if _, err := pc.AddTransceiverFromKind(pionwebrtc.RTPCodecTypeAudio,
 		pionwebrtc.RTPTransceiverInit{Direction: pionwebrtc.RTPTransceiverDirectionRecvonly},
 	); err != nil {
@@ -89,33 +201,87 @@ func SetupTransceivers(pc *PeerConnection) error {
 	return nil
 }
 
+// iceGatherTimeout is the longest to wait for ICE candidate gathering
+const iceGatherTimeout = 20 * time.Second
+
 // CreateOffer generates a WebRTC offer and waits for ICE candidate gathering
-func CreateOffer(pc *PeerConnection) (*SessionDescription, error) {
+// to complete, for at most iceGatherTimeout or until the context is done
+func CreateOffer(ctx context.Context, pc *Connection) (*SessionDescription, error) {
 	offer, err := pc.CreateOffer(nil)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create offer: %w", err)
 	}
 
-	gatherComplete := pionwebrtc.GatheringCompletePromise(pc)
+	gatherComplete := pionwebrtc.GatheringCompletePromise(pc.PeerConnection)
 	if err = pc.SetLocalDescription(offer); err != nil {
 		return nil, fmt.Errorf("failed to set local description: %w", err)
 	}
 
+	ctx, cancel := context.WithTimeout(ctx, iceGatherTimeout)
+	defer cancel()
+
 	select {
 	case <-gatherComplete:
 		fmt.Println("ICE candidate gathering complete")
-	case <-time.After(20 * time.Second):
-		return nil, fmt.Errorf("failed to gather ICE candidates: timeout")
+	case <-ctx.Done():
+		return nil, fmt.Errorf("failed to gather ICE candidates: %w", ctx.Err())
 	}
 
 	return pc.LocalDescription(), nil
 }
 
-// writeH264ToBuffer writes H264 RTP packets to a buffer using an H264 writer.
-// Returns the buffer with the written data and any error that occurred.
-func writeH264ToBuffer(remoteTrack *TrackRemote) (*bytes.Buffer, error) {
-	buffer := &bytes.Buffer{}
-	writer := h264writer.NewWith(buffer)
+// ErrRecordingLimit is returned when a recording is stopped because it has
+// reached its size limit
+var ErrRecordingLimit = errors.New("recording size limit reached")
+
+// ErrSkippedTrack is returned for tracks that aren't recorded because they
+// aren't H264 video
+var ErrSkippedTrack = errors.New("track isn't H264 video")
+
+// RecordOptions configures how a track is recorded
+type RecordOptions struct {
+	// MaxBytes stops the recording once this much H264 data has been
+	// written. Zero means no limit.
+	MaxBytes int64
+	// OnKeyframe, if not nil, is called once the first complete keyframe
+	// (with SPS and PPS) has been written, so that the caller can stop
+	// recording early
+	OnKeyframe func()
+	// OnFrame, if not nil, is called as each frame finishes arriving
+	OnFrame func()
+}
+
+// limitWriter writes whole NAL units to w until max bytes have been written,
+// then fails with ErrRecordingLimit. It also hides w from the H264 writer,
+// which would otherwise close it.
+type limitWriter struct {
+	w       io.Writer
+	max     int64
+	written int64
+}
+
+func (l *limitWriter) Write(p []byte) (int, error) {
+	if l.max > 0 && l.written+int64(len(p)) > l.max {
+		return 0, ErrRecordingLimit
+	}
+	n, err := l.w.Write(p)
+	l.written += int64(n)
+	return n, err
+}
+
+// writeH264 writes H264 RTP packets to w using an H264 writer, calling
+// opts.OnKeyframe once the first decodable keyframe has been written.
+// Reading stops when the track ends, the context is done or the size limit is
+// reached.
+func writeH264(ctx context.Context, remoteTrack *TrackRemote, w io.Writer, opts RecordOptions) error {
+	writer := h264writer.NewWith(&limitWriter{w: w, max: opts.MaxBytes})
+	detector := &keyframeDetector{}
+
+	// Unblock ReadRTP when the context is done
+	stop := context.AfterFunc(ctx, func() {
+		_ = remoteTrack.SetReadDeadline(time.Now())
+	})
+	defer stop()
 
 	// Ensure writer is closed when we're done
 	defer func() {
@@ -127,20 +293,44 @@ func writeH264ToBuffer(remoteTrack *TrackRemote) (*bytes.Buffer, error) {
 	for {
 		rtpPacket, _, err := remoteTrack.ReadRTP()
 		if err == io.EOF {
-			return buffer, nil
+			return nil
+		}
+		if ctx.Err() != nil {
+			return fmt.Errorf("stopped reading track: %w", ctx.Err())
 		}
 		if err != nil {
-			return buffer, fmt.Errorf("track ended: %w", err)
+			return fmt.Errorf("track ended: %w", err)
 		}
-		if err := writer.WriteRTP(rtpPacket); err != nil {
-			return buffer, fmt.Errorf("failed to write RTP packet: %w", err)
+		if err := writer.WriteRTP(rtpPacket); errors.Is(err, ErrRecordingLimit) {
+			return err
+		} else if err != nil {
+			return fmt.Errorf("failed to write RTP packet: %w", err)
+		}
+		if detector.observe(rtpPacket) {
+			fmt.Println("Received first keyframe")
+			if opts.OnKeyframe != nil {
+				opts.OnKeyframe()
+			}
+		}
+		if rtpPacket.Marker && opts.OnFrame != nil {
+			opts.OnFrame()
 		}
 	}
 }
 
-// HandleTrack processes incoming media tracks, writing H264 data to a buffer
-// and ignoring other track types. Returns the buffered data if video was recorded.
-func HandleTrack(remoteTrack *TrackRemote, receiver *RTPReceiver) *bytes.Buffer {
+// IsH264Video reports whether the track is H264 video, which HandleTrack
+// records
+func IsH264Video(track *TrackRemote) bool {
+	return track.Kind() == pionwebrtc.RTPCodecTypeVideo && track.Codec().MimeType == pionwebrtc.MimeTypeH264
+}
+
+// HandleTrack processes incoming media tracks, writing H264 data to w as it
+// arrives and returning ErrSkippedTrack for other track types. w can be a
+// file, or a pipe into a decoder so that decoding starts while the recording
+// is still in progress; it isn't closed. Recording stops when the track ends,
+// the context is done or opts.MaxBytes have been written. Whatever was written
+// before an error is still valid H264 data.
+func HandleTrack(ctx context.Context, remoteTrack *TrackRemote, receiver *RTPReceiver, w io.Writer, opts RecordOptions) error {
 	codecName := remoteTrack.Codec().MimeType
 	trackType := remoteTrack.Kind().String()
 	fmt.Printf("Received track: %s, codec: %s, id: %s, ssrc: %d\n",
@@ -149,87 +339,126 @@ func HandleTrack(remoteTrack *TrackRemote, receiver *RTPReceiver) *bytes.Buffer
 	// Skip non-video tracks
 	if trackType != "video" {
 		fmt.Printf("Skipping non-video track: %s\n", trackType)
-		return nil
+		return ErrSkippedTrack
 	}
 
 	// Skip non-H264 tracks
 	if codecName != pionwebrtc.MimeTypeH264 {
 		fmt.Printf("Skipping non-H264 track: %s\n", codecName)
-		return nil
+		return ErrSkippedTrack
 	}
 
-	fmt.Println("Buffering video data...")
-	buffer, err := writeH264ToBuffer(remoteTrack)
-	if err != nil {
-		fmt.Println("Error writing H264 data:", err)
-		return buffer // Return buffer even on error as it may contain partial data
-	}
-
-	return buffer
+	fmt.Println("Recording video data...")
+	return writeH264(ctx, remoteTrack, w, opts)
 }
 
-// WaitForConnection monitors the peer connection state until it's connected
-// or fails, with a timeout
-func WaitForConnection(pc *PeerConnection, timeout time.Duration) error {
-	done := make(chan struct{})
-	failed := make(chan struct{})
+// Opus audio as sent by Nest cameras
+const (
+	opusSampleRate = 48000
+	opusChannels   = 2
+)
 
-	monitorCtx, cancelMonitor := context.WithCancel(context.Background())
-	defer cancelMonitor()
+// HandleAudioTrack records an Opus audio track to w as an Ogg stream, and
+// returns ErrSkippedTrack for other track types. w isn't closed. Recording
+// stops when the track ends or the context is done.
+func HandleAudioTrack(ctx context.Context, remoteTrack *TrackRemote, w io.Writer) error {
+	codecName := remoteTrack.Codec().MimeType
+	if remoteTrack.Kind() != pionwebrtc.RTPCodecTypeAudio || codecName != pionwebrtc.MimeTypeOpus {
+		return ErrSkippedTrack
+	}
 
-	go monitorConnectionState(pc, done, failed, monitorCtx)
+	// Hide w from the Ogg writer, which would otherwise close it
+	writer, err := oggwriter.NewWith(struct{ io.Writer }{w}, opusSampleRate, opusChannels)
+	if err != nil {
+		return fmt.Errorf("failed to create Ogg writer: %w", err)
+	}
+	defer func() {
+		if err := writer.Close(); err != nil {
+			fmt.Println("Failed to close Ogg writer:", err)
+		}
+	}()
 
-	select {
-	case <-done:
-		fmt.Println("WebRTC connection established")
-		return nil
-	case <-failed:
-		return fmt.Errorf("WebRTC connection failed")
-	case <-time.After(timeout):
-		return fmt.Errorf("failed to establish WebRTC connection: timeout")
+	// Unblock ReadRTP when the context is done
+	stop := context.AfterFunc(ctx, func() {
+		_ = remoteTrack.SetReadDeadline(time.Now())
+	})
+	defer stop()
+
+	fmt.Println("Recording audio data...")
+	for {
+		rtpPacket, _, err := remoteTrack.ReadRTP()
+		if err == io.EOF {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return fmt.Errorf("stopped reading track: %w", ctx.Err())
+		}
+		if err != nil {
+			return fmt.Errorf("track ended: %w", err)
+		}
+		if err := writer.WriteRTP(rtpPacket); err != nil {
+			return fmt.Errorf("failed to write RTP packet: %w", err)
+		}
 	}
 }
 
-// WaitForConnectionClose gracefully closes the peer connection and waits
-// for it to fully close, with a timeout
-func WaitForConnectionClose(pc *PeerConnection, timeout time.Duration) error {
-	done := make(chan struct{})
-	pc.OnConnectionStateChange(func(state pionwebrtc.PeerConnectionState) {
-		if state == pionwebrtc.PeerConnectionStateClosed {
-			close(done)
+// WaitForConnection waits until the peer connection is connected. It returns
+// an error describing why if the connection fails or closes first, or the
+// context's error if it is done first.
+func WaitForConnection(ctx context.Context, conn *Connection) error {
+	err := conn.waitForState(ctx, func(state PeerConnectionState, reason error) (bool, error) {
+		switch state {
+		case pionwebrtc.PeerConnectionStateConnected:
+			return true, nil
+		case pionwebrtc.PeerConnectionStateFailed, pionwebrtc.PeerConnectionStateClosed:
+			return true, reason
 		}
+		return false, nil
 	})
-
-	if err := pc.Close(); err != nil {
-		return fmt.Errorf("failed to close peer connection: %w", err)
+	if err != nil {
+		return fmt.Errorf("failed to establish WebRTC connection: %w", err)
 	}
 
-	select {
-	case <-done:
-		fmt.Println("WebRTC connection closed")
-		return nil
-	case <-time.After(timeout):
-		return fmt.Errorf("failed to close connection: timeout")
-	}
+	fmt.Println("WebRTC connection established")
+	return nil
 }
 
-// monitorConnectionState is a helper that watches the peer connection state
-// and signals when it's connected or failed
-func monitorConnectionState(pc *PeerConnection, done, failed chan struct{}, ctx context.Context) {
-	for {
-		select {
-		case <-ctx.Done():
-			return
-		default:
-			switch pc.ConnectionState() {
-			case pionwebrtc.PeerConnectionStateConnected:
-				close(done)
-				return
-			case pionwebrtc.PeerConnectionStateFailed, pionwebrtc.PeerConnectionStateClosed:
-				close(failed)
-				return
-			}
-			time.Sleep(500 * time.Millisecond)
+// WaitForConnectionLoss waits until an established connection fails or is
+// closed, returning the reason, or the context's error if it is done first
+func WaitForConnectionLoss(ctx context.Context, conn *Connection) error {
+	var lost error
+	err := conn.waitForState(ctx, func(state PeerConnectionState, reason error) (bool, error) {
+		switch state {
+		case pionwebrtc.PeerConnectionStateFailed, pionwebrtc.PeerConnectionStateClosed:
+			lost = reason
+			return true, nil
 		}
+		return false, nil
+	})
+	if err != nil {
+		return err
 	}
+	if lost == nil {
+		lost = ErrConnectionClosed
+	}
+	return fmt.Errorf("WebRTC connection lost: %w", lost)
+}
+
+// WaitForConnectionClose gracefully closes the peer connection and waits
+// for it to fully close, or for the context to be done
+func WaitForConnectionClose(ctx context.Context, conn *Connection) error {
+	if err := conn.Close(); err != nil {
+		return fmt.Errorf("failed to close peer connection: %w", err)
+	}
+	conn.update()
+
+	err := conn.waitForState(ctx, func(state PeerConnectionState, _ error) (bool, error) {
+		return state == pionwebrtc.PeerConnectionStateClosed, nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to close connection: %w", err)
+	}
+
+	fmt.Println("WebRTC connection closed")
+	return nil
 }
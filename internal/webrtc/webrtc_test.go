@@ -0,0 +1,67 @@
+package webrtc
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestSetupWebRTCOptions(t *testing.T) {
+	turn := ICEServer{URLs: []string{"turn:turn.example.com:3478"}, Username: "user", Credential: "secret"}
+
+	tests := []struct {
+		name        string
+		opts        Options
+		wantErr     bool
+		wantServers int
+	}{
+		{"default", DefaultOptions(), false, 1},
+		{"turn", Options{ICEServers: []ICEServer{turn}, IPFamily: IPFamilyIPv4}, false, 1},
+		{"host only", Options{ICEServers: []ICEServer{turn}, HostOnly: true}, false, 0},
+		{"port range", Options{PortMin: 50000, PortMax: 50100, Interfaces: []string{"eth0"}}, false, 0},
+		{"reversed port range", Options{PortMin: 50100, PortMax: 50000}, true, 0},
+		{"unknown IP family", Options{IPFamily: "ipx"}, true, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, err := SetupWebRTC(tt.opts)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("SetupWebRTC() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+
+			servers := conn.GetConfiguration().ICEServers
+			if len(servers) != tt.wantServers {
+				t.Errorf("ICE servers = %v, want %d", servers, tt.wantServers)
+			}
+		})
+	}
+}
+
+func TestLimitWriter(t *testing.T) {
+	var out bytes.Buffer
+	w := &limitWriter{w: &out, max: 10}
+
+	for _, nalu := range []string{"abcd", "efgh"} {
+		if _, err := w.Write([]byte(nalu)); err != nil {
+			t.Fatalf("Write(%q) error = %v", nalu, err)
+		}
+	}
+	// A NAL unit that doesn't fit isn't written at all
+	if _, err := w.Write([]byte("ijkl")); !errors.Is(err, ErrRecordingLimit) {
+		t.Errorf("Write() past the limit error = %v, want %v", err, ErrRecordingLimit)
+	}
+	if got := out.String(); got != "abcdefgh" {
+		t.Errorf("written %q, want %q", got, "abcdefgh")
+	}
+
+	unlimited := &limitWriter{w: io.Discard}
+	if _, err := unlimited.Write(make([]byte, 1<<20)); err != nil {
+		t.Errorf("Write() without a limit error = %v", err)
+	}
+}
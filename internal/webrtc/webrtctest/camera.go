@@ -0,0 +1,232 @@
+// Package webrtctest provides a fake Nest camera WebRTC peer for tests. The
+// camera answers offers and streams canned H264 video, with silent Opus audio,
+// over loopback, so the capture path can be exercised without a network.
+package webrtctest
+
+import (
+	"bytes"
+	_ "embed"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	pionwebrtc "github.com/pion/webrtc/v4"
+	"github.com/pion/webrtc/v4/pkg/media"
+	"github.com/pion/webrtc/v4/pkg/media/h264reader"
+)
+
+// SampleH264 is a one second H264 clip of 32x32 frames of flat grey, each a
+// keyframe preceded by its SPS and PPS
+//
+//go:embed testdata/camera.h264
+var SampleH264 []byte
+
+// frameDuration is how long each frame is shown for
+const frameDuration = 100 * time.Millisecond
+
+// opusSilence is a 20ms Opus frame of silence
+var opusSilence = []byte{0xF8, 0xFF, 0xFE}
+
+// opusFrameDuration is how long each Opus frame lasts
+const opusFrameDuration = 20 * time.Millisecond
+
+// gatherTimeout is the longest to wait for the camera to gather candidates
+const gatherTimeout = 5 * time.Second
+
+// Camera is a fake camera that answers WebRTC offers and streams H264 video
+// and Opus audio to each peer that connects, looping over the frames until it
+// is closed
+type Camera struct {
+	frames [][]byte
+
+	mu     sync.Mutex
+	peers  []*pionwebrtc.PeerConnection
+	closed bool
+	done   chan struct{}
+
+	// videoTracks is how many video tracks are offered to each peer
+	videoTracks int
+}
+
+// NewCamera returns a camera streaming the Annex B H264 video
+func NewCamera(h264 []byte) (*Camera, error) {
+	frames, err := splitFrames(h264)
+	if err != nil {
+		return nil, err
+	}
+	return &Camera{frames: frames, videoTracks: 1, done: make(chan struct{})}, nil
+}
+
+// SetVideoTracks sets how many video tracks, each streaming the same video,
+// are offered to peers that connect after it is called. Only as many are sent
+// as the peer's offer has video transceivers for.
+func (c *Camera) SetVideoTracks(n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.videoTracks = n
+}
+
+// splitFrames splits Annex B H264 video into access units, each ending with
+// the slice of a frame
+func splitFrames(h264 []byte) ([][]byte, error) {
+	reader, err := h264reader.NewReader(bytes.NewReader(h264))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read H264: %w", err)
+	}
+
+	var frames [][]byte
+	var frame []byte
+	for {
+		nal, err := reader.NextNAL()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read NAL unit: %w", err)
+		}
+		frame = append(frame, 0, 0, 0, 1)
+		frame = append(frame, nal.Data...)
+		if nal.UnitType == h264reader.NalUnitTypeCodedSliceNonIdr || nal.UnitType == h264reader.NalUnitTypeCodedSliceIdr {
+			frames = append(frames, frame)
+			frame = nil
+		}
+	}
+	if len(frames) == 0 {
+		return nil, errors.New("no frames in H264 video")
+	}
+	return frames, nil
+}
+
+// Answer creates a peer for the offer and returns its answer SDP, for use as
+// the answer function of a fake SDM server
+func (c *Camera) Answer(offerSDP string) (string, error) {
+	settings := pionwebrtc.SettingEngine{}
+	settings.SetIncludeLoopbackCandidate(true)
+
+	m := &pionwebrtc.MediaEngine{}
+	if err := m.RegisterDefaultCodecs(); err != nil {
+		return "", fmt.Errorf("failed to register default codecs: %w", err)
+	}
+	api := pionwebrtc.NewAPI(pionwebrtc.WithMediaEngine(m), pionwebrtc.WithSettingEngine(settings))
+
+	pc, err := api.NewPeerConnection(pionwebrtc.Configuration{})
+	if err != nil {
+		return "", fmt.Errorf("failed to create peer connection: %w", err)
+	}
+	if !c.addPeer(pc) {
+		pc.Close()
+		return "", errors.New("camera is closed")
+	}
+
+	c.mu.Lock()
+	videoTracks := c.videoTracks
+	c.mu.Unlock()
+	var tracks []*pionwebrtc.TrackLocalStaticSample
+	for i := range videoTracks {
+		track, err := pionwebrtc.NewTrackLocalStaticSample(
+			pionwebrtc.RTPCodecCapability{MimeType: pionwebrtc.MimeTypeH264}, fmt.Sprintf("video%d", i), "camera")
+		if err != nil {
+			return "", fmt.Errorf("failed to create track: %w", err)
+		}
+		if _, err := pc.AddTrack(track); err != nil {
+			return "", fmt.Errorf("failed to add track: %w", err)
+		}
+		tracks = append(tracks, track)
+	}
+	audioTrack, err := pionwebrtc.NewTrackLocalStaticSample(
+		pionwebrtc.RTPCodecCapability{MimeType: pionwebrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2}, "audio", "camera")
+	if err != nil {
+		return "", fmt.Errorf("failed to create audio track: %w", err)
+	}
+	if _, err := pc.AddTrack(audioTrack); err != nil {
+		return "", fmt.Errorf("failed to add audio track: %w", err)
+	}
+
+	pc.OnConnectionStateChange(func(state pionwebrtc.PeerConnectionState) {
+		if state == pionwebrtc.PeerConnectionStateConnected {
+			go c.stream(pc, tracks, audioTrack)
+		}
+	})
+
+	offer := pionwebrtc.SessionDescription{Type: pionwebrtc.SDPTypeOffer, SDP: offerSDP}
+	if err := pc.SetRemoteDescription(offer); err != nil {
+		return "", fmt.Errorf("failed to set remote description: %w", err)
+	}
+	answer, err := pc.CreateAnswer(nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to create answer: %w", err)
+	}
+	gatherComplete := pionwebrtc.GatheringCompletePromise(pc)
+	if err := pc.SetLocalDescription(answer); err != nil {
+		return "", fmt.Errorf("failed to set local description: %w", err)
+	}
+
+	select {
+	case <-gatherComplete:
+	case <-time.After(gatherTimeout):
+		return "", errors.New("timed out gathering ICE candidates")
+	}
+	return pc.LocalDescription().SDP, nil
+}
+
+// addPeer records the peer so it is closed with the camera, returning false
+// if the camera has already been closed
+func (c *Camera) addPeer(pc *pionwebrtc.PeerConnection) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return false
+	}
+	c.peers = append(c.peers, pc)
+	return true
+}
+
+// stream writes the frames to the video tracks, and silence to go with them to
+// the audio track, until the peer disconnects or the camera is closed
+func (c *Camera) stream(pc *pionwebrtc.PeerConnection, tracks []*pionwebrtc.TrackLocalStaticSample, audioTrack *pionwebrtc.TrackLocalStaticSample) {
+	ticker := time.NewTicker(frameDuration)
+	defer ticker.Stop()
+
+	for i := 0; ; i++ {
+		state := pc.ConnectionState()
+		if state != pionwebrtc.PeerConnectionStateConnected {
+			return
+		}
+		sample := media.Sample{Data: c.frames[i%len(c.frames)], Duration: frameDuration}
+		for _, track := range tracks {
+			if err := track.WriteSample(sample); err != nil {
+				return
+			}
+		}
+		for range frameDuration / opusFrameDuration {
+			if err := audioTrack.WriteSample(media.Sample{Data: opusSilence, Duration: opusFrameDuration}); err != nil {
+				return
+			}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// Close closes all the camera's peers
+func (c *Camera) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	close(c.done)
+
+	var errs []error
+	for _, pc := range c.peers {
+		errs = append(errs, pc.Close())
+	}
+	return errors.Join(errs...)
+}